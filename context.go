@@ -0,0 +1,116 @@
+package mals
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// 在 lua registry 中保存 with_timeout 覆盖的 context
+const contextRegistryKey = "__mals_context"
+
+// HasContext reports whether the first parameter of fn is context.Context,
+// such functions get the vm context injected instead of taking it from lua.
+func (fn *MalFunction) HasContext() bool {
+	return len(fn.ArgTypes) > 0 && fn.ArgTypes[0] == contextType
+}
+
+func isContext(v interface{}) bool {
+	_, ok := v.(context.Context)
+	return ok
+}
+
+// CallContext returns the context for a call made from L: the innermost
+// with_timeout override, the context set by the host via L.SetContext, or
+// context.Background.
+func CallContext(L *lua.LState) context.Context {
+	if ud, ok := L.GetField(L.Get(lua.RegistryIndex), contextRegistryKey).(*lua.LUserData); ok {
+		if ctx, ok := ud.Value.(context.Context); ok {
+			return ctx
+		}
+	}
+	if ctx := L.Context(); ctx != nil {
+		return ctx
+	}
+	return context.Background()
+}
+
+// functionContext 返回注入给 fn 的 context, MalFunction.Timeout 大于 0 时附加超时.
+// 返回的 context 总是可以取消, 流式调用依靠它在流结束或被关闭时释放连接
+func (fn *MalFunction) functionContext(L *lua.LState) (context.Context, context.CancelFunc) {
+	ctx := CallContext(L)
+	if fn.Timeout > 0 {
+		return context.WithTimeout(ctx, fn.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// ContextLoader is the loader of the lua "context" module.
+//
+//	local context = require("context")
+//	local resp = context.with_timeout(5, rpc.GetTasks, req)
+func ContextLoader(L *lua.LState) int {
+	mod := L.NewTable()
+	L.SetFuncs(mod, map[string]lua.LGFunction{
+		"with_timeout": contextWithTimeout,
+		"remaining":    contextRemaining,
+		"cancelled":    contextCancelled,
+	})
+	L.Push(mod)
+	return 1
+}
+
+// with_timeout(seconds, fn, ...) 在超时 context 中调用 fn, 返回 fn 的全部返回值
+func contextWithTimeout(L *lua.LState) int {
+	timeout := time.Duration(float64(L.CheckNumber(1)) * float64(time.Second))
+	fn := L.CheckFunction(2)
+	args := make([]lua.LValue, 0, L.GetTop()-2)
+	for i := 3; i <= L.GetTop(); i++ {
+		args = append(args, L.Get(i))
+	}
+
+	ctx, cancel := context.WithTimeout(CallContext(L), timeout)
+	registry := L.Get(lua.RegistryIndex)
+	previous := L.GetField(registry, contextRegistryKey)
+	ud := L.NewUserData()
+	ud.Value = ctx
+	L.SetField(registry, contextRegistryKey, ud)
+	defer func() {
+		L.SetField(registry, contextRegistryKey, previous)
+		cancel()
+	}()
+
+	base := L.GetTop()
+	L.Push(fn)
+	for _, arg := range args {
+		L.Push(arg)
+	}
+	L.Call(len(args), lua.MultRet)
+	return L.GetTop() - base
+}
+
+// remaining() 返回当前 context 剩余的秒数, 没有 deadline 时返回 nil
+func contextRemaining(L *lua.LState) int {
+	deadline, ok := CallContext(L).Deadline()
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LNumber(time.Until(deadline).Seconds()))
+	return 1
+}
+
+// cancelled() 返回当前 context 是否已结束以及原因
+func contextCancelled(L *lua.LState) int {
+	if err := CallContext(L).Err(); err != nil {
+		L.Push(lua.LTrue)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LFalse)
+	return 1
+}
@@ -0,0 +1,56 @@
+package mals
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type contextKey struct{}
+
+func TestContextInjection(t *testing.T) {
+	deadline := func(ctx context.Context) (float64, error) {
+		if d, ok := ctx.Deadline(); ok {
+			return time.Until(d).Seconds(), nil
+		}
+		return -1, nil
+	}
+	value := func(ctx context.Context, key string) string {
+		v, _ := ctx.Value(contextKey{}).(string)
+		return key + "=" + v
+	}
+	timeout := newTestFunction("m", "timeout", deadline)
+	timeout.Timeout = 30 * time.Second
+
+	r := NewRegistry()
+	if err := r.RegisterFunctions(
+		newTestFunction("m", "deadline", deadline),
+		newTestFunction("m", "value", value),
+		timeout,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, script := range map[string]string{
+		"host context": `assert(m.value("k") == "k=host")`,
+		"no deadline":  `assert(m.deadline() == -1)`,
+		"with_timeout": `
+			local left = context.with_timeout(10, m.deadline)
+			assert(left > 0 and left <= 10)
+			assert(context.remaining() == nil)`,
+		"nested with_timeout keeps values": `assert(context.with_timeout(10, m.value, "k") == "k=host")`,
+		"function timeout":                 `local left = m.timeout(); assert(left > 10 and left <= 30)`,
+		"cancelled": `
+			local cancelled, reason = context.with_timeout(0, context.cancelled)
+			assert(cancelled and reason:find("deadline"))
+			assert(not context.cancelled())`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			L := newTestVM(t, r)
+			L.SetContext(context.WithValue(context.Background(), contextKey{}, "host"))
+			if err := L.DoString(`local m, context = require("m"), require("context")` + "\n" + script); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package mals
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// 运行时加载的 descriptor, 与编译进二进制的 GlobalFiles/GlobalTypes 分开保存
+var (
+	dynamicMu    sync.RWMutex
+	dynamicFiles = new(protoregistry.Files)
+	dynamicTypes = new(protoregistry.Types)
+)
+
+// dynamicResolver 先查找已加载的动态文件, 再查找 GlobalFiles
+type dynamicResolver struct{}
+
+func (dynamicResolver) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
+	if fd, err := dynamicFiles.FindFileByPath(path); err == nil {
+		return fd, nil
+	}
+	return protoregistry.GlobalFiles.FindFileByPath(path)
+}
+
+func (dynamicResolver) FindDescriptorByName(name protoreflect.FullName) (protoreflect.Descriptor, error) {
+	if d, err := dynamicFiles.FindDescriptorByName(name); err == nil {
+		return d, nil
+	}
+	return protoregistry.GlobalFiles.FindDescriptorByName(name)
+}
+
+// LoadProtoDescriptorSet 加载 protoc --descriptor_set_out 生成的 FileDescriptorSet,
+// 其中的 message 通过 dynamicpb 创建, 可以与编译进二进制的 message 一样在 lua 中使用.
+// 已经存在于 GlobalFiles 或之前加载过的文件会被跳过, 返回新加载的 message 全名
+func LoadProtoDescriptorSet(data []byte) ([]string, error) {
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, set); err != nil {
+		return nil, fmt.Errorf("invalid FileDescriptorSet: %v", err)
+	}
+
+	dynamicMu.Lock()
+	defer dynamicMu.Unlock()
+
+	pending := make(map[string]*descriptorpb.FileDescriptorProto, len(set.File))
+	for _, file := range set.File {
+		pending[file.GetName()] = file
+	}
+	var names []string
+	var load func(file *descriptorpb.FileDescriptorProto) error
+	load = func(file *descriptorpb.FileDescriptorProto) error {
+		delete(pending, file.GetName())
+		if _, err := (dynamicResolver{}).FindFileByPath(file.GetName()); err == nil {
+			return nil
+		}
+		// 依赖可能在 set 中排在后面
+		for _, dep := range file.GetDependency() {
+			if depFile, ok := pending[dep]; ok {
+				if err := load(depFile); err != nil {
+					return err
+				}
+			}
+		}
+		fd, err := protodesc.NewFile(file, dynamicResolver{})
+		if err != nil {
+			return fmt.Errorf("%s: %v", file.GetName(), err)
+		}
+		if err := dynamicFiles.RegisterFile(fd); err != nil {
+			return fmt.Errorf("%s: %v", file.GetName(), err)
+		}
+		return registerDynamicTypes(fd.Messages(), fd.Enums(), &names)
+	}
+	for _, file := range set.File {
+		if _, ok := pending[file.GetName()]; !ok {
+			continue
+		}
+		if err := load(file); err != nil {
+			return names, err
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func registerDynamicTypes(messages protoreflect.MessageDescriptors, enums protoreflect.EnumDescriptors, names *[]string) error {
+	for i := 0; i < enums.Len(); i++ {
+		if err := dynamicTypes.RegisterEnum(dynamicpb.NewEnumType(enums.Get(i))); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < messages.Len(); i++ {
+		md := messages.Get(i)
+		if md.IsMapEntry() {
+			continue
+		}
+		if err := dynamicTypes.RegisterMessage(dynamicpb.NewMessageType(md)); err != nil {
+			return err
+		}
+		*names = append(*names, string(md.FullName()))
+		if err := registerDynamicTypes(md.Messages(), md.Enums(), names); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadProtoDescriptorSetFile 从文件加载 FileDescriptorSet
+func LoadProtoDescriptorSetFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return LoadProtoDescriptorSet(data)
+}
+
+// LoadProtoDescriptorSetFS 从 mal 包等 fs.FS 中加载 FileDescriptorSet
+func LoadProtoDescriptorSetFS(fsys fs.FS, name string) ([]string, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	return LoadProtoDescriptorSet(data)
+}
+
+// FindProtoMessageType 按全名查找 message 类型, 依次查找 GlobalTypes 与动态加载的类型
+func FindProtoMessageType(name string) (protoreflect.MessageType, error) {
+	if mt, err := protoregistry.GlobalTypes.FindMessageByName(protoreflect.FullName(name)); err == nil {
+		return mt, nil
+	}
+	dynamicMu.RLock()
+	defer dynamicMu.RUnlock()
+	if mt, err := dynamicTypes.FindMessageByName(protoreflect.FullName(name)); err == nil {
+		return mt, nil
+	}
+	return nil, fmt.Errorf("invalid message type: %s", name)
+}
+
+// FindProtoMessageTypeByURL 按 Any 的 type_url 查找 message 类型
+func FindProtoMessageTypeByURL(url string) (protoreflect.MessageType, error) {
+	if i := strings.LastIndexByte(url, '/'); i >= 0 {
+		url = url[i+1:]
+	}
+	return FindProtoMessageType(url)
+}
+
+// RangeProtoMessageTypes 遍历 GlobalTypes 与动态加载的全部 message 类型
+func RangeProtoMessageTypes(f func(protoreflect.MessageType) bool) {
+	next := true
+	protoregistry.GlobalTypes.RangeMessages(func(mt protoreflect.MessageType) bool {
+		next = f(mt)
+		return next
+	})
+	if !next {
+		return
+	}
+	dynamicMu.RLock()
+	var types []protoreflect.MessageType
+	dynamicTypes.RangeMessages(func(mt protoreflect.MessageType) bool {
+		types = append(types, mt)
+		return true
+	})
+	dynamicMu.RUnlock()
+	for _, mt := range types {
+		if !f(mt) {
+			return
+		}
+	}
+}
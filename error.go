@@ -0,0 +1,145 @@
+package mals
+
+import (
+	"errors"
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// ErrorMode 决定 Go 函数返回的 error 如何交给 lua
+type ErrorMode int
+
+const (
+	// ErrorModeDefault 继承 Registry 的设置, 都未设置时等同于 ErrorModeRaise
+	ErrorModeDefault ErrorMode = iota
+	// ErrorModeRaise 通过 vm.Error 抛出异常, 需要 pcall 捕获
+	ErrorModeRaise
+	// ErrorModeReturn 返回 nil, "error message"
+	ErrorModeReturn
+	// ErrorModeObject 返回 nil, MalError userdata, 可访问 code/message/cause
+	ErrorModeObject
+)
+
+func (mode ErrorMode) String() string {
+	switch mode {
+	case ErrorModeRaise:
+		return "raise"
+	case ErrorModeReturn:
+		return "return"
+	case ErrorModeObject:
+		return "object"
+	default:
+		return "default"
+	}
+}
+
+const MalErrorTypeName = "MalError"
+
+// MalError is an error carrying a code, Go functions may return it to give
+// scripts a machine readable reason under ErrorModeObject.
+type MalError struct {
+	Code    int
+	Message string
+	Cause   error
+}
+
+func NewMalError(code int, message string, cause error) *MalError {
+	return &MalError{Code: code, Message: message, Cause: cause}
+}
+
+func (e *MalError) Error() string {
+	if e.Cause != nil {
+		if e.Message == "" {
+			return e.Cause.Error()
+		}
+		return fmt.Sprintf("%s: %s", e.Message, e.Cause.Error())
+	}
+	return e.Message
+}
+
+func (e *MalError) Unwrap() error {
+	return e.Cause
+}
+
+// AsMalError converts any error to *MalError, plain errors get code 0.
+func AsMalError(err error) *MalError {
+	var malErr *MalError
+	if errors.As(err, &malErr) {
+		return malErr
+	}
+	return &MalError{Message: err.Error(), Cause: errors.Unwrap(err)}
+}
+
+// RegisterMalErrorType 注册 MalError 的元表
+func RegisterMalErrorType(L *lua.LState) *lua.LTable {
+	mt := L.NewTypeMetatable(MalErrorTypeName)
+	L.SetField(mt, "__index", L.NewFunction(malErrorIndex))
+	L.SetField(mt, "__tostring", L.NewFunction(malErrorToString))
+	return mt
+}
+
+// NewLuaMalError wraps err as MalError userdata, the metatable is registered
+// once per VM on first use.
+func NewLuaMalError(L *lua.LState, err error) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = AsMalError(err)
+	mt := L.GetTypeMetatable(MalErrorTypeName)
+	if mt == lua.LNil {
+		mt = RegisterMalErrorType(L)
+	}
+	L.SetMetatable(ud, mt)
+	return ud
+}
+
+func checkMalError(L *lua.LState) *MalError {
+	ud := L.CheckUserData(1)
+	if err, ok := ud.Value.(*MalError); ok {
+		return err
+	}
+	L.ArgError(1, "MalError expected")
+	return nil
+}
+
+func malErrorIndex(L *lua.LState) int {
+	err := checkMalError(L)
+	switch L.CheckString(2) {
+	case "code":
+		L.Push(lua.LNumber(err.Code))
+	case "message":
+		L.Push(lua.LString(err.Message))
+	case "cause":
+		if err.Cause == nil {
+			L.Push(lua.LNil)
+		} else {
+			L.Push(lua.LString(err.Cause.Error()))
+		}
+	case "error":
+		L.Push(lua.LString(err.Error()))
+	default:
+		L.Push(lua.LNil)
+	}
+	return 1
+}
+
+func malErrorToString(L *lua.LState) int {
+	L.Push(lua.LString(checkMalError(L).Error()))
+	return 1
+}
+
+// pushError 按照 mode 处理函数返回的 error, 返回值为 lua 函数的返回值数量
+func pushError(vm *lua.LState, mode ErrorMode, err error) int {
+	switch mode {
+	case ErrorModeReturn:
+		vm.Push(lua.LNil)
+		vm.Push(lua.LString(err.Error()))
+		return 2
+	case ErrorModeObject:
+		vm.Push(lua.LNil)
+		vm.Push(NewLuaMalError(vm, err))
+		return 2
+	default:
+		vm.Error(lua.LString(fmt.Sprintf("Error: %v", err)), 1)
+		return 0
+	}
+}
@@ -1,15 +1,20 @@
 package mals
 
 import (
-	"context"
 	"fmt"
-	"google.golang.org/protobuf/proto"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
 )
 
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Results 保存 Go 函数除 error 以外的多个返回值, 在 lua 中作为多返回值返回
+type Results []interface{}
+
 type MalFunction struct {
 	Name           string
 	Package        string
@@ -18,6 +23,9 @@ type MalFunction struct {
 	Func           func(...interface{}) (interface{}, error)
 	HasLuaCallback bool
 	NoCache        bool
+	Variadic       bool
+	ErrorMode      ErrorMode
+	Timeout        time.Duration
 	ArgTypes       []reflect.Type
 	ReturnTypes    []reflect.Type
 	*Helper
@@ -41,7 +49,7 @@ func GetInternalFuncSignature(fn interface{}) *MalFunction {
 	// 获取返回值类型
 	numReturns := fnType.NumOut()
 	// 如果最后一个返回值是 error 类型，忽略它
-	if numReturns > 0 && fnType.Out(numReturns-1) == reflect.TypeOf((*error)(nil)).Elem() {
+	if numReturns > 0 && fnType.Out(numReturns-1) == errorType {
 		numReturns--
 	}
 	returnTypes := make([]reflect.Type, numReturns)
@@ -51,6 +59,7 @@ func GetInternalFuncSignature(fn interface{}) *MalFunction {
 	return &MalFunction{
 		Raw:         fn,
 		RawName:     filepath.Base(runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()),
+		Variadic:    fnType.IsVariadic(),
 		ArgTypes:    argTypes,
 		ReturnTypes: returnTypes,
 	}
@@ -63,16 +72,25 @@ func WrapInternalFunc(fun interface{}) *MalFunction {
 		funcValue := reflect.ValueOf(fun)
 		funcType := funcValue.Type()
 
-		// 检查函数的参数数量是否匹配
-		if funcType.NumIn() != len(params) {
-			return nil, fmt.Errorf("expected %d arguments, got %d", funcType.NumIn(), len(params))
+		// 检查函数的参数数量是否匹配, 变长参数可以为空
+		numIn := funcType.NumIn()
+		if funcType.IsVariadic() {
+			if len(params) < numIn-1 {
+				return nil, fmt.Errorf("expected at least %d arguments, got %d", numIn-1, len(params))
+			}
+		} else if numIn != len(params) {
+			return nil, fmt.Errorf("expected %d arguments, got %d", numIn, len(params))
 		}
 
 		// 构建参数切片并检查参数类型
 		in := make([]reflect.Value, len(params))
 		for i, param := range params {
-			expectedType := funcType.In(i)
-			if reflect.TypeOf(param) != expectedType {
+			expectedType := paramType(funcType, i)
+			if param == nil && isNillable(expectedType) {
+				in[i] = reflect.Zero(expectedType)
+				continue
+			}
+			if !reflect.TypeOf(param).AssignableTo(expectedType) {
 				return nil, fmt.Errorf("argument %d should be %v, got %v", i+1, expectedType, reflect.TypeOf(param))
 			}
 			in[i] = reflect.ValueOf(param)
@@ -81,25 +99,143 @@ func WrapInternalFunc(fun interface{}) *MalFunction {
 		// 调用原始函数并获取返回值
 		results := funcValue.Call(in)
 
-		// 处理返回值
-		var result interface{}
-		if len(results) > 0 {
-			result = results[0].Interface()
-		}
-
+		// 最后一个返回值为 error 时单独处理
 		var err error
-		// 如果函数返回了多个值，最后一个值通常是 error
-		if len(results) > 1 {
-			if e, ok := results[len(results)-1].Interface().(error); ok {
+		if n := len(results); n > 0 && funcType.Out(n-1) == errorType {
+			if e, ok := results[n-1].Interface().(error); ok {
 				err = e
 			}
+			results = results[:n-1]
 		}
 
-		return result, err
+		// 多个返回值打包为 Results, 在 lua 中展开为多返回值
+		switch len(results) {
+		case 0:
+			return nil, err
+		case 1:
+			return results[0].Interface(), err
+		default:
+			values := make(Results, len(results))
+			for i, result := range results {
+				values[i] = result.Interface()
+			}
+			return values, err
+		}
 	}
 	return internalFunc
 }
 
+// paramType 返回第 i 个实参对应的类型, 变长部分取切片的元素类型
+func paramType(funcType reflect.Type, i int) reflect.Type {
+	if funcType.IsVariadic() && i >= funcType.NumIn()-1 {
+		return funcType.In(funcType.NumIn() - 1).Elem()
+	}
+	return funcType.In(i)
+}
+
+func isNillable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map, reflect.Func, reflect.Chan:
+		return true
+	default:
+		return false
+	}
+}
+
+// LuaArgTypes returns the parameter types visible from lua, an injected
+// context.Context is not included.
+func (fn *MalFunction) LuaArgTypes() []reflect.Type {
+	if fn.HasContext() {
+		return fn.ArgTypes[1:]
+	}
+	return fn.ArgTypes
+}
+
+// ConvertArgs converts lua arguments to LuaArgTypes, filling omitted
+// trailing parameters from the Helper defaults and spreading variadic ones.
+func (fn *MalFunction) ConvertArgs(args []interface{}) ([]interface{}, error) {
+	luaArgTypes := fn.LuaArgTypes()
+	fixed := len(luaArgTypes)
+	if fn.Variadic {
+		fixed--
+	}
+	if !fn.Variadic && len(args) > fixed {
+		return nil, fmt.Errorf("argument count mismatch: expected %d, got %d", fixed, len(args))
+	}
+
+	var params []*Param
+	if fn.Helper != nil {
+		params = fn.Helper.Params()
+	}
+	required := fixed
+	for required > 0 && required <= len(params) && params[required-1].Optional {
+		required--
+	}
+	if len(args) < required {
+		if required == fixed && !fn.Variadic {
+			return nil, fmt.Errorf("argument count mismatch: expected %d, got %d", fixed, len(args))
+		}
+		return nil, fmt.Errorf("argument count mismatch: expected at least %d, got %d", required, len(args))
+	}
+	for i := len(args); i < fixed; i++ {
+		def, err := params[i].DefaultValue(luaArgTypes[i])
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, def)
+	}
+
+	argTypes := make([]reflect.Type, len(args))
+	for i := range args {
+		if i < fixed {
+			argTypes[i] = luaArgTypes[i]
+		} else {
+			argTypes[i] = luaArgTypes[fixed].Elem()
+		}
+	}
+	return ConvertArgsToExpectedTypes(args, argTypes)
+}
+
+// Param 是 Helper.Input 中单个参数的描述
+//
+//	"name:desc"          必选参数
+//	"name?:desc"         可选参数, 缺省为零值
+//	"name=default:desc"  可选参数, 缺省为 default
+type Param struct {
+	Name        string
+	Description string
+	Optional    bool
+	Default     string
+	HasDefault  bool
+}
+
+// DefaultValue parses the default of the param into t.
+func (p *Param) DefaultValue(t reflect.Type) (interface{}, error) {
+	if !p.HasDefault || p.Default == "nil" {
+		return reflect.Zero(t).Interface(), nil
+	}
+	var v interface{}
+	var err error
+	switch t.Kind() {
+	case reflect.String:
+		v = strings.Trim(p.Default, `"'`)
+	case reflect.Bool:
+		v, err = strconv.ParseBool(p.Default)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v, err = strconv.ParseInt(p.Default, 0, 64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v, err = strconv.ParseUint(p.Default, 0, 64)
+	case reflect.Float32, reflect.Float64:
+		v, err = strconv.ParseFloat(p.Default, 64)
+	default:
+		return nil, fmt.Errorf("param %s: default value not supported for %s", p.Name, t)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("param %s: invalid default %q: %v", p.Name, p.Default, err)
+	}
+	return reflect.ValueOf(v).Convert(t).Interface(), nil
+}
+
 type Helper struct {
 	Group   string
 	Short   string
@@ -112,21 +248,30 @@ type Helper struct {
 
 func (help *Helper) FormatInput() ([]string, []string) {
 	var keys, values []string
-	if help.Input == nil {
-		return keys, values
+	for _, param := range help.Params() {
+		keys = append(keys, param.Name)
+		values = append(values, param.Description)
 	}
+	return keys, values
+}
 
+func (help *Helper) Params() []*Param {
+	var params []*Param
 	for _, input := range help.Input {
-		i := strings.Index(input, ":")
-		if i == -1 {
-			keys = append(keys, input)
-			values = append(values, "")
-		} else {
-			keys = append(keys, input[:i])
-			values = append(values, input[i+1:])
+		param := &Param{Name: input}
+		if i := strings.Index(input, ":"); i != -1 {
+			param.Name, param.Description = input[:i], input[i+1:]
 		}
+		if i := strings.Index(param.Name, "="); i != -1 {
+			param.Name, param.Default = param.Name[:i], param.Name[i+1:]
+			param.Optional, param.HasDefault = true, true
+		} else if strings.HasSuffix(param.Name, "?") {
+			param.Name = strings.TrimSuffix(param.Name, "?")
+			param.Optional = true
+		}
+		params = append(params, param)
 	}
-	return keys, values
+	return params
 }
 
 func (help *Helper) FormatOutput() ([]string, []string) {
@@ -147,69 +292,3 @@ func (help *Helper) FormatOutput() ([]string, []string) {
 	}
 	return keys, values
 }
-
-func RegisterGRPCBuiltin(pkg string, rpc interface{}) []*MalFunction {
-	rpcType := reflect.TypeOf(rpc)
-	rpcValue := reflect.ValueOf(rpc)
-	var funcs []*MalFunction
-	for i := 0; i < rpcType.NumMethod(); i++ {
-		method := rpcType.Method(i)
-		methodName := method.Name
-
-		// 忽略流式方法
-		methodReturnType := method.Type.Out(0)
-		if methodReturnType.Kind() == reflect.Interface && methodReturnType.Name() == "ClientStream" {
-			continue
-		}
-
-		// 将方法包装为 InternalFunc
-		rpcFunc := func(args ...interface{}) (interface{}, error) {
-			if len(args) != 2 {
-				return nil, fmt.Errorf("expected 2 arguments: context and proto.Message")
-			}
-
-			ctx, ok := args[0].(context.Context)
-			if !ok {
-				return nil, fmt.Errorf("first argument must be context.Context")
-			}
-
-			msg, ok := args[1].(proto.Message)
-			if !ok {
-				return nil, fmt.Errorf("second argument must be proto.Message")
-			}
-
-			// 准备调用方法的参数列表
-			callArgs := []reflect.Value{
-				reflect.ValueOf(ctx), // context.Context
-				reflect.ValueOf(msg), // proto.Message
-			}
-
-			// 调用方法
-			results := rpcValue.MethodByName(methodName).Call(callArgs)
-
-			// 处理返回值
-			var result interface{}
-			if len(results) > 0 {
-				result = results[0].Interface()
-			}
-
-			var err error
-			if len(results) > 1 {
-				if e, ok := results[1].Interface().(error); ok {
-					err = e
-				}
-			}
-
-			return result, err
-		}
-
-		// 创建 InternalFunc 实例并设置真实的参数和返回值类型
-		internalFunc := GetInternalFuncSignature(method.Func.Interface())
-		internalFunc.Func = rpcFunc
-		internalFunc.ArgTypes = internalFunc.ArgTypes[1:3]
-		internalFunc.Package = pkg
-		internalFunc.Name = methodName
-		funcs = append(funcs, internalFunc)
-	}
-	return funcs
-}
@@ -0,0 +1,66 @@
+package mals
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConvertArgs(t *testing.T) {
+	fixed := WrapInternalFunc(func(name string, count int, verbose bool) string { return "" })
+	fixed.Helper = &Helper{Input: []string{"name:target", "count=3:retries", "verbose?:log more"}}
+	variadic := WrapInternalFunc(func(sep string, parts ...string) string { return "" })
+	variadic.Helper = &Helper{Input: []string{"sep=',':separator", "parts:values"}}
+
+	for name, tc := range map[string]struct {
+		fn   *MalFunction
+		args []interface{}
+		want []interface{}
+		err  string
+	}{
+		"all given":        {fn: fixed, args: []interface{}{"a", int64(5), true}, want: []interface{}{"a", 5, true}},
+		"default":          {fn: fixed, args: []interface{}{"a"}, want: []interface{}{"a", 3, false}},
+		"optional zero":    {fn: fixed, args: []interface{}{"a", int64(1)}, want: []interface{}{"a", 1, false}},
+		"missing required": {fn: fixed, args: []interface{}{}, err: "expected at least 1, got 0"},
+		"too many":         {fn: fixed, args: []interface{}{"a", int64(1), true, "x"}, err: "expected 3, got 4"},
+		"variadic empty":   {fn: variadic, args: []interface{}{}, want: []interface{}{","}},
+		"variadic spread":  {fn: variadic, args: []interface{}{"-", "a", int64(1)}, want: []interface{}{"-", "a", "1"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := tc.fn.ConvertArgs(tc.args)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %#v, want %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResultsExpansion(t *testing.T) {
+	r := NewRegistry()
+	if err := r.RegisterFunctions(
+		newTestFunction("m", "pair", func(a int) (int, string, error) { return a + 1, "ok", nil }),
+		newTestFunction("m", "single", func() (string, error) { return "one", nil }),
+		newTestFunction("m", "join", func(sep string, parts ...string) string { return strings.Join(parts, sep) }),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestVM(t, r).DoString(`
+		local m = require("m")
+		local n, s, extra = m.pair(1)
+		assert(n == 2 and s == "ok" and extra == nil)
+		assert(select("#", m.single()) == 1)
+		assert(m.join("-", "a", "b", "c") == "a-b-c")
+		assert(m.join("-") == "")
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
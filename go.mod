@@ -4,6 +4,7 @@ go 1.20
 
 require (
 	al.essio.dev/pkg/shellescape v1.5.1
+	github.com/Masterminds/semver/v3 v3.2.1
 	github.com/cbroglie/mustache v1.4.0
 	github.com/chainreactors/logs v0.0.0-20241115105204-6132e39f5261
 	github.com/chainreactors/utils v0.0.0-20241209140746-65867d2f78b2
@@ -17,6 +18,7 @@ require (
 	github.com/tengattack/gluacrypto v0.0.0-20240324200146-54b58c95c255
 	github.com/yuin/gluamapper v0.0.0-20150323120927-d836955830e7
 	github.com/yuin/gopher-lua v1.1.1
+	golang.org/x/crypto v0.14.0
 	google.golang.org/protobuf v1.34.1
 	gopkg.in/yaml.v3 v3.0.1
 	layeh.com/gopher-luar v1.0.11
@@ -32,4 +34,5 @@ require (
 	github.com/mitchellh/mapstructure v1.5.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/twmb/murmur3 v1.1.8 // indirect
+	golang.org/x/sys v0.13.0 // indirect
 )
@@ -0,0 +1,561 @@
+package mals
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+const (
+	GRPCStreamSenderTypeName   = "GRPCStreamSender"
+	GRPCStreamReceiverTypeName = "GRPCStreamReceiver"
+)
+
+var protoMessageType = reflect.TypeOf((*proto.Message)(nil)).Elem()
+
+type grpcMethodKind int
+
+const (
+	grpcUnknown grpcMethodKind = iota
+	grpcUnary
+	grpcServerStream
+	grpcClientStream
+	grpcBidiStream
+)
+
+// grpcMethodType 根据 grpc 生成的 client 方法签名判断调用类型, methodType 包含 receiver
+//
+//	Unary:        (ctx, *Req, ...CallOption) (*Resp, error)
+//	ServerStream: (ctx, *Req, ...CallOption) (Svc_MethodClient, error)
+//	ClientStream: (ctx, ...CallOption) (Svc_MethodClient, error)  // Send + CloseAndRecv
+//	BidiStream:   (ctx, ...CallOption) (Svc_MethodClient, error)  // Send + Recv
+func grpcMethodType(methodType reflect.Type) grpcMethodKind {
+	if methodType.NumIn() < 2 || methodType.In(1) != contextType || methodType.NumOut() != 2 {
+		return grpcUnknown
+	}
+	out := methodType.Out(0)
+	_, hasSend := out.MethodByName("Send")
+	_, hasRecv := out.MethodByName("Recv")
+	_, hasCloseAndRecv := out.MethodByName("CloseAndRecv")
+	withRequest := methodType.NumIn() > 2 && methodType.In(2).Implements(protoMessageType)
+
+	switch {
+	case withRequest && out.Implements(protoMessageType):
+		return grpcUnary
+	case withRequest && hasRecv && !hasSend:
+		return grpcServerStream
+	case !withRequest && hasSend && hasCloseAndRecv:
+		return grpcClientStream
+	case !withRequest && hasSend && hasRecv:
+		return grpcBidiStream
+	default:
+		return grpcUnknown
+	}
+}
+
+// RegisterGRPCBuiltin 将 grpc client 的方法包装为 MalFunction.
+// 服务端流返回迭代器, 客户端流返回 GRPCStreamSender, 双向流返回 sender 与迭代器
+//
+//	for msg in rpc.Watch(req) do ... end
+//	local sender = rpc.Upload(); sender:send(req); local resp = sender:close_and_recv()
+//	local sender, recv = rpc.Chat(); sender:send(req); for msg in recv do ... end
+//
+// 提前退出循环时调用 recv:close() 或 sender:cancel() 释放流, 否则流在 VM 的 context 结束时释放
+func RegisterGRPCBuiltin(pkg string, rpc interface{}) []*MalFunction {
+	rpcType := reflect.TypeOf(rpc)
+	rpcValue := reflect.ValueOf(rpc)
+	serviceHint := grpcServiceHint(rpcType)
+	var funcs []*MalFunction
+	for i := 0; i < rpcType.NumMethod(); i++ {
+		method := rpcType.Method(i)
+		methodValue := rpcValue.Method(i)
+		kind := grpcMethodType(method.Type)
+		if kind == grpcUnknown {
+			continue
+		}
+
+		// 创建 InternalFunc 实例并设置真实的参数和返回值类型
+		internalFunc := GetInternalFuncSignature(method.Func.Interface())
+		internalFunc.Variadic = false
+		internalFunc.Package = pkg
+		internalFunc.Name = method.Name
+
+		switch kind {
+		case grpcUnary:
+			internalFunc.Func = grpcUnaryFunc(methodValue)
+			internalFunc.ArgTypes = internalFunc.ArgTypes[1:3]
+		case grpcServerStream:
+			stream := method.Type.Out(0)
+			recv, _ := stream.MethodByName("Recv")
+			internalFunc.Func = grpcServerStreamFunc(methodValue)
+			internalFunc.ArgTypes = internalFunc.ArgTypes[1:3]
+			internalFunc.ReturnTypes = []reflect.Type{grpcIteratorType(recv.Type.Out(0))}
+		case grpcClientStream:
+			internalFunc.Func = grpcClientStreamFunc(methodValue, false)
+			internalFunc.ArgTypes = internalFunc.ArgTypes[1:2]
+			internalFunc.ReturnTypes = []reflect.Type{reflect.TypeOf(&GRPCStreamSender{})}
+		case grpcBidiStream:
+			stream := method.Type.Out(0)
+			recv, _ := stream.MethodByName("Recv")
+			internalFunc.Func = grpcClientStreamFunc(methodValue, true)
+			internalFunc.ArgTypes = internalFunc.ArgTypes[1:2]
+			internalFunc.ReturnTypes = []reflect.Type{reflect.TypeOf(&GRPCStreamSender{}), grpcIteratorType(recv.Type.Out(0))}
+		}
+		internalFunc.Helper = grpcHelper(pkg, serviceHint, method, kind)
+		funcs = append(funcs, internalFunc)
+	}
+	return funcs
+}
+
+// grpcIteratorType 仅用于生成定义文件, 表示返回值为迭代器函数
+func grpcIteratorType(elem reflect.Type) reflect.Type {
+	return reflect.FuncOf(nil, []reflect.Type{elem}, false)
+}
+
+func callGRPCMethod(method reflect.Value, args ...interface{}) (interface{}, error) {
+	callArgs := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		callArgs[i] = reflect.ValueOf(arg)
+	}
+	results := method.Call(callArgs)
+
+	// 处理返回值
+	var err error
+	if e, ok := results[1].Interface().(error); ok {
+		err = e
+	}
+	return results[0].Interface(), err
+}
+
+func grpcUnaryFunc(method reflect.Value) func(args ...interface{}) (interface{}, error) {
+	return func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("expected 2 arguments: context and proto.Message")
+		}
+
+		ctx, ok := args[0].(context.Context)
+		if !ok {
+			return nil, fmt.Errorf("first argument must be context.Context")
+		}
+
+		msg, ok := args[1].(proto.Message)
+		if !ok {
+			return nil, fmt.Errorf("second argument must be proto.Message")
+		}
+
+		return callGRPCMethod(method, ctx, msg)
+	}
+}
+
+func grpcServerStreamFunc(method reflect.Value) func(args ...interface{}) (interface{}, error) {
+	return func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("expected 2 arguments: context and proto.Message")
+		}
+
+		ctx, ok := args[0].(context.Context)
+		if !ok {
+			return nil, fmt.Errorf("first argument must be context.Context")
+		}
+
+		msg, ok := args[1].(proto.Message)
+		if !ok {
+			return nil, fmt.Errorf("second argument must be proto.Message")
+		}
+
+		stream, err := callGRPCMethod(method, ctx, msg)
+		if err != nil {
+			return nil, err
+		}
+		return &GRPCStreamReceiver{grpcStream: newGRPCStream(stream)}, nil
+	}
+}
+
+func grpcClientStreamFunc(method reflect.Value, bidi bool) func(args ...interface{}) (interface{}, error) {
+	return func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("expected 1 argument: context")
+		}
+
+		ctx, ok := args[0].(context.Context)
+		if !ok {
+			return nil, fmt.Errorf("first argument must be context.Context")
+		}
+
+		stream, err := callGRPCMethod(method, ctx)
+		if err != nil {
+			return nil, err
+		}
+		s := newGRPCStream(stream)
+		if bidi {
+			return Results{&GRPCStreamSender{grpcStream: s}, &GRPCStreamReceiver{grpcStream: s}}, nil
+		}
+		return &GRPCStreamSender{grpcStream: s}, nil
+	}
+}
+
+// grpcStream 通过反射调用生成代码中的 Send/Recv/CloseSend/CloseAndRecv
+type grpcStream struct {
+	stream reflect.Value
+	cancel context.CancelFunc
+	done   bool
+}
+
+func newGRPCStream(stream interface{}) *grpcStream {
+	return &grpcStream{stream: reflect.ValueOf(stream)}
+}
+
+// bindCancel 让流持有调用时创建的 context, 直到流结束才取消
+func (s *grpcStream) bindCancel(cancel context.CancelFunc) {
+	s.cancel = cancel
+}
+
+func (s *grpcStream) finish() {
+	s.done = true
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+}
+
+func (s *grpcStream) call(name string, args ...reflect.Value) ([]reflect.Value, error) {
+	method := s.stream.MethodByName(name)
+	if !method.IsValid() {
+		return nil, fmt.Errorf("stream does not support %s", name)
+	}
+	results := method.Call(args)
+	if e, ok := results[len(results)-1].Interface().(error); ok && e != nil {
+		return nil, e
+	}
+	return results[:len(results)-1], nil
+}
+
+func (s *grpcStream) send(value interface{}) error {
+	if s.done {
+		return errors.New("stream already closed")
+	}
+	method := s.stream.MethodByName("Send")
+	args, err := ConvertArgsToExpectedTypes([]interface{}{value}, []reflect.Type{method.Type().In(0)})
+	if err != nil {
+		return err
+	}
+	_, err = s.call("Send", reflect.ValueOf(args[0]))
+	return err
+}
+
+// recv 返回下一条消息, 流结束时返回 nil, nil
+func (s *grpcStream) recv() (interface{}, error) {
+	if s.done {
+		return nil, nil
+	}
+	results, err := s.call("Recv")
+	if err == io.EOF {
+		s.finish()
+		return nil, nil
+	} else if err != nil {
+		s.finish()
+		return nil, err
+	}
+	return results[0].Interface(), nil
+}
+
+// GRPCStreamSender is the lua handle of the sending side of a client or bidi stream.
+type GRPCStreamSender struct {
+	*grpcStream
+}
+
+// GRPCStreamReceiver is converted to a lua iterator over the received messages.
+type GRPCStreamReceiver struct {
+	*grpcStream
+}
+
+type cancelBinder interface {
+	bindCancel(context.CancelFunc)
+}
+
+// bindStreamCancel 将 cancel 交给返回值中的流, 返回是否已交出
+func bindStreamCancel(result interface{}, cancel context.CancelFunc) bool {
+	values := []interface{}{result}
+	if results, ok := result.(Results); ok {
+		values = results
+	}
+	for _, value := range values {
+		if binder, ok := value.(cancelBinder); ok {
+			binder.bindCancel(cancel)
+			return true
+		}
+	}
+	return false
+}
+
+// NewLuaStreamIterator 将 receiver 封装为可以直接用于 for ... in 的 userdata, 流结束时返回 nil, 出错时抛出异常.
+// close 方法用于提前结束接收并释放流
+func NewLuaStreamIterator(L *lua.LState, receiver *GRPCStreamReceiver) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = receiver
+	mt := L.GetTypeMetatable(GRPCStreamReceiverTypeName)
+	if mt == lua.LNil {
+		mt = RegisterGRPCStreamReceiverType(L)
+	}
+	L.SetMetatable(ud, mt)
+	return ud
+}
+
+// RegisterGRPCStreamReceiverType 注册 GRPCStreamReceiver 元表
+func RegisterGRPCStreamReceiverType(L *lua.LState) *lua.LTable {
+	mt := L.NewTypeMetatable(GRPCStreamReceiverTypeName)
+	L.SetField(mt, "__call", L.NewFunction(streamRecv))
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"recv":  streamRecv,
+		"close": streamCancel,
+	}))
+	return mt
+}
+
+func checkStream(L *lua.LState) *grpcStream {
+	ud := L.CheckUserData(1)
+	switch v := ud.Value.(type) {
+	case *GRPCStreamReceiver:
+		return v.grpcStream
+	case *GRPCStreamSender:
+		return v.grpcStream
+	}
+	L.ArgError(1, "grpc stream expected")
+	return nil
+}
+
+func streamRecv(L *lua.LState) int {
+	msg, err := checkStream(L).recv()
+	if err != nil {
+		L.RaiseError("stream recv: %s", err.Error())
+		return 0
+	}
+	if msg == nil {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(ConvertGoValueToLua(L, msg))
+	return 1
+}
+
+// streamCancel 取消流的 context, 之后 recv 返回 nil, send 返回错误
+func streamCancel(L *lua.LState) int {
+	checkStream(L).finish()
+	return 0
+}
+
+// NewLuaStreamSender 将 sender 封装为带 send/close/close_and_recv 方法的 userdata
+func NewLuaStreamSender(L *lua.LState, sender *GRPCStreamSender) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = sender
+	L.SetMetatable(ud, RegisterGRPCStreamType(L))
+	return ud
+}
+
+// RegisterGRPCStreamType 注册 GRPCStreamSender 元表
+func RegisterGRPCStreamType(L *lua.LState) *lua.LTable {
+	mt := L.NewTypeMetatable(GRPCStreamSenderTypeName)
+	L.SetField(mt, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"send":           streamSend,
+		"close":          streamClose,
+		"close_and_recv": streamCloseAndRecv,
+		"cancel":         streamCancel,
+	}))
+	return mt
+}
+
+func checkStreamSender(L *lua.LState) *GRPCStreamSender {
+	ud := L.CheckUserData(1)
+	if sender, ok := ud.Value.(*GRPCStreamSender); ok {
+		return sender
+	}
+	L.ArgError(1, "GRPCStreamSender expected")
+	return nil
+}
+
+func streamSend(L *lua.LState) int {
+	sender := checkStreamSender(L)
+	if err := sender.send(ConvertLuaValueToGo(L.CheckAny(2))); err != nil {
+		L.RaiseError("stream send: %s", err.Error())
+	}
+	return 0
+}
+
+// close 结束发送, 双向流仍可继续接收
+func streamClose(L *lua.LState) int {
+	sender := checkStreamSender(L)
+	if _, err := sender.call("CloseSend"); err != nil {
+		L.RaiseError("stream close: %s", err.Error())
+	}
+	return 0
+}
+
+func streamCloseAndRecv(L *lua.LState) int {
+	sender := checkStreamSender(L)
+	results, err := sender.call("CloseAndRecv")
+	sender.finish()
+	if err != nil {
+		L.RaiseError("stream close_and_recv: %s", err.Error())
+		return 0
+	}
+	L.Push(ConvertGoValueToLua(L, results[0].Interface()))
+	return 1
+}
+
+// grpcServiceHint 根据生成的 client 类型名推断服务名, 如 rootRPCClient -> rootRPC
+func grpcServiceHint(rpcType reflect.Type) string {
+	for rpcType.Kind() == reflect.Ptr {
+		rpcType = rpcType.Elem()
+	}
+	return strings.TrimSuffix(rpcType.Name(), "Client")
+}
+
+// streamMethodIn 返回流方法的第 i 个参数类型, 非接口类型的方法包含 receiver
+func streamMethodIn(stream reflect.Type, method reflect.Method, i int) reflect.Type {
+	if stream.Kind() == reflect.Interface {
+		return method.Type.In(i)
+	}
+	return method.Type.In(i + 1)
+}
+
+// grpcMessageTypes 返回 grpc 方法的请求与响应 message 类型
+func grpcMessageTypes(method reflect.Method, kind grpcMethodKind) (req, resp reflect.Type) {
+	stream := method.Type.Out(0)
+	switch kind {
+	case grpcUnary:
+		return method.Type.In(2), stream
+	case grpcServerStream:
+		recv, _ := stream.MethodByName("Recv")
+		return method.Type.In(2), recv.Type.Out(0)
+	case grpcClientStream:
+		send, _ := stream.MethodByName("Send")
+		closeAndRecv, _ := stream.MethodByName("CloseAndRecv")
+		return streamMethodIn(stream, send, 0), closeAndRecv.Type.Out(0)
+	case grpcBidiStream:
+		send, _ := stream.MethodByName("Send")
+		recv, _ := stream.MethodByName("Recv")
+		return streamMethodIn(stream, send, 0), recv.Type.Out(0)
+	}
+	return nil, nil
+}
+
+func messageDescriptorOf(t reflect.Type) protoreflect.MessageDescriptor {
+	if t == nil || t.Kind() != reflect.Ptr || !t.Implements(protoMessageType) {
+		return nil
+	}
+	return reflect.New(t.Elem()).Interface().(proto.Message).ProtoReflect().Descriptor()
+}
+
+// findGRPCMethodDescriptor 在 protoregistry.GlobalFiles 中按方法名与请求类型查找方法描述,
+// 多个服务匹配时优先选择与 serviceHint 同名的服务
+func findGRPCMethodDescriptor(serviceHint, name string, input protoreflect.FullName) protoreflect.MethodDescriptor {
+	var found protoreflect.MethodDescriptor
+	protoregistry.GlobalFiles.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		services := fd.Services()
+		for i := 0; i < services.Len(); i++ {
+			md := services.Get(i).Methods().ByName(protoreflect.Name(name))
+			if md == nil || (input != "" && md.Input().FullName() != input) {
+				continue
+			}
+			if strings.EqualFold(string(services.Get(i).Name()), serviceHint) {
+				found = md
+				return false
+			}
+			if found == nil {
+				found = md
+			}
+		}
+		return true
+	})
+	return found
+}
+
+func protoComments(desc protoreflect.Descriptor) string {
+	if desc == nil || desc.ParentFile() == nil {
+		return ""
+	}
+	return strings.TrimSpace(desc.ParentFile().SourceLocations().ByDescriptor(desc).LeadingComments)
+}
+
+// protoMessageFieldsDoc 列出 message 的字段, 每行 "- name type comment"
+func protoMessageFieldsDoc(md protoreflect.MessageDescriptor) []string {
+	var lines []string
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		line := fmt.Sprintf("- %s %s", field.Name(), protoFieldToLuaType(field))
+		if comment := protoComments(field); comment != "" {
+			line += " " + strings.Join(strings.Fields(comment), " ")
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// grpcHelper 根据 protobuf 描述生成 grpc 方法的 Helper
+func grpcHelper(pkg, serviceHint string, method reflect.Method, kind grpcMethodKind) *Helper {
+	reqType, respType := grpcMessageTypes(method, kind)
+	req, resp := messageDescriptorOf(reqType), messageDescriptorOf(respType)
+	if req == nil || resp == nil {
+		return nil
+	}
+	reqName, respName := removePrefix(string(req.FullName())), removePrefix(string(resp.FullName()))
+
+	helper := &Helper{CMDName: method.Name}
+	signature := fmt.Sprintf("rpc %s(%s) returns (%s)", method.Name, req.FullName(), resp.FullName())
+	switch kind {
+	case grpcServerStream:
+		signature = fmt.Sprintf("rpc %s(%s) returns (stream %s)", method.Name, req.FullName(), resp.FullName())
+	case grpcClientStream:
+		signature = fmt.Sprintf("rpc %s(stream %s) returns (%s)", method.Name, req.FullName(), resp.FullName())
+	case grpcBidiStream:
+		signature = fmt.Sprintf("rpc %s(stream %s) returns (stream %s)", method.Name, req.FullName(), resp.FullName())
+	}
+
+	var comment string
+	if md := findGRPCMethodDescriptor(serviceHint, method.Name, req.FullName()); md != nil {
+		helper.Group = string(md.Parent().Name())
+		comment = protoComments(md)
+	}
+	if comment != "" {
+		helper.Short = strings.TrimSpace(strings.SplitN(comment, "\n", 2)[0])
+	} else {
+		helper.Short = signature
+	}
+
+	var long []string
+	if comment != "" {
+		long = append(long, comment, "", signature, "")
+	}
+	long = append(long, reqName+":")
+	long = append(long, protoMessageFieldsDoc(req)...)
+	long = append(long, "", respName+":")
+	long = append(long, protoMessageFieldsDoc(resp)...)
+	helper.Long = strings.Join(long, "\n")
+
+	switch kind {
+	case grpcUnary:
+		helper.Input = []string{"req:" + reqName}
+		helper.Output = []string{"resp:" + respName}
+		helper.Example = fmt.Sprintf("local resp = %s.%s(%s.New({}))", pkg, method.Name, reqName)
+	case grpcServerStream:
+		helper.Input = []string{"req:" + reqName}
+		helper.Output = []string{"iter:iterator of " + respName}
+		helper.Example = fmt.Sprintf("for msg in %s.%s(%s.New({})) do\n  print(msg)\nend", pkg, method.Name, reqName)
+	case grpcClientStream:
+		helper.Output = []string{fmt.Sprintf("sender:send %s, close_and_recv returns %s", reqName, respName)}
+		helper.Example = fmt.Sprintf("local sender = %s.%s()\nsender:send(%s.New({}))\nlocal resp = sender:close_and_recv()", pkg, method.Name, reqName)
+	case grpcBidiStream:
+		helper.Output = []string{"sender:send " + reqName, "iter:iterator of " + respName}
+		helper.Example = fmt.Sprintf("local sender, recv = %s.%s()\nsender:send(%s.New({}))\nsender:close()\nfor msg in recv do\n  print(msg)\nend", pkg, method.Name, reqName)
+	}
+	return helper
+}
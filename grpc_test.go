@@ -0,0 +1,152 @@
+package mals
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// fakeRPCClient 与 grpc 生成的 client 方法签名一致, 记录每次调用的 context
+type fakeRPCClient struct {
+	contexts []context.Context
+}
+
+func (c *fakeRPCClient) Echo(ctx context.Context, req *structpb.Value) (*structpb.Value, error) {
+	c.contexts = append(c.contexts, ctx)
+	if req.GetStringValue() == "" {
+		return nil, errors.New("empty request")
+	}
+	return req, nil
+}
+
+func (c *fakeRPCClient) Watch(ctx context.Context, req *structpb.ListValue) (*fakeWatchClient, error) {
+	c.contexts = append(c.contexts, ctx)
+	return &fakeWatchClient{ctx: ctx, values: req.GetValues()}, nil
+}
+
+func (c *fakeRPCClient) Upload(ctx context.Context) (*fakeUploadClient, error) {
+	c.contexts = append(c.contexts, ctx)
+	return &fakeUploadClient{}, nil
+}
+
+func (c *fakeRPCClient) Chat(ctx context.Context) (*fakeChatClient, error) {
+	c.contexts = append(c.contexts, ctx)
+	return &fakeChatClient{}, nil
+}
+
+type fakeWatchClient struct {
+	ctx    context.Context
+	values []*structpb.Value
+}
+
+func (s *fakeWatchClient) Recv() (*structpb.Value, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(s.values) == 0 {
+		return nil, io.EOF
+	}
+	value := s.values[0]
+	s.values = s.values[1:]
+	return value, nil
+}
+
+type fakeUploadClient struct {
+	values []*structpb.Value
+}
+
+func (s *fakeUploadClient) Send(value *structpb.Value) error {
+	s.values = append(s.values, value)
+	return nil
+}
+
+func (s *fakeUploadClient) CloseAndRecv() (*structpb.ListValue, error) {
+	return &structpb.ListValue{Values: s.values}, nil
+}
+
+type fakeChatClient struct {
+	replies []*structpb.Value
+	closed  bool
+}
+
+func (s *fakeChatClient) Send(value *structpb.Value) error {
+	s.replies = append(s.replies, structpb.NewStringValue("re:"+value.GetStringValue()))
+	return nil
+}
+
+func (s *fakeChatClient) Recv() (*structpb.Value, error) {
+	if len(s.replies) > 0 {
+		reply := s.replies[0]
+		s.replies = s.replies[1:]
+		return reply, nil
+	}
+	if s.closed {
+		return nil, io.EOF
+	}
+	return nil, errors.New("no message")
+}
+
+func (s *fakeChatClient) CloseSend() error {
+	s.closed = true
+	return nil
+}
+
+func TestGRPCBuiltin(t *testing.T) {
+	for name, script := range map[string]string{
+		"unary": `
+			assert(rpc.Echo({string_value = "hi"}).string_value == "hi")
+			local ok, err = pcall(rpc.Echo, {})
+			assert(not ok and tostring(err):find("empty request"))`,
+		"server stream": `
+			local got = {}
+			for msg in rpc.Watch({values = {{string_value = "a"}, {string_value = "b"}}}) do
+				got[#got + 1] = msg.string_value
+			end
+			assert(table.concat(got, ",") == "a,b")`,
+		"server stream close": `
+			local recv = rpc.Watch({values = {{string_value = "a"}, {string_value = "b"}}})
+			assert(recv:recv().string_value == "a")
+			recv:close()
+			assert(recv() == nil)`,
+		"client stream": `
+			local sender = rpc.Upload()
+			sender:send({number_value = 1})
+			sender:send({number_value = 2})
+			local resp = sender:close_and_recv()
+			assert(#resp.values == 2 and resp.values[2].number_value == 2)
+			assert(not pcall(sender.send, sender, {number_value = 3}))`,
+		"bidi stream": `
+			local sender, recv = rpc.Chat()
+			sender:send({string_value = "x"})
+			sender:send({string_value = "y"})
+			sender:close()
+			local replies = {}
+			for msg in recv do replies[#replies + 1] = msg.string_value end
+			assert(table.concat(replies, ",") == "re:x,re:y")`,
+		"bidi stream cancel": `
+			local sender, recv = rpc.Chat()
+			sender:cancel()
+			assert(recv() == nil)
+			assert(not pcall(sender.send, sender, {string_value = "x"}))`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			client := &fakeRPCClient{}
+			r := NewRegistry()
+			if err := r.RegisterFunctions(RegisterGRPCBuiltin("rpc", client)...); err != nil {
+				t.Fatal(err)
+			}
+			if err := newTestVM(t, r).DoString(`local rpc = require("rpc")` + "\n" + script); err != nil {
+				t.Fatal(err)
+			}
+			// 流结束, 关闭或取消后都会释放调用时的 context
+			for i, ctx := range client.contexts {
+				if ctx.Err() == nil {
+					t.Fatalf("context of call %d not released", i+1)
+				}
+			}
+		})
+	}
+}
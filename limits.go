@@ -0,0 +1,267 @@
+package mals
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/metrics"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// 在 lua registry 中保存 WithLimits 设置的 Limits
+const limitsRegistryKey = "__mals_limits"
+
+const (
+	// memoryCheckInterval 是 MaxMemory 采样堆大小的间隔
+	memoryCheckInterval = 10 * time.Millisecond
+	// memoryLimitMessage 出现在因 MaxMemory 被拒绝的调用的错误信息中
+	memoryLimitMessage = "memory limit exceeded"
+)
+
+// Limits 限制单个 VM 可以使用的资源, 为 0 的项使用 gopher-lua 的默认值或不限制.
+// gopher-lua 没有指令计数的 hook, 死循环通过 Timeout 中断, 持续增长的 table 与字符串通过 MaxMemory 中断.
+type Limits struct {
+	// Timeout 是 Run/RunString/RunFile 单次执行的最长时间
+	Timeout time.Duration
+	// MaxMemory 是 Run/RunString/RunFile 单次执行期间堆可以增长的字节数, 超过后报告 LimitMemory.
+	// 堆大小按进程统计并定期采样, 并发运行的其他 VM 的分配也会计入, 它是防止失控的上限而不是精确的配额.
+	// 设置后 string.rep 会直接拒绝超过 MaxMemory 的结果
+	MaxMemory uint64
+	// CallStackSize 是最大调用深度, 超过后报告 LimitCallStack
+	CallStackSize int
+	// RegistrySize 是值栈的初始大小, RegistryMaxSize 是可以增长到的上限
+	RegistrySize    int
+	RegistryMaxSize int
+}
+
+// WithLimits 创建带资源限制的 VM, 需要通过 Run/RunString/RunFile 执行才能得到 LimitError
+func WithLimits(limits Limits) VMOption {
+	return func(config *vmConfig) {
+		config.limits = &limits
+	}
+}
+
+func (limits *Limits) options() lua.Options {
+	opts := lua.Options{
+		CallStackSize:   limits.CallStackSize,
+		RegistrySize:    limits.RegistrySize,
+		RegistryMaxSize: limits.RegistryMaxSize,
+	}
+	if opts.RegistrySize == 0 {
+		opts.RegistrySize = lua.RegistrySize
+	}
+	return opts
+}
+
+// LimitKind 表示超出的限制
+type LimitKind int
+
+const (
+	LimitTimeout LimitKind = iota + 1
+	LimitCallStack
+	LimitRegistry
+	LimitMemory
+)
+
+func (kind LimitKind) String() string {
+	switch kind {
+	case LimitTimeout:
+		return "timeout"
+	case LimitCallStack:
+		return "call stack"
+	case LimitRegistry:
+		return "registry"
+	case LimitMemory:
+		return "memory"
+	default:
+		return "unknown"
+	}
+}
+
+// LimitError 表示脚本因为超出 Limits 被中断
+type LimitError struct {
+	Kind  LimitKind
+	Limit string
+	Err   error
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s limit exceeded (%s): %v", e.Kind, e.Limit, e.Err)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// VMLimits 返回通过 WithLimits 创建的 VM 的限制, 没有设置时返回 nil
+func VMLimits(L *lua.LState) *Limits {
+	if ud, ok := L.GetField(L.Get(lua.RegistryIndex), limitsRegistryKey).(*lua.LUserData); ok {
+		if limits, ok := ud.Value.(*Limits); ok {
+			return limits
+		}
+	}
+	return nil
+}
+
+func setVMLimits(L *lua.LState, limits *Limits) {
+	ud := L.NewUserData()
+	ud.Value = limits
+	L.SetField(L.Get(lua.RegistryIndex), limitsRegistryKey, ud)
+}
+
+// Run 在 Limits.Timeout 与 Limits.MaxMemory 内执行 fn, 超出限制时返回 *LimitError
+func Run(L *lua.LState, fn func(L *lua.LState) error) error {
+	limits := VMLimits(L)
+	if limits == nil || (limits.Timeout <= 0 && limits.MaxMemory == 0) {
+		return limitError(limits, fn(L))
+	}
+
+	previous := L.Context()
+	parent := previous
+	if parent == nil {
+		parent = context.Background()
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if limits.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, limits.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	defer cancel()
+	var exceeded *atomic.Bool
+	if limits.MaxMemory > 0 {
+		exceeded = watchMemory(ctx, cancel, limits.MaxMemory)
+	}
+	L.SetContext(ctx)
+	defer func() {
+		if previous == nil {
+			L.RemoveContext()
+		} else {
+			L.SetContext(previous)
+		}
+	}()
+	err := fn(L)
+	if err != nil && parent.Err() == nil {
+		if exceeded != nil && exceeded.Load() {
+			return &LimitError{Kind: LimitMemory, Limit: fmt.Sprintf("%d bytes", limits.MaxMemory), Err: err}
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return &LimitError{Kind: LimitTimeout, Limit: limits.Timeout.String(), Err: err}
+		}
+	}
+	return limitError(limits, err)
+}
+
+// watchMemory 在 ctx 结束前定期采样堆大小, 比开始时增长超过 max 字节后标记并取消 ctx.
+// 取消会传递到 coroutine 的 context, VM 在下一条指令处中断
+func watchMemory(ctx context.Context, cancel context.CancelFunc, max uint64) *atomic.Bool {
+	exceeded := &atomic.Bool{}
+	limit := heapBytes() + max
+	go func() {
+		ticker := time.NewTicker(memoryCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if heapBytes() <= limit {
+					continue
+				}
+				// 采样包含尚未回收的垃圾, 回收后仍然超出才中断
+				runtime.GC()
+				if heapBytes() > limit {
+					exceeded.Store(true)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return exceeded
+}
+
+func heapBytes() uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+// limitStringRep 替换 string.rep, 拒绝超过 max 字节的结果.
+// 单次调用的分配发生在两次采样之间, 无法被 watchMemory 中断
+func limitStringRep(L *lua.LState, max uint64) {
+	strlib, ok := L.GetGlobal(lua.StringLibName).(*lua.LTable)
+	if !ok {
+		return
+	}
+	rep, ok := L.GetField(strlib, "rep").(*lua.LFunction)
+	if !ok || !rep.IsG {
+		return
+	}
+	L.SetField(strlib, "rep", L.NewFunction(func(L *lua.LState) int {
+		s := L.CheckString(1)
+		n := L.CheckInt(2)
+		if n > 0 && uint64(len(s))*uint64(n) > max {
+			L.RaiseError("string.rep: %s (%d bytes)", memoryLimitMessage, max)
+			return 0
+		}
+		return rep.GFunction(L)
+	}))
+}
+
+func RunString(L *lua.LState, source string) error {
+	return Run(L, func(L *lua.LState) error {
+		return L.DoString(source)
+	})
+}
+
+func RunFile(L *lua.LState, path string) error {
+	return Run(L, func(L *lua.LState) error {
+		return L.DoFile(path)
+	})
+}
+
+// limitError 根据 gopher-lua 的错误信息识别调用栈与值栈溢出
+func limitError(limits *Limits, err error) error {
+	if err == nil {
+		return nil
+	}
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		return err
+	}
+	var apiErr *lua.ApiError
+	if !errors.As(err, &apiErr) || apiErr.Object == nil {
+		return err
+	}
+	msg := apiErr.Object.String()
+	switch {
+	case strings.Contains(msg, "stack overflow") || strings.Contains(msg, "callstack overflow"):
+		size := lua.CallStackSize
+		if limits != nil && limits.CallStackSize > 0 {
+			size = limits.CallStackSize
+		}
+		return &LimitError{Kind: LimitCallStack, Limit: fmt.Sprintf("%d frames", size), Err: err}
+	case strings.Contains(msg, memoryLimitMessage) && limits != nil && limits.MaxMemory > 0:
+		return &LimitError{Kind: LimitMemory, Limit: fmt.Sprintf("%d bytes", limits.MaxMemory), Err: err}
+	case strings.Contains(msg, "registry overflow"):
+		size := lua.RegistrySize
+		if limits != nil {
+			size = limits.options().RegistrySize
+			if limits.RegistryMaxSize > size {
+				size = limits.RegistryMaxSize
+			}
+		}
+		return &LimitError{Kind: LimitRegistry, Limit: fmt.Sprintf("%d slots", size), Err: err}
+	}
+	return err
+}
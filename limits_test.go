@@ -0,0 +1,101 @@
+package mals
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunLimits(t *testing.T) {
+	for name, tc := range map[string]struct {
+		limits Limits
+		script string
+		kind   LimitKind
+	}{
+		"within limits": {limits: Limits{Timeout: time.Second, CallStackSize: 64}, script: `local n = 0 for i = 1, 1000 do n = n + i end`},
+		"timeout":       {limits: Limits{Timeout: 50 * time.Millisecond}, script: `while true do end`, kind: LimitTimeout},
+		"timeout in coroutine": {
+			limits: Limits{Timeout: 50 * time.Millisecond},
+			script: `coroutine.wrap(function() while true do end end)()`,
+			kind:   LimitTimeout,
+		},
+		"call stack": {
+			limits: Limits{Timeout: time.Second, CallStackSize: 64},
+			script: `local function f(n) return 1 + f(n + 1) end f(1)`,
+			kind:   LimitCallStack,
+		},
+		"call stack without timeout": {
+			limits: Limits{CallStackSize: 64},
+			script: `local function f(n) return 1 + f(n + 1) end f(1)`,
+			kind:   LimitCallStack,
+		},
+		"script error": {limits: Limits{Timeout: time.Second}, script: `error("boom")`, kind: -1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			L := NewLuaVM(WithLimits(tc.limits))
+			defer L.Close()
+			err := RunString(L, tc.script)
+			var limitErr *LimitError
+			switch {
+			case tc.kind == 0:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case tc.kind < 0:
+				if err == nil || errors.As(err, &limitErr) {
+					t.Fatalf("expected a plain script error, got %v", err)
+				}
+			default:
+				if !errors.As(err, &limitErr) || limitErr.Kind != tc.kind {
+					t.Fatalf("expected %s limit error, got %v", tc.kind, err)
+				}
+			}
+			if L.Context() != nil {
+				t.Fatal("Run left its context on the vm")
+			}
+		})
+	}
+}
+
+func TestRunHostCancel(t *testing.T) {
+	L := NewLuaVM(WithLimits(Limits{Timeout: time.Minute}))
+	defer L.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	L.SetContext(ctx)
+	err := RunString(L, `while true do end`)
+	var limitErr *LimitError
+	if err == nil || errors.As(err, &limitErr) {
+		t.Fatalf("expected host cancellation not to be reported as a limit, got %v", err)
+	}
+	if L.Context() != ctx {
+		t.Fatal("Run did not restore the host context")
+	}
+}
+
+func TestRunMemoryLimit(t *testing.T) {
+	for name, script := range map[string]string{
+		"growing table": `local t = {} while true do t[#t+1] = ("x"):rep(1e6) end`,
+		"string.rep":    `local s = ("x"):rep(1e10)`,
+		"coroutine":     `coroutine.wrap(function() local t = {} while true do t[#t+1] = ("x"):rep(1e6) end end)()`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			L := NewLuaVM(WithLimits(Limits{Timeout: time.Minute, MaxMemory: 64 << 20}))
+			defer L.Close()
+			err := RunString(L, script)
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) || limitErr.Kind != LimitMemory {
+				t.Fatalf("expected memory limit error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRunMemoryLimitIgnoresGarbage(t *testing.T) {
+	L := NewLuaVM(WithLimits(Limits{Timeout: time.Minute, MaxMemory: 64 << 20}))
+	defer L.Close()
+	if err := RunString(L, `for i = 1, 500 do local s = ("x"):rep(1e6) end`); err != nil {
+		t.Fatal(err)
+	}
+}
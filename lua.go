@@ -8,6 +8,7 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/chainreactors/logs"
 	"github.com/chainreactors/utils/iutils"
@@ -15,7 +16,6 @@ import (
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
-	"google.golang.org/protobuf/reflect/protoregistry"
 	luar "layeh.com/gopher-luar"
 
 	"github.com/chainreactors/mals/libs/gopher-lua-libs/argparse"
@@ -42,13 +42,20 @@ import (
 	gluacrypto_crypto "github.com/tengattack/gluacrypto/crypto"
 )
 
-var (
-	luaFunctionCache = map[string]lua.LGFunction{}
-)
+// luaFunctionCache 缓存 WrapFuncForLua 包装后的 lua 函数, 多个 VM 可能并发访问.
+// 通过 Registry 包装的函数缓存在 Registry 中, 随 Registry 一起释放
+var luaFunctionCache sync.Map
 
 func WrapFuncForLua(fn *MalFunction) lua.LGFunction {
-	if luaFn, ok := luaFunctionCache[fn.String()]; ok {
-		return luaFn
+	return wrapFuncForLua(fn, nil)
+}
+
+// wrapFuncForLua 中 r 不为 nil 时, 函数自身未设置 ErrorMode 时使用 r 的设置.
+// ErrorMode 在每次调用时读取, 包装并缓存之后修改也会生效
+func wrapFuncForLua(fn *MalFunction, r *Registry) lua.LGFunction {
+	cache, cacheKey := luaFunctionCacheFor(fn, r)
+	if luaFn, ok := cache.Load(cacheKey); ok {
+		return luaFn.(lua.LGFunction)
 	}
 
 	luaFn := func(vm *lua.LState) int {
@@ -68,40 +75,90 @@ func WrapFuncForLua(fn *MalFunction) lua.LGFunction {
 		for i := 1; i <= top; i++ {
 			args = append(args, ConvertLuaValueToGo(vm.Get(i)))
 		}
-		args, err := ConvertArgsToExpectedTypes(args, fn.ArgTypes)
+
+		// 第一个参数为 context.Context 时自动注入, 兼容脚本显式传入 context
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if fn.HasContext() {
+			if len(args) > 0 && isContext(args[0]) {
+				ctx, args = args[0].(context.Context), args[1:]
+			} else {
+				ctx, cancel = fn.functionContext(vm)
+				defer func() {
+					if cancel != nil {
+						cancel()
+					}
+				}()
+			}
+		}
+		args, err := fn.ConvertArgs(args)
 		if err != nil {
 			vm.Error(lua.LString(fmt.Sprintf("Error: %v", err)), 1)
 			return 0
 		}
+		if ctx != nil {
+			args = append([]interface{}{ctx}, args...)
+		}
 		// 调用 Go 函数
 		result, err := fn.Func(args...)
 		if err != nil {
-			vm.Error(lua.LString(fmt.Sprintf("Error: %v", err)), 1)
-			return 0
+			errorMode := fn.ErrorMode
+			if errorMode == ErrorModeDefault && r != nil {
+				errorMode = r.ErrorMode()
+			}
+			return pushError(vm, errorMode, err)
+		}
+		// 流式调用的 context 在流结束时才取消
+		if cancel != nil && bindStreamCancel(result, cancel) {
+			cancel = nil
+		}
+
+		values := []interface{}{result}
+		if results, ok := result.(Results); ok {
+			values = results
 		}
 
 		// 如果有回调，调用回调函数
 		if callback != nil {
 			vm.Push(callback)
-			vm.Push(ConvertGoValueToLua(vm, result))
-			if err := vm.PCall(1, 1, nil); err != nil { // 期待一个返回值
+			for _, value := range values {
+				vm.Push(ConvertGoValueToLua(vm, value))
+			}
+			if err := vm.PCall(len(values), 1, nil); err != nil { // 期待一个返回值
 				vm.Error(lua.LString(fmt.Sprintf("Callback Error: %v", err)), 1)
 				return 0
 			}
 
 			return 1
 		} else {
-			vm.Push(ConvertGoValueToLua(vm, result))
-			return 1
+			for _, value := range values {
+				vm.Push(ConvertGoValueToLua(vm, value))
+			}
+			return len(values)
 		}
 	}
 	if !fn.NoCache {
-		luaFunctionCache[fn.String()] = luaFn
+		cache.Store(cacheKey, lua.LGFunction(luaFn))
 	}
 
 	return luaFn
 }
 
+// luaFunctionCacheFor 返回 fn 包装结果所在的缓存与 key, r 为 nil 时使用全局缓存
+func luaFunctionCacheFor(fn *MalFunction, r *Registry) (*sync.Map, interface{}) {
+	if r == nil {
+		return &luaFunctionCache, fn.String()
+	}
+	return &r.wrappers, fn
+}
+
+func deleteLuaFunctionCache(fn *MalFunction, r *Registry) {
+	luaFunctionCache.Delete(fn.String())
+	if r != nil {
+		r.wrappers.Delete(fn)
+	}
+}
+
 // Convert the []interface{} and map[string]interface{} to the expected types defined in ArgTypes
 func ConvertArgsToExpectedTypes(args []interface{}, argTypes []reflect.Type) ([]interface{}, error) {
 	if len(args) != len(argTypes) {
@@ -112,6 +169,10 @@ func ConvertArgsToExpectedTypes(args []interface{}, argTypes []reflect.Type) ([]
 
 	for i, arg := range args {
 		expectedType := argTypes[i]
+		if arg == nil {
+			convertedArgs[i] = reflect.Zero(expectedType).Interface()
+			continue
+		}
 		val := reflect.ValueOf(arg)
 
 		// Skip conversion if types are already identical
@@ -126,6 +187,16 @@ func ConvertArgsToExpectedTypes(args []interface{}, argTypes []reflect.Type) ([]
 			continue
 		}
 
+		// Handle lua table to proto.Message conversion
+		if isProtoTable(expectedType, val) {
+			msg, err := NewProtoMessageFromValue(expectedType, arg)
+			if err != nil {
+				return nil, fmt.Errorf("cannot convert argument %d to %s: %v", i+1, expectedType, err)
+			}
+			convertedArgs[i] = msg
+			continue
+		}
+
 		// Handle slice conversion
 		if expectedType.Kind() == reflect.Slice && val.Kind() == reflect.Slice {
 			elemType := expectedType.Elem()
@@ -174,6 +245,9 @@ func ConvertArgsToExpectedTypes(args []interface{}, argTypes []reflect.Type) ([]
 
 // Helper function to convert individual values to the expected type
 func convertValueToExpectedType(value interface{}, expectedType reflect.Type) (interface{}, error) {
+	if value == nil {
+		return reflect.Zero(expectedType).Interface(), nil
+	}
 	val := reflect.ValueOf(value)
 
 	// Skip conversion if types are already identical
@@ -186,6 +260,11 @@ func convertValueToExpectedType(value interface{}, expectedType reflect.Type) (i
 		return iutils.ToString(value), nil
 	}
 
+	// Handle lua table to proto.Message conversion
+	if isProtoTable(expectedType, val) {
+		return NewProtoMessageFromValue(expectedType, value)
+	}
+
 	// Handle slice conversion
 	if expectedType.Kind() == reflect.Slice && val.Kind() == reflect.Slice {
 		elemType := expectedType.Elem()
@@ -227,6 +306,12 @@ func convertValueToExpectedType(value interface{}, expectedType reflect.Type) (i
 	return nil, fmt.Errorf("cannot convert value to %s", expectedType)
 }
 
+// isProtoTable 判断是否需要将 lua table 转换为 expectedType 的 proto.Message
+func isProtoTable(expectedType reflect.Type, val reflect.Value) bool {
+	return expectedType.Kind() == reflect.Ptr && expectedType.Implements(protoMessageType) &&
+		(val.Kind() == reflect.Map || val.Kind() == reflect.Slice)
+}
+
 func isArray(tbl *lua.LTable) bool {
 	length := tbl.Len() // Length of the array part
 	count := 0
@@ -294,10 +379,13 @@ func ConvertGoValueToLua(L *lua.LState, value interface{}) lua.LValue {
 	switch v := value.(type) {
 	case proto.Message:
 		// 如果是 proto.Message 类型，将其封装为 LUserData 并设置元表
-		table1 := L.GetTypeMetatable("ProtobufMessage")
-		val := luar.New(L, v)
-		mergeLTable(val.(*lua.LUserData).Metatable.(*lua.LTable), table1.(*lua.LTable))
-		return val
+		return NewLuaProtoMessage(L, v)
+	case *ProtoList, *ProtoMap:
+		return newLuaProtoContainer(L, v)
+	case *GRPCStreamReceiver:
+		return NewLuaStreamIterator(L, v)
+	case *GRPCStreamSender:
+		return NewLuaStreamSender(L, v)
 	case []string:
 		// 如果是 []string 类型，将其转换为 Lua 表
 		luaTable := L.NewTable()
@@ -324,6 +412,12 @@ func ConvertGoValueToLuaType(L *lua.LState, t reflect.Type) string {
 		}
 		return "table"
 	case reflect.Ptr:
+		if t == reflect.TypeOf(&GRPCStreamSender{}) {
+			return GRPCStreamSenderTypeName
+		}
+		if t == reflect.TypeOf(&GRPCStreamReceiver{}) {
+			return GRPCStreamReceiverTypeName
+		}
 		if t.Implements(reflect.TypeOf((*proto.Message)(nil)).Elem()) {
 			return t.Elem().Name()
 		}
@@ -423,50 +517,65 @@ func LoadLib(vm *lua.LState) {
 	cmd.Preload(vm)
 
 	vm.PreloadModule("http", gluahttp.NewHttpModule(&http.Client{}).Loader)
+	vm.PreloadModule("context", ContextLoader)
+	vm.PreloadModule("protobuf", ProtobufLoader)
 	vm.PreloadModule("crypto", gluacrypto_crypto.Loader)
 }
 
+// PackageLoader 只注册 funcs 中属于所加载包的函数
 func PackageLoader(funcs map[string]*MalFunction) func(L *lua.LState) int {
-	return func(L *lua.LState) int {
-		packageName := L.ToString(1)
-
-		mod := L.NewTable()
-		L.SetField(mod, "_NAME", lua.LString(packageName))
-		// 查找 InternalFunctions 中属于该包的函数并注册
-		for _, fn := range funcs {
-			mod.RawSetString(fn.Name, L.NewFunction(WrapFuncForLua(fn)))
-		}
-
-		// 如果没有找到函数，则返回空表
-		L.Push(mod)
-		return 1
-	}
+	r := NewRegistryFromMap(funcs)
+	return r.Loader
 }
 
-func NewLuaVM() *lua.LState {
-	vm := lua.NewState()
+// NewLuaVM 创建加载了全部库的 VM, 通过 WithSandbox 或 WithCapabilities 限制脚本可以使用的能力, 通过 WithLimits 限制资源
+func NewLuaVM(opts ...VMOption) *lua.LState {
+	config := &vmConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+	var vm *lua.LState
+	if config.limits != nil {
+		vm = lua.NewState(config.limits.options())
+		setVMLimits(vm, config.limits)
+	} else {
+		vm = lua.NewState()
+	}
 	LoadLib(vm)
+	if config.sandbox != nil {
+		config.sandbox.Apply(vm)
+	}
+	if config.limits != nil && config.limits.MaxMemory > 0 {
+		limitStringRep(vm, config.limits.MaxMemory)
+	}
 	RegisterProtobufMessageType(vm)
+	RegisterMalErrorType(vm)
 
 	return vm
 }
 
 // 注册 Protobuf Message 的类型和方法
 func RegisterProtobufMessageType(L *lua.LState) {
-	mt := L.NewTypeMetatable("ProtobufMessage")
-	L.SetGlobal("ProtobufMessage", mt)
+	mt := L.NewTypeMetatable(ProtobufMessageTypeName)
+	L.SetGlobal(ProtobufMessageTypeName, mt)
 
 	// 注册 __index 和 __newindex 元方法
-	//L.SetField(mt, "__index", L.NewFunction(protoIndex))
+	L.SetField(mt, "__index", L.NewFunction(protoIndex))
 	L.SetField(mt, "__newindex", L.NewFunction(protoNewIndex))
 
 	// 注册 __tostring 元方法
 	L.SetField(mt, "__tostring", L.NewFunction(protoToString))
 
 	L.SetField(mt, "New", L.NewFunction(protoNew))
+
+	RegisterProtobufContainerTypes(L)
 }
 
 func GenerateLuaDefinitionFile(L *lua.LState, pkg string, protos []string, fns map[string]*MalFunction) error {
+	return NewRegistryFromMap(fns).GenerateLuaDefinitionFile(L, pkg, protos)
+}
+
+func (r *Registry) GenerateLuaDefinitionFile(L *lua.LState, pkg string, protos []string) error {
 	file, err := os.Create(pkg + ".lua")
 	if err != nil {
 		return err
@@ -475,28 +584,14 @@ func GenerateLuaDefinitionFile(L *lua.LState, pkg string, protos []string, fns m
 
 	generateProtobufMessageClasses(L, file, protos)
 
-	// 按 package 分组，然后在每个分组内按 funcName 排序
-	groupedFunctions := make(map[string][]string)
-	for funcName, signature := range fns {
-		if pkg == signature.Package {
-			var group string
-			if signature.Helper != nil && signature.Helper.Group != "" {
-				group = signature.Helper.Group
-			}
-			groupedFunctions[group] = append(groupedFunctions[group], funcName)
-		}
-	}
-
-	// 排序每个 package 内的函数名
-	for _, funcs := range groupedFunctions {
-		sort.Strings(funcs)
-	}
+	// 按 group 分组，组内按函数名排序
+	groupedFunctions := r.Groups(pkg)
 
 	// 生成 Lua 定义文件
-	for group, funcs := range groupedFunctions {
+	for _, group := range r.GroupNames(pkg) {
 		fmt.Fprintf(file, "-- Group: %s\n\n", group)
-		for _, funcName := range funcs {
-			signature := fns[funcName]
+		for _, signature := range groupedFunctions[group] {
+			funcName := signature.Name
 
 			fmt.Fprintf(file, "--- %s\n", funcName)
 
@@ -523,28 +618,41 @@ func GenerateLuaDefinitionFile(L *lua.LState, pkg string, protos []string, fns m
 				}
 			}
 
-			// 参数和返回值描述
+			// 参数和返回值描述, 可选参数标记为 name?, 变长参数标记为 ...
 			var paramsName []string
-			for i, argType := range signature.ArgTypes {
+			var params []*Param
+			argTypes := signature.LuaArgTypes()
+			if signature.Helper != nil && signature.Input != nil {
+				params = signature.Helper.Params()
+			}
+			for i, argType := range argTypes {
+				if signature.Variadic && i == len(argTypes)-1 {
+					argType = argType.Elem()
+				}
 				luaType := ConvertGoValueToLuaType(L, argType)
-				if signature.Helper != nil && signature.Input != nil {
-					keys, values := signature.Helper.FormatInput()
-					if len(keys) > 0 {
-						paramsName = append(paramsName, keys[i])
-						fmt.Fprintf(file, "--- @param %s %s %s\n", keys[i], luaType, values[i])
-					}
-				} else {
-					paramsName = append(paramsName, fmt.Sprintf("arg%d", i+1))
-					fmt.Fprintf(file, "--- @param arg%d %s\n", i+1, luaType)
+				name := fmt.Sprintf("arg%d", i+1)
+				var desc string
+				if i < len(params) {
+					name, desc = params[i].Name, " "+params[i].Description
+				}
+				paramName := name
+				if signature.Variadic && i == len(argTypes)-1 {
+					name, paramName = "...", "..."
+				} else if i < len(params) && params[i].Optional {
+					paramName = name + "?"
 				}
+				paramsName = append(paramsName, name)
+				fmt.Fprintf(file, "--- @param %s %s%s\n", paramName, luaType, desc)
 			}
-			for _, returnType := range signature.ReturnTypes {
+			// 每个返回值对应一个 @return
+			var outputKeys, outputValues []string
+			if signature.Helper != nil && signature.Output != nil {
+				outputKeys, outputValues = signature.Helper.FormatOutput()
+			}
+			for i, returnType := range signature.ReturnTypes {
 				luaType := ConvertGoValueToLuaType(L, returnType)
-				if signature.Helper != nil && signature.Output != nil {
-					keys, values := signature.Helper.FormatOutput()
-					for i := range keys {
-						fmt.Fprintf(file, "--- @return %s %s %s\n", keys[i], luaType, values[i])
-					}
+				if i < len(outputKeys) {
+					fmt.Fprintf(file, "--- @return %s %s %s\n", outputKeys[i], luaType, outputValues[i])
 				} else {
 					fmt.Fprintf(file, "--- @return %s\n", luaType)
 				}
@@ -552,15 +660,7 @@ func GenerateLuaDefinitionFile(L *lua.LState, pkg string, protos []string, fns m
 
 			// 函数定义
 			fmt.Fprintf(file, "function %s(", funcName)
-			for i := range signature.ArgTypes {
-				if i > 0 {
-					fmt.Fprintf(file, ", ")
-				}
-				if len(paramsName) > 0 {
-					fmt.Fprintf(file, paramsName[i])
-				}
-			}
-			fmt.Fprintf(file, ") end\n\n")
+			fmt.Fprintf(file, "%s) end\n\n", strings.Join(paramsName, ", "))
 		}
 	}
 
@@ -568,42 +668,36 @@ func GenerateLuaDefinitionFile(L *lua.LState, pkg string, protos []string, fns m
 }
 
 func GenerateMarkdownDefinitionFile(L *lua.LState, pkg, filename string, fns map[string]*MalFunction) error {
+	return NewRegistryFromMap(fns).GenerateMarkdownDefinitionFile(L, pkg, filename)
+}
+
+func (r *Registry) GenerateMarkdownDefinitionFile(L *lua.LState, pkg, filename string) error {
 	file, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	// 按 package 分组，然后在每个分组内按 funcName 排序
-	groupedFunctions := make(map[string][]string)
-	for funcName, iFunc := range fns {
-		if iFunc.Package != pkg {
-			continue
+	// 按 group 分组，未分组的函数归入 basic
+	groupedFunctions := make(map[string][]*MalFunction)
+	for group, funcs := range r.Groups(pkg) {
+		if group == "" {
+			group = "basic"
 		}
-		group := "basic"
-		if iFunc.Helper != nil && iFunc.Helper.Group != "" {
-			group = iFunc.Helper.Group
-		}
-		groupedFunctions[group] = append(groupedFunctions[group], funcName)
+		groupedFunctions[group] = append(groupedFunctions[group], funcs...)
 	}
 	var groups []string
-	for g, _ := range groupedFunctions {
+	for g := range groupedFunctions {
 		groups = append(groups, g)
 	}
-
 	sort.Strings(groups)
-	// 排序每个 package 内的函数名
-	for _, funcs := range groupedFunctions {
-		sort.Strings(funcs)
-	}
 
 	// 生成 Markdown 文档
-	for _, pkg := range groups {
-		funcs := groupedFunctions[pkg]
-		// Package 名称作为二级标题
-		fmt.Fprintf(file, "## %s\n\n", pkg)
-		for _, funcName := range funcs {
-			iFunc := fns[funcName]
+	for _, group := range groups {
+		// Group 名称作为二级标题
+		fmt.Fprintf(file, "## %s\n\n", group)
+		for _, iFunc := range groupedFunctions[group] {
+			funcName := iFunc.Name
 
 			// 函数名作为三级标题
 			fmt.Fprintf(file, "### %s\n\n", funcName)
@@ -622,21 +716,33 @@ func GenerateMarkdownDefinitionFile(L *lua.LState, pkg, filename string, fns map
 			}
 
 			// 写入参数描述.
-			if len(iFunc.ArgTypes) > 0 {
+			argTypes := iFunc.LuaArgTypes()
+			if len(argTypes) > 0 {
 				fmt.Fprintf(file, "**Arguments**\n\n")
-				for i, argType := range iFunc.ArgTypes {
+				for i, argType := range argTypes {
+					if iFunc.Variadic && i == len(argTypes)-1 {
+						argType = argType.Elem()
+					}
 					luaType := ConvertGoValueToLuaType(L, argType)
 					if iFunc.Helper == nil {
 						fmt.Fprintf(file, "- `$%d` [%s] \n", i+1, luaType)
 					} else {
-						keys, values := iFunc.Helper.FormatInput()
+						params := iFunc.Helper.Params()
 						paramName := fmt.Sprintf("$%d", i+1)
-						if i < len(keys) && keys[i] != "" {
-							paramName = keys[i]
-						}
 						description := ""
-						if i < len(values) {
-							description = values[i]
+						if i < len(params) {
+							if params[i].Name != "" {
+								paramName = params[i].Name
+							}
+							description = params[i].Description
+							if params[i].HasDefault {
+								description += fmt.Sprintf(" (default: %s)", params[i].Default)
+							} else if params[i].Optional {
+								description += " (optional)"
+							}
+						}
+						if iFunc.Variadic && i == len(argTypes)-1 {
+							paramName = "..." + paramName
 						}
 						fmt.Fprintf(file, "- `%s` [%s] - %s\n", paramName, luaType, description)
 					}
@@ -660,8 +766,8 @@ func GenerateMarkdownDefinitionFile(L *lua.LState, pkg, filename string, fns map
 
 // generateProtobufMessageClasses 生成 Protobuf message 的 Lua class 定义
 func generateProtobufMessageClasses(L *lua.LState, file *os.File, grpcPackage []string) {
-	// 使用 protoregistry 遍历所有注册的 Protobuf 结构体
-	protoregistry.GlobalTypes.RangeMessages(func(mt protoreflect.MessageType) bool {
+	// 遍历所有注册的 Protobuf 结构体, 包括动态加载的 descriptor
+	RangeProtoMessageTypes(func(mt protoreflect.MessageType) bool {
 		// 获取结构体名称
 		messageName := mt.Descriptor().FullName()
 		var contains bool
@@ -725,22 +831,15 @@ func protoFieldToLuaType(field protoreflect.FieldDescriptor) string {
 	}
 }
 
-// RegisterProtobufMessagesFromPackage 注册指定包中所有的 Protobuf Message
+// RegisterProtobufMessagesFromPackage 注册指定包中所有的 Protobuf Message, pkg 为完整的 proto package, 如 "clientpb" 或 "foo.bar.v1".
+// 只注册顶层 message, 以 message 名作为 lua 全局名称, 嵌套 message 可以通过 ProtobufMessage.New 使用全名创建
 func RegisterProtobufMessagesFromPackage(L *lua.LState, pkg string) {
-	// 通过 protoregistry 获取所有注册的消息
-	protoregistry.GlobalTypes.RangeMessages(func(mt protoreflect.MessageType) bool {
-		messageName := string(mt.Descriptor().FullName())
-
-		// 检查 message 是否属于指定包
-		kv := strings.Split(messageName, ".")
-		if len(kv) == 2 {
-			if pkg == kv[0] {
-				RegisterProtobufMessage(L, kv[1], mt.New().Interface().(proto.Message))
-			}
-		} else {
+	RangeProtoMessageTypes(func(mt protoreflect.MessageType) bool {
+		desc := mt.Descriptor()
+		if string(desc.ParentFile().Package()) != pkg || desc.Parent() != desc.ParentFile() {
 			return true
 		}
-
+		RegisterProtobufMessage(L, string(desc.Name()), mt.New().Interface())
 		return true
 	})
 }
@@ -749,6 +848,7 @@ func RegisterProtobufMessagesFromPackage(L *lua.LState, pkg string) {
 func RegisterProtobufMessage(L *lua.LState, msgType string, msg proto.Message) {
 	mt := L.NewTypeMetatable(msgType)
 	L.SetGlobal(msgType, mt)
+	L.SetField(mt, protoTypeNameField, lua.LString(proto.MessageName(msg)))
 
 	// 注册 Protobuf 操作
 	L.SetField(mt, "__index", L.NewFunction(protoIndex))
@@ -760,12 +860,9 @@ func RegisterProtobufMessage(L *lua.LState, msgType string, msg proto.Message) {
 		newMsg := proto.Clone(msg).(proto.Message)
 
 		if L.GetTop() == 1 {
-			initTable := L.CheckTable(1)
-			initTable.ForEach(func(key lua.LValue, value lua.LValue) {
-				fieldName := key.String()
-				fieldValue := ConvertLuaValueToGo(value)
-				setFieldByName(newMsg, fieldName, fieldValue)
-			})
+			if err := SetProtoMessage(newMsg.ProtoReflect(), ConvertLuaValueToGo(L.CheckTable(1))); err != nil {
+				L.ArgError(1, err.Error())
+			}
 		}
 		ud := L.NewUserData()
 		ud.Value = newMsg
@@ -799,161 +896,93 @@ func protoToString(L *lua.LState) int {
 	return 1
 }
 
-// truncateLongFields 递归处理 map 中的字符串字段，截断长度超过 1024 的字符串
+// maxDisplayFieldLength 是 tostring 显示 message 时 string 与 bytes 字段的最大长度
+const maxDisplayFieldLength = 1024
+
+// truncateMessageFields 返回 msg 的副本, 其中超过 maxDisplayFieldLength 的 string 与 bytes 字段被截断,
+// 包括嵌套的 message, repeated 与 map 中的值. 通过 protoreflect 处理, dynamicpb 的 message 同样适用
 func truncateMessageFields(msg proto.Message) proto.Message {
-	// 创建消息的深拷贝，以避免修改原始消息
 	copyMsg := proto.Clone(msg)
+	truncateMessage(copyMsg.ProtoReflect())
+	return copyMsg
+}
 
-	msgValue := reflect.ValueOf(copyMsg).Elem()
-	msgType := msgValue.Type()
-
-	for i := 0; i < msgType.NumField(); i++ {
-		fieldValue := msgValue.Field(i)
-
-		// 处理字符串类型字段
-		if fieldValue.Kind() == reflect.String && fieldValue.Len() > 1024 {
-			truncatedStr := fieldValue.String()[:1024] + "......"
-			fieldValue.SetString(truncatedStr)
-		}
-
-		// 处理字节数组（[]byte）类型字段
-		if fieldValue.Kind() == reflect.Slice && fieldValue.Type().Elem().Kind() == reflect.Uint8 {
-			// 如果字节数组长度大于 1024，则截断
-			if fieldValue.Len() > 1024 {
-				truncatedBytes := append(fieldValue.Slice(0, 1024).Bytes(), []byte("......")...)
-				fieldValue.SetBytes(truncatedBytes)
-			}
-		}
-
-		// 处理嵌套的消息类型字段
-		if fieldValue.Kind() == reflect.Ptr && !fieldValue.IsNil() && fieldValue.Elem().Kind() == reflect.Struct {
-			nestedMsg, ok := fieldValue.Interface().(proto.Message)
-			if ok {
-				truncateMessageFields(nestedMsg)
+func truncateMessage(msg protoreflect.Message) {
+	var fields []protoreflect.FieldDescriptor
+	msg.Range(func(fd protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		fields = append(fields, fd)
+		return true
+	})
+	for _, fd := range fields {
+		v := msg.Get(fd)
+		switch {
+		case fd.IsList():
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				if truncated, ok := truncateValue(fd, list.Get(i)); ok {
+					list.Set(i, truncated)
+				}
 			}
-		}
-
-		// 处理 repeated 字段（slice 类型）
-		if fieldValue.Kind() == reflect.Slice && fieldValue.Type().Elem().Kind() == reflect.Ptr {
-			for j := 0; j < fieldValue.Len(); j++ {
-				item := fieldValue.Index(j)
-				if item.Kind() == reflect.Ptr && item.Elem().Kind() == reflect.Struct {
-					nestedMsg, ok := item.Interface().(proto.Message)
-					if ok {
-						truncateMessageFields(nestedMsg)
-					}
+		case fd.IsMap():
+			m := v.Map()
+			var keys []protoreflect.MapKey
+			m.Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+				keys = append(keys, k)
+				return true
+			})
+			for _, k := range keys {
+				if truncated, ok := truncateValue(fd.MapValue(), m.Get(k)); ok {
+					m.Set(k, truncated)
 				}
 			}
+		default:
+			if truncated, ok := truncateValue(fd, v); ok {
+				msg.Set(fd, truncated)
+			}
 		}
 	}
+}
 
-	return copyMsg
+// truncateValue 截断单个值, 嵌套的 message 直接修改, 返回 true 时需要写回截断后的值
+func truncateValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) (protoreflect.Value, bool) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		if str := v.String(); len(str) > maxDisplayFieldLength {
+			return protoreflect.ValueOfString(str[:maxDisplayFieldLength] + "......"), true
+		}
+	case protoreflect.BytesKind:
+		if b := v.Bytes(); len(b) > maxDisplayFieldLength {
+			truncated := append(append([]byte{}, b[:maxDisplayFieldLength]...), "......"...)
+			return protoreflect.ValueOfBytes(truncated), true
+		}
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		truncateMessage(v.Message())
+	}
+	return v, false
 }
 
 func protoNew(L *lua.LState) int {
 	msgTypeName := L.CheckString(1) // 这里确保第一个参数是字符串类型
 
 	// 查找消息类型
-	msgType, err := protoregistry.GlobalTypes.FindMessageByName(protoreflect.FullName(msgTypeName))
+	msgType, err := FindProtoMessageType(msgTypeName)
 	if err != nil {
 		L.Push(lua.LNil)
-		L.Push(lua.LString("invalid message type: " + msgTypeName))
+		L.Push(lua.LString(err.Error()))
 		return 2
 	}
 
 	msg := msgType.New().Interface()
 
 	if L.GetTop() > 1 {
-		initTable := L.CheckTable(2)
-		initTable.ForEach(func(key lua.LValue, value lua.LValue) {
-			fieldName := key.String()
-			fieldValue := ConvertLuaValueToGo(value)
-			setFieldByName(msg, fieldName, fieldValue)
-		})
+		if err := SetProtoMessage(msg.ProtoReflect(), ConvertLuaValueToGo(L.CheckTable(2))); err != nil {
+			L.ArgError(2, err.Error())
+		}
 	}
 	// 将消息实例返回给 Lua
 	ud := L.NewUserData()
 	ud.Value = msg
-	L.SetMetatable(ud, L.GetTypeMetatable("ProtobufMessage"))
+	L.SetMetatable(ud, L.GetTypeMetatable(ProtobufMessageTypeName))
 	L.Push(ud)
 	return 1
 }
-
-// __index 元方法：获取 Protobuf 消息的字段值
-func protoIndex(L *lua.LState) int {
-	ud := L.CheckUserData(1)
-	fieldName := L.CheckString(2)
-
-	if msg, ok := ud.Value.(proto.Message); ok {
-		val := getFieldByName(msg, fieldName)
-		L.Push(ConvertGoValueToLua(L, val))
-		return 1
-	}
-	return 0
-}
-
-// __newindex 元方法：设置 Protobuf 消息的字段值
-func protoNewIndex(L *lua.LState) int {
-	ud := L.CheckUserData(1)
-	fieldName := L.CheckString(2)
-	newValue := ConvertLuaValueToGo(L.Get(3))
-
-	if msg, ok := ud.Value.(proto.Message); ok {
-		setFieldByName(msg, fieldName, newValue)
-	}
-	return 0
-}
-
-// 使用反射获取字段值
-func getFieldByName(msg proto.Message, fieldName string) interface{} {
-	val := reflect.ValueOf(msg).Elem().FieldByName(fieldName)
-	if val.IsValid() {
-		return val.Interface()
-	}
-	return nil
-}
-
-// 使用反射设置字段值
-func setFieldByName(msg proto.Message, fieldName string, newValue interface{}) {
-	val := reflect.ValueOf(msg).Elem().FieldByName(fieldName)
-	if val.IsValid() && val.CanSet() {
-		// 将 Lua 值转换为 Go 值并直接设置
-		newVal := reflect.ValueOf(newValue)
-		// 特别处理 []byte 类型
-		if val.Kind() == reflect.Slice && val.Type().Elem().Kind() == reflect.Uint8 {
-			if str, ok := newValue.(string); ok {
-				newVal = reflect.ValueOf([]byte(str))
-			}
-		} else if val.Kind() == reflect.Slice && val.Type().Elem().Kind() == reflect.String {
-			// 特别处理 []interface{} 到 []string 的转换
-			if newVal.Kind() == reflect.Slice && newVal.Type().Elem().Kind() == reflect.Interface {
-				slice := newValue.([]interface{})
-				strSlice := make([]string, len(slice))
-				for i, v := range slice {
-					if str, ok := v.(string); ok {
-						strSlice[i] = str
-					} else {
-						fmt.Printf("element %d in %s is not a string\n", i, fieldName)
-						return
-					}
-				}
-				newVal = reflect.ValueOf(strSlice)
-			}
-		}
-
-		// 检查是否可以直接设置值
-		if newVal.Type().ConvertibleTo(val.Type()) {
-			val.Set(newVal.Convert(val.Type()))
-		} else {
-			fmt.Printf("Error: cannot convert %s to %s \n", fieldName, val.Type())
-		}
-	} else {
-		fmt.Printf("Error: invalid field: %s \n", fieldName)
-	}
-}
-
-func mergeLTable(table1, table2 *lua.LTable) {
-	table2.ForEach(func(key, value lua.LValue) {
-		table1.RawSet(key, value)
-	})
-}
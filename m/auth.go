@@ -0,0 +1,231 @@
+package m
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// AuthorizationCacheTTL 是 AuthorizationCmd 输出的缓存时间
+	AuthorizationCacheTTL = 5 * time.Minute
+	// AuthorizationCmdTimeout 是 AuthorizationCmd 的最长执行时间
+	AuthorizationCmdTimeout = 30 * time.Second
+)
+
+const redactedAuthorization = "[REDACTED]"
+
+type cachedAuthorization struct {
+	value   string
+	expires time.Time
+}
+
+var (
+	authCacheMu sync.Mutex
+	authCache   = make(map[string]cachedAuthorization)
+)
+
+// authorization 返回 cfg 的 Authorization 头, 优先使用 Authorization, 其次是 AuthorizationCmd 的输出.
+// 值可以带 "Bearer ", "Basic ", "token " 前缀, "user:password" 使用 basic 认证, 其他视为 bearer token
+func (cfg *MalConfig) authorization() (string, error) {
+	if cfg == nil {
+		return "", nil
+	}
+	value := cfg.Authorization
+	if value == "" && cfg.AuthorizationCmd != "" {
+		var err error
+		value, err = runAuthorizationCmd(cfg.AuthorizationCmd)
+		if err != nil {
+			return "", err
+		}
+	}
+	return authorizationHeader(value), nil
+}
+
+func authorizationHeader(value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ""
+	}
+	if i := strings.IndexByte(value, ' '); i > 0 {
+		switch strings.ToLower(value[:i]) {
+		case "bearer", "basic", "token":
+			return value
+		}
+	}
+	if strings.Contains(value, ":") {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	return "Bearer " + value
+}
+
+// authorizes 报告是否向 reqURL 发送认证信息, 只发送给 RepoURL 所在的主机,
+// 避免 release 中指向第三方存储的下载地址拿到 token
+func (cfg *MalConfig) authorizes(reqURL *url.URL) bool {
+	if cfg == nil || (cfg.Authorization == "" && cfg.AuthorizationCmd == "") {
+		return false
+	}
+	repo, err := url.Parse(cfg.RepoURL)
+	if err != nil || repo.Host == "" {
+		return false
+	}
+	host, repoHost := strings.ToLower(reqURL.Host), strings.ToLower(repo.Host)
+	if host == repoHost {
+		return true
+	}
+	// github.com 的 release API 在 api.github.com
+	return (repoHost == "github.com" && host == "api.github.com") || (repoHost == "api.github.com" && host == "github.com")
+}
+
+// inheritAuthorization 返回索引项 cfg 的副本, 认证只来自本地配置的索引仓库 index:
+// 忽略索引项自带的认证, 与索引在同一主机的仓库沿用索引的认证. index 为 nil 时 cfg 即本地配置, 原样返回
+func inheritAuthorization(cfg, index *MalConfig) *MalConfig {
+	if index == nil || index == cfg {
+		return cfg
+	}
+	inherited := *cfg
+	inherited.Authorization, inherited.AuthorizationCmd = "", ""
+	if u, err := url.Parse(cfg.RepoURL); err == nil && u.Host != "" && index.authorizes(u) {
+		inherited.Authorization = index.Authorization
+		inherited.AuthorizationCmd = index.AuthorizationCmd
+	}
+	return &inherited
+}
+
+// setAuthorization 为发往仓库的请求添加 Authorization 头
+func setAuthorization(req *http.Request, cfg *MalConfig) error {
+	if !cfg.authorizes(req.URL) {
+		return nil
+	}
+	auth, err := cfg.authorization()
+	if err != nil {
+		return err
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	return nil
+}
+
+// runAuthorizationCmd 执行命令并返回 stdout, 结果缓存 AuthorizationCacheTTL
+func runAuthorizationCmd(command string) (string, error) {
+	authCacheMu.Lock()
+	defer authCacheMu.Unlock()
+	if cached, ok := authCache[command]; ok && time.Now().Before(cached.expires) {
+		return cached.value, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), AuthorizationCmdTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	// stderr 可能包含凭据, 不出现在错误信息中
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("authorization_cmd failed: %v", err)
+	}
+	value := strings.TrimSpace(stdout.String())
+	if value == "" {
+		return "", fmt.Errorf("authorization_cmd returned empty output")
+	}
+	authCache[command] = cachedAuthorization{value: value, expires: time.Now().Add(AuthorizationCacheTTL)}
+	return value, nil
+}
+
+// invalidateAuthorization 删除 AuthorizationCmd 的缓存, 用于 token 过期后重新获取
+func invalidateAuthorization(cfg *MalConfig) bool {
+	if cfg == nil || cfg.Authorization != "" || cfg.AuthorizationCmd == "" {
+		return false
+	}
+	authCacheMu.Lock()
+	defer authCacheMu.Unlock()
+	if _, ok := authCache[cfg.AuthorizationCmd]; !ok {
+		return false
+	}
+	delete(authCache, cfg.AuthorizationCmd)
+	return true
+}
+
+// redact 将 s 中出现的认证信息替换为 [REDACTED]
+func (cfg *MalConfig) redact(s string) string {
+	if cfg == nil {
+		return s
+	}
+	var secrets []string
+	if cfg.Authorization != "" {
+		secrets = append(secrets, cfg.Authorization, authorizationHeader(cfg.Authorization))
+	}
+	if cfg.AuthorizationCmd != "" {
+		authCacheMu.Lock()
+		if cached, ok := authCache[cfg.AuthorizationCmd]; ok {
+			secrets = append(secrets, cached.value, authorizationHeader(cached.value))
+		}
+		authCacheMu.Unlock()
+	}
+	for _, secret := range secrets {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			s = strings.ReplaceAll(s, secret, redactedAuthorization)
+		}
+		// 同时替换去掉认证方式后的 token
+		if i := strings.IndexByte(secret, ' '); i > 0 && i < len(secret)-1 {
+			s = strings.ReplaceAll(s, secret[i+1:], redactedAuthorization)
+		}
+	}
+	return s
+}
+
+func (cfg *MalConfig) redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if msg := cfg.redact(err.Error()); msg != err.Error() {
+		return &redactedError{msg: msg, err: err}
+	}
+	return err
+}
+
+// redactedError 隐藏了原始错误信息中的认证信息, 保留 Unwrap 以便 errors.Is 判断
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// Redacted 返回隐藏了认证信息的副本, 用于打印或记录日志
+func (cfg *MalConfig) Redacted() *MalConfig {
+	if cfg == nil {
+		return nil
+	}
+	redacted := *cfg
+	if redacted.Authorization != "" {
+		redacted.Authorization = redactedAuthorization
+	}
+	return &redacted
+}
+
+func (cfg *MalConfig) String() string {
+	if cfg == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%+v", *cfg.Redacted())
+}
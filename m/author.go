@@ -0,0 +1,396 @@
+package m
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/chainreactors/mals"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// MalTestDir 是 mal 中测试脚本所在的目录, 其中的 *_test.lua 由 RunMalTests 执行
+	MalTestDir = "tests"
+
+	// mal 的名称同时作为安装目录与 <name>.tar.gz 的文件名
+	malNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+)
+
+const scaffoldManifest = `name: %s
+version: v0.1.0
+entrypoint: %s
+help: %s
+author: ""
+license: ""
+tags: []
+# 支持的 implant 平台, 为空表示不限制
+os: []
+arch: []
+# 依赖的 mal 及版本约束
+# dependencies:
+#   community-lib: ^1.0
+# 需要的权限, 未声明的访问在运行时被拒绝
+permissions: {}
+`
+
+const scaffoldEntrypoint = `-- %s
+local M = {}
+
+function M.hello(name)
+    return "hello, " .. (name or "world")
+end
+
+return M
+`
+
+const scaffoldTest = `-- %s 的测试, 失败时抛出错误即可
+local main = require("%s")
+
+assert(main.hello("mal") == "hello, mal", "unexpected greeting")
+`
+
+// ScaffoldMal 在 dir 下创建名为 name 的 mal, 包括 mal.yaml, 入口脚本与测试脚本. dir 不为空时返回错误
+func ScaffoldMal(dir, name string) (*Manifest, error) {
+	if !malNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid mal name %q, only letters, digits, '.', '_' and '-' are allowed", name)
+	}
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("%s is not empty", dir)
+	}
+	module := strings.TrimSuffix(DefaultEntrypoint, ".lua")
+	files := map[string]string{
+		ManifestFileName:  fmt.Sprintf(scaffoldManifest, name, DefaultEntrypoint, name),
+		DefaultEntrypoint: fmt.Sprintf(scaffoldEntrypoint, name),
+		filepath.Join(MalTestDir, module+"_test.lua"): fmt.Sprintf(scaffoldTest, name, module),
+	}
+	for _, file := range sortedKeys(files) {
+		target := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(target, []byte(files[file]), 0644); err != nil {
+			return nil, err
+		}
+	}
+	return LoadManifest(dir)
+}
+
+// ValidateMal 检查 dir 是否可以发布: mal.yaml 合法, 名称与版本可以作为文件名与 tag,
+// entrypoint 存在, 所有 lua 文件都能编译. 返回的错误包含所有发现的问题
+func ValidateMal(dir string) (*Manifest, error) {
+	manifest, err := LoadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	var problems []error
+	if !malNamePattern.MatchString(manifest.Name) {
+		problems = append(problems, fmt.Errorf("%s: invalid name %q", ManifestFileName, manifest.Name))
+	}
+	if manifest.Version == "" {
+		problems = append(problems, fmt.Errorf("%s: version is required", ManifestFileName))
+	} else if err := checkPathSegment("version", manifest.Version); err != nil || strings.ContainsAny(manifest.Version, " \t") {
+		problems = append(problems, fmt.Errorf("%s: invalid version %q", ManifestFileName, manifest.Version))
+	}
+	if info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(manifest.Entrypoint))); err != nil {
+		problems = append(problems, fmt.Errorf("entrypoint %s not found", manifest.Entrypoint))
+	} else if !info.Mode().IsRegular() {
+		problems = append(problems, fmt.Errorf("entrypoint %s is not a regular file", manifest.Entrypoint))
+	}
+
+	files, err := malFiles(dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file, ".lua") {
+			if err := compileLua(filepath.Join(dir, filepath.FromSlash(file)), file); err != nil {
+				problems = append(problems, err)
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return manifest, errors.Join(problems...)
+	}
+	return manifest, nil
+}
+
+func compileLua(path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	chunk, err := parse.Parse(f, name)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if _, err := lua.Compile(chunk, name); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// malFiles 返回 dir 中需要打包的文件, 使用 / 分隔的相对路径, 按字典序排列.
+// 以 . 开头的文件与目录以及 skip 中的绝对路径被忽略, 不允许链接
+func malFiles(dir string, skip map[string]bool) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") || skip[abs] {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.Type()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("links are not allowed in mal: %s", rel)
+		}
+		if d.IsDir() {
+			files = append(files, rel+"/")
+		} else if d.Type().IsRegular() {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// RunMalTests 加载 dir 下的 mal 并依次执行 tests 目录中的 *_test.lua, 每个测试脚本使用独立的 VM.
+// 测试脚本拥有与 mal 相同的权限, 可以通过 require 加载 mal 中的模块
+func RunMalTests(dir string, opts ...mals.VMOption) error {
+	tests, err := filepath.Glob(filepath.Join(dir, MalTestDir, "*_test.lua"))
+	if err != nil {
+		return err
+	}
+	var failures []error
+	for _, test := range tests {
+		mal, err := LoadMal(dir, opts...)
+		if err != nil {
+			return err
+		}
+		if err := mals.RunFile(mal.VM, test); err != nil {
+			failures = append(failures, fmt.Errorf("%s: %v", filepath.Base(test), err))
+		}
+		mal.Close()
+	}
+	return errors.Join(failures...)
+}
+
+// Package 是 Pack 生成的发布文件
+type Package struct {
+	Manifest *Manifest
+	// Path 为 <name>.tar.gz, ChecksumPath 为 <name>.tar.gz.sha256
+	Path         string
+	ChecksumPath string
+	// Checksum 形如 "sha256:<hex>"
+	Checksum string
+	Size     int64
+}
+
+// Pack 校验 dir 后打包到 outDir/<name>.tar.gz, 并写入 sha256 校验文件.
+// 文件位于压缩包的根目录, 与安装时 ExtractTarGz 的布局一致, 时间与属主固定以保证相同内容的 checksum 不变.
+// MalTestDir 中的测试脚本不打包
+func Pack(dir, outDir string) (*Package, error) {
+	manifest, err := ValidateMal(dir)
+	if err != nil {
+		return nil, err
+	}
+	pkgName := fmt.Sprintf("%s.tar.gz", manifest.Name)
+	pkgPath, err := filepath.Abs(filepath.Join(outDir, pkgName))
+	if err != nil {
+		return nil, err
+	}
+	sumPath := pkgPath + ChecksumFileSuffix
+	absOut, err := filepath.Abs(outDir)
+	if err != nil {
+		return nil, err
+	}
+	absTests, err := filepath.Abs(filepath.Join(dir, MalTestDir))
+	if err != nil {
+		return nil, err
+	}
+	// 测试脚本只在发布前执行, 不打包
+	files, err := malFiles(dir, map[string]bool{absOut: true, pkgPath: true, sumPath: true, absTests: true})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := packTarGz(dir, files)
+	if err != nil {
+		return nil, err
+	}
+	// 确认安装时可以读取到相同的 manifest
+	packed, err := ReadTarGzFile(data, ManifestFileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from package: %v", ManifestFileName, err)
+	}
+	if _, err := ParseManifest(packed); err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(pkgPath, data); err != nil {
+		return nil, err
+	}
+	checksum := fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum[:]), pkgName)
+	if err := writeFileAtomic(sumPath, []byte(checksum)); err != nil {
+		return nil, err
+	}
+	return &Package{
+		Manifest:     manifest,
+		Path:         pkgPath,
+		ChecksumPath: sumPath,
+		Checksum:     "sha256:" + hex.EncodeToString(sum[:]),
+		Size:         int64(len(data)),
+	}, nil
+}
+
+func packTarGz(dir string, files []string) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	var total int64
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		header := &tar.Header{
+			Name:    file,
+			Mode:    int64(info.Mode().Perm()),
+			ModTime: time.Unix(0, 0),
+			Format:  tar.FormatPAX,
+		}
+		if info.IsDir() {
+			header.Typeflag = tar.TypeDir
+			header.Mode = 0755
+			if err := tw.WriteHeader(header); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		total += info.Size()
+		if total > MaxPackageSize {
+			return nil, fmt.Errorf("package exceeds %d bytes", MaxPackageSize)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		header.Typeflag = tar.TypeReg
+		header.Size = int64(len(content))
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// IndexEntry 返回 mals.yaml 中对应的索引项, repoURL 为发布 <name>.tar.gz 的仓库
+func (pkg *Package) IndexEntry(repoURL string) *MalConfig {
+	manifest := pkg.Manifest
+	return &MalConfig{
+		RepoURL:        repoURL,
+		Name:           manifest.Name,
+		Version:        manifest.Version,
+		Help:           manifest.Help,
+		Description:    manifest.Description,
+		Tags:           manifest.Tags,
+		Author:         manifest.Author,
+		License:        manifest.License,
+		Homepage:       manifest.Homepage,
+		OS:             manifest.OS,
+		Arch:           manifest.Arch,
+		Checksum:       pkg.Checksum,
+		Size:           pkg.Size,
+		MinHostVersion: manifest.MinHostVersion,
+	}
+}
+
+// UpdateIndex 将 entry 写入 path 中的 mals.yaml, 文件不存在时创建.
+// 已有同名项时替换, 旧的版本保留在 Versions 中供依赖解析选择, entry 没有设置的仓库配置沿用旧值
+func UpdateIndex(path string, entry *MalConfig) error {
+	var index MalsYaml
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := yaml.Unmarshal(data, &index); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	updated := *entry
+	replaced := false
+	for i, old := range index.Mals {
+		if old.Name != entry.Name {
+			continue
+		}
+		if updated.RepoURL == "" {
+			updated.RepoURL = old.RepoURL
+		}
+		if updated.Type == "" {
+			updated.Type = old.Type
+		}
+		if updated.PublicKey == "" {
+			updated.PublicKey = old.PublicKey
+		}
+		updated.Versions = nil
+		for _, version := range append([]string{old.Version}, old.Versions...) {
+			if version != "" && version != updated.Version && !containsFold(updated.Versions, version) {
+				updated.Versions = append(updated.Versions, version)
+			}
+		}
+		index.Mals[i] = &updated
+		replaced = true
+		break
+	}
+	if !replaced {
+		index.Mals = append(index.Mals, &updated)
+	}
+
+	fileData, err := yaml.Marshal(&index)
+	if err != nil {
+		return fmt.Errorf("failed to marshal malData to YAML: %v", err)
+	}
+	return writeFileAtomic(path, fileData)
+}
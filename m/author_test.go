@@ -0,0 +1,50 @@
+package m
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPackExcludesTests(t *testing.T) {
+	dir, out := t.TempDir(), t.TempDir()
+	if _, err := ScaffoldMal(dir, "demo"); err != nil {
+		t.Fatal(err)
+	}
+	pkg, err := Pack(dir, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(pkg.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadTarGzFile(data, DefaultEntrypoint); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadTarGzFile(data, MalTestDir+"/main_test.lua"); err == nil {
+		t.Fatalf("%s should not be packed", MalTestDir)
+	}
+}
+
+func TestValidateMalVersion(t *testing.T) {
+	for _, version := range []string{"..", "../v1", "v1/v2", `v1\v2`, "v1 v2"} {
+		dir := t.TempDir()
+		if _, err := ScaffoldMal(dir, "demo"); err != nil {
+			t.Fatal(err)
+		}
+		manifest := filepath.Join(dir, ManifestFileName)
+		data, err := os.ReadFile(manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = []byte(strings.Replace(string(data), "version: v0.1.0", "version: '"+version+"'", 1))
+		if err := os.WriteFile(manifest, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ValidateMal(dir); err == nil || !strings.Contains(err.Error(), "invalid version") {
+			t.Errorf("expected version %q to be rejected, got %v", version, err)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package m
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotCached 表示离线模式下请求的地址没有缓存
+var ErrNotCached = errors.New("not available in offline cache")
+
+// cacheEntry 是缓存的响应的元数据, 响应体保存在同名的 .body 文件中
+type cacheEntry struct {
+	URL          string      `json:"url"`
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"last_modified,omitempty"`
+	Header       http.Header `json:"header,omitempty"`
+	StoredAt     time.Time   `json:"stored_at"`
+	// Expires 之前直接使用缓存, 为零值时每次都需要重新验证
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+func (entry *cacheEntry) fresh(now time.Time) bool {
+	return !entry.Expires.IsZero() && now.Before(entry.Expires)
+}
+
+// response 构造一个与缓存内容对应的 200 响应
+func (entry *cacheEntry) response(reqURL string) *http.Response {
+	req, _ := http.NewRequest(http.MethodGet, reqURL, http.NoBody)
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     entry.Header.Clone(),
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
+
+// cachePolicy 根据 Cache-Control 与 Expires 计算过期时间, no-store 时 store 为 false
+func cachePolicy(header http.Header, now time.Time) (expires time.Time, store bool) {
+	store = true
+	maxAge := -1
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store":
+			return time.Time{}, false
+		case directive == "no-cache":
+			maxAge = 0
+		case strings.HasPrefix(directive, "max-age=") && maxAge != 0:
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+				maxAge = seconds
+			}
+		}
+	}
+	if maxAge > 0 {
+		return now.Add(time.Duration(maxAge) * time.Second), store
+	} else if maxAge == 0 {
+		return time.Time{}, store
+	}
+	if exp, err := http.ParseTime(header.Get("Expires")); err == nil && exp.After(now) {
+		return exp, store
+	}
+	return time.Time{}, store
+}
+
+// httpCache 按 URL 将 GET 的响应缓存到目录中, credential 不为空时与 URL 一起作为 key
+type httpCache struct {
+	dir        string
+	credential string
+}
+
+// cacheCredential 返回发往 reqURL 的请求使用的凭据, 带认证的响应只能被相同凭据的请求读取.
+// AuthorizationCmd 使用命令本身区分, 读取缓存时不需要执行命令
+func cacheCredential(cfg *MalConfig, reqURL string) string {
+	u, err := url.Parse(reqURL)
+	if err != nil || !cfg.authorizes(u) {
+		return ""
+	}
+	return cfg.Authorization + "\n" + cfg.AuthorizationCmd
+}
+
+func (cache *httpCache) paths(reqURL string) (string, string) {
+	key := reqURL
+	if cache.credential != "" {
+		key += "\n" + cache.credential
+	}
+	sum := sha256.Sum256([]byte(key))
+	name := filepath.Join(cache.dir, hex.EncodeToString(sum[:]))
+	return name + ".json", name + ".body"
+}
+
+func (cache *httpCache) load(reqURL string) (*cacheEntry, []byte) {
+	metaPath, bodyPath := cache.paths(reqURL)
+	meta, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, nil
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(meta, entry); err != nil || entry.URL != reqURL {
+		return nil, nil
+	}
+	body, err := os.ReadFile(bodyPath)
+	if err != nil {
+		return nil, nil
+	}
+	return entry, body
+}
+
+func (cache *httpCache) store(reqURL string, header http.Header, body []byte) error {
+	expires, store := cachePolicy(header, time.Now())
+	if !store {
+		return nil
+	}
+	entry := &cacheEntry{
+		URL:          reqURL,
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+		Header:       http.Header{},
+		StoredAt:     time.Now(),
+		Expires:      expires,
+	}
+	for _, key := range []string{"Content-Type", "ETag", "Last-Modified", "Cache-Control", "Link"} {
+		if value := header.Get(key); value != "" {
+			entry.Header.Set(key, value)
+		}
+	}
+	_, bodyPath := cache.paths(reqURL)
+	if err := os.MkdirAll(cache.dir, 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(bodyPath, body); err != nil {
+		return err
+	}
+	return cache.writeEntry(entry)
+}
+
+// revalidate 在 304 后更新过期时间
+func (cache *httpCache) revalidate(entry *cacheEntry, header http.Header) error {
+	expires, store := cachePolicy(header, time.Now())
+	if !store {
+		return nil
+	}
+	entry.Expires = expires
+	if etag := header.Get("ETag"); etag != "" {
+		entry.ETag = etag
+		entry.Header.Set("ETag", etag)
+	}
+	return cache.writeEntry(entry)
+}
+
+func (cache *httpCache) writeEntry(entry *cacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	metaPath, _ := cache.paths(entry.URL)
+	return writeFileAtomic(metaPath, data)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// cachedRequest 优先使用未过期的缓存, 过期后通过 If-None-Match/If-Modified-Since 重新验证.
+// 网络错误或服务端错误时使用过期的缓存, Offline 时只读取缓存. 带认证的请求按凭据分别缓存
+func cachedRequest(clientConfig MalHTTPConfig, reqURL string, extraHeaders http.Header) (*http.Response, []byte, error) {
+	cache := &httpCache{dir: clientConfig.CacheDir, credential: cacheCredential(clientConfig.MalConfig, reqURL)}
+	entry, body := cache.load(reqURL)
+	if entry != nil && (clientConfig.Offline || (!clientConfig.IgnoreCache && entry.fresh(time.Now()))) {
+		return entry.response(reqURL), body, nil
+	}
+	if clientConfig.Offline {
+		return nil, nil, fmt.Errorf("%w: %s", ErrNotCached, reqURL)
+	}
+
+	headers := http.Header{}
+	for key, values := range extraHeaders {
+		headers[key] = values
+	}
+	if entry != nil && !clientConfig.IgnoreCache {
+		if entry.ETag != "" {
+			headers.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			headers.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+	resp, data, err := authorizedRequest(clientConfig, reqURL, headers)
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+		if entry != nil {
+			return entry.response(reqURL), body, nil
+		}
+		return resp, data, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotModified && entry != nil:
+		if err := cache.revalidate(entry, resp.Header); err != nil {
+			return nil, nil, fmt.Errorf("failed to update http cache: %v", err)
+		}
+		return entry.response(reqURL), body, nil
+	case resp.StatusCode == http.StatusOK:
+		if err := cache.store(reqURL, resp.Header, data); err != nil {
+			return nil, nil, fmt.Errorf("failed to write http cache: %v", err)
+		}
+	}
+	return resp, data, nil
+}
+
+// ClearCache 删除 dir 中的所有缓存
+func ClearCache(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if ext := filepath.Ext(entry.Name()); ext == ".json" || ext == ".body" {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
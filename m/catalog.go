@@ -0,0 +1,268 @@
+package m
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CatalogFileName 是合并后的索引, 与 mals.yaml 保存在同一目录
+var CatalogFileName = "mals.catalog.yaml"
+
+// RepoIndex 是一个索引仓库与它的 mals.yaml
+type RepoIndex struct {
+	Repo *MalConfig
+	Mals []*MalConfig
+	// Err 为获取索引失败的原因
+	Err error
+}
+
+// CatalogRepo 记录参与合并的索引仓库
+type CatalogRepo struct {
+	Name     string `yaml:"name"`
+	RepoURL  string `yaml:"repo_url"`
+	Priority int    `yaml:"priority"`
+	Mals     int    `yaml:"mals"`
+	// Error 为本次更新失败的原因, 此时沿用上一次合并结果中该仓库的 mal
+	Error     string    `yaml:"error,omitempty"`
+	UpdatedAt time.Time `yaml:"updated_at"`
+}
+
+// CatalogMal 是合并后的一项, Source 为提供它的索引仓库
+type CatalogMal struct {
+	MalConfig `yaml:",inline"`
+	Source    string `yaml:"source"`
+	// ShadowedBy 为遮蔽了该项的索引仓库, 只出现在 Catalog.Shadowed 中
+	ShadowedBy string `yaml:"shadowed_by,omitempty"`
+
+	index *MalConfig
+}
+
+// Config 返回安装时使用的配置, 公钥, insecure 与认证只来自所在索引仓库的本地配置
+func (mal *CatalogMal) Config() *MalConfig {
+	cfg := mal.MalConfig
+	cfg.PublicKey, cfg.Insecure = "", false
+	cfg.Authorization, cfg.AuthorizationCmd = "", ""
+	cfg.catalog = true
+	if mal.index != nil {
+		cfg.PublicKey = mal.index.PublicKey
+		cfg.Insecure = mal.index.Insecure
+	}
+	return inheritAuthorization(&cfg, mal.index)
+}
+
+// Collision 是多个索引仓库中同名的 mal, Mal 为生效的一项
+type Collision struct {
+	Name     string
+	Mal      *CatalogMal
+	Shadowed []*CatalogMal
+}
+
+func (c *Collision) String() string {
+	sources := make([]string, len(c.Shadowed))
+	for i, mal := range c.Shadowed {
+		sources[i] = mal.Source
+	}
+	return fmt.Sprintf("%s from %s shadows %s", c.Name, c.Mal.Source, strings.Join(sources, ", "))
+}
+
+// Catalog 是按 priority 合并多个索引仓库后的结果.
+// 同名的 mal 只保留 priority 最高的仓库中的一项, priority 相同时先配置的仓库优先, 其余记录在 Shadowed
+type Catalog struct {
+	Repos    []*CatalogRepo `yaml:"repos"`
+	Mals     []*CatalogMal  `yaml:"mals"`
+	Shadowed []*CatalogMal  `yaml:"shadowed,omitempty"`
+}
+
+// MergeIndexes 合并多个索引, 获取失败的索引只记录在 Repos 中
+func MergeIndexes(indexes []*RepoIndex) *Catalog {
+	indexes = append([]*RepoIndex{}, indexes...)
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return indexes[i].Repo.Priority > indexes[j].Repo.Priority
+	})
+	catalog := &Catalog{}
+	winners := make(map[string]*CatalogMal)
+	for _, index := range indexes {
+		source := repoName(index.Repo)
+		repo := &CatalogRepo{
+			Name:      source,
+			RepoURL:   index.Repo.RepoURL,
+			Priority:  index.Repo.Priority,
+			Mals:      len(index.Mals),
+			UpdatedAt: time.Now(),
+		}
+		if index.Err != nil {
+			repo.Error = index.Repo.redact(index.Err.Error())
+		}
+		catalog.Repos = append(catalog.Repos, repo)
+		for _, cfg := range index.Mals {
+			mal := &CatalogMal{MalConfig: *cfg, Source: source, index: index.Repo}
+			if winner, ok := winners[cfg.Name]; ok {
+				mal.ShadowedBy = winner.Source
+				catalog.Shadowed = append(catalog.Shadowed, mal)
+				continue
+			}
+			winners[cfg.Name] = mal
+			catalog.Mals = append(catalog.Mals, mal)
+		}
+	}
+	return catalog
+}
+
+func repoName(repo *MalConfig) string {
+	if repo.Name != "" {
+		return repo.Name
+	}
+	return repo.RepoURL
+}
+
+func (catalog *Catalog) Get(name string) *CatalogMal {
+	for _, mal := range catalog.Mals {
+		if mal.Name == name {
+			return mal
+		}
+	}
+	return nil
+}
+
+// Collisions 返回所有同名的 mal, 按名称排序
+func (catalog *Catalog) Collisions() []*Collision {
+	collisions := make(map[string]*Collision)
+	for _, mal := range catalog.Shadowed {
+		c, ok := collisions[mal.Name]
+		if !ok {
+			c = &Collision{Name: mal.Name, Mal: catalog.Get(mal.Name)}
+			collisions[mal.Name] = c
+		}
+		c.Shadowed = append(c.Shadowed, mal)
+	}
+	result := make([]*Collision, 0, len(collisions))
+	for _, name := range sortedKeys(collisions) {
+		result = append(result, collisions[name])
+	}
+	return result
+}
+
+// Configs 返回生效的 mal 的配置, 可以直接用于 NewInstaller
+func (catalog *Catalog) Configs() []*MalConfig {
+	configs := make([]*MalConfig, len(catalog.Mals))
+	for i, mal := range catalog.Mals {
+		configs[i] = mal.Config()
+	}
+	return configs
+}
+
+// Search 返回名称, 说明或标签中包含 keyword 的 mal, 不区分大小写, keyword 为空时返回全部
+func (catalog *Catalog) Search(keyword string) []*CatalogMal {
+	return catalog.Query(SearchQuery{Keyword: keyword})
+}
+
+// Write 将合并结果写入 path, 不保存认证信息
+func (catalog *Catalog) Write(path string) error {
+	stored := &Catalog{Repos: catalog.Repos}
+	strip := func(mals []*CatalogMal) []*CatalogMal {
+		result := make([]*CatalogMal, len(mals))
+		for i, mal := range mals {
+			copied := *mal
+			copied.Authorization = ""
+			copied.AuthorizationCmd = ""
+			result[i] = &copied
+		}
+		return result
+	}
+	stored.Mals = strip(catalog.Mals)
+	stored.Shadowed = strip(catalog.Shadowed)
+	data, err := yaml.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("failed to marshal catalog to YAML: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// ReadCatalog 读取 path 中的合并结果, repos 为当前配置的索引仓库, 用于恢复每一项的公钥与认证
+func ReadCatalog(path string, repos []*MalConfig) (*Catalog, error) {
+	catalog := &Catalog{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return catalog, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, catalog); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	catalog.bind(repos)
+	return catalog, nil
+}
+
+func (catalog *Catalog) bind(repos []*MalConfig) {
+	byName := make(map[string]*MalConfig)
+	for _, repo := range repos {
+		byName[repoName(repo)] = repo
+	}
+	for _, mal := range append(append([]*CatalogMal{}, catalog.Mals...), catalog.Shadowed...) {
+		mal.index = byName[mal.Source]
+	}
+}
+
+// FetchCatalog 获取所有启用的索引仓库的 mals.yaml, 合并后写入 path 下的 mals.catalog.yaml.
+// 某个仓库获取失败时沿用上一次的结果, 避免低 priority 仓库中的同名 mal 意外生效; 所有仓库都失败时返回错误
+func FetchCatalog(repos []*MalConfig, path string, clientConfig MalHTTPConfig) (*Catalog, error) {
+	catalogPath := filepath.Join(path, CatalogFileName)
+	previous, err := ReadCatalog(catalogPath, repos)
+	if err != nil {
+		previous = &Catalog{}
+	}
+
+	var indexes []*RepoIndex
+	seen := make(map[string]bool)
+	failed := 0
+	for _, repo := range repos {
+		if !repo.Enabled {
+			continue
+		}
+		name := repoName(repo)
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate mal repo name %s", name)
+		}
+		seen[name] = true
+
+		index := &RepoIndex{Repo: repo}
+		config := clientConfig
+		config.MalConfig = repo
+		malData, err := fetchMalYaml(repo.RepoURL, config)
+		if err != nil {
+			failed++
+			index.Err = err
+			for _, mal := range append(append([]*CatalogMal{}, previous.Mals...), previous.Shadowed...) {
+				if mal.Source == name {
+					cfg := mal.MalConfig
+					index.Mals = append(index.Mals, &cfg)
+				}
+			}
+		} else {
+			index.Mals = malData.Mals
+		}
+		indexes = append(indexes, index)
+	}
+	if len(indexes) == 0 {
+		return nil, fmt.Errorf("no mal repo enabled")
+	}
+	if failed == len(indexes) {
+		return nil, fmt.Errorf("failed to fetch all mal repos: %v", indexes[0].Repo.redactError(indexes[0].Err))
+	}
+
+	catalog := MergeIndexes(indexes)
+	if err := catalog.Write(catalogPath); err != nil {
+		return catalog, fmt.Errorf("failed to write %s: %v", CatalogFileName, err)
+	}
+	return catalog, nil
+}
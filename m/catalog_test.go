@@ -0,0 +1,100 @@
+package m
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCatalogRepositoryAuthorization(t *testing.T) {
+	srv := newReleaseServer(t)
+	srv.file("/index/"+MalIndexFileName, testIndex)
+	srv.file("/demo/"+MalIndexFileName, testIndex)
+	index := &MalConfig{Name: "index", RepoURL: srv.URL + "/index", Type: RepoTypeHTTP, Authorization: "token index"}
+	mal := &MalConfig{Name: "demo", RepoURL: srv.URL + "/demo", Type: RepoTypeHTTP}
+	// 客户端配置指向同一主机的另一个仓库, 不应替换索引仓库的认证
+	client := MalHTTPConfig{MalConfig: &MalConfig{RepoURL: srv.URL + "/other", Authorization: "token client"}}
+
+	catalog := MergeIndexes([]*RepoIndex{{Repo: index, Mals: []*MalConfig{mal}}})
+	path := filepath.Join(t.TempDir(), CatalogFileName)
+	if err := catalog.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ReadCatalog(path, []*MalConfig{index})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, catalog := range map[string]*Catalog{"merged": catalog, "stored": stored} {
+		t.Run(name, func(t *testing.T) {
+			srv.auth = nil
+			repo, err := NewRepository(catalog.Configs()[0], client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := repo.Index(); err != nil {
+				t.Fatal(err)
+			}
+			if len(srv.auth) == 0 || srv.auth[0] != "token index" {
+				t.Fatalf("expected credentials of the index repo, got %q", srv.auth)
+			}
+		})
+	}
+}
+
+func TestMergeIndexes(t *testing.T) {
+	low := &MalConfig{Name: "low", RepoURL: "https://low.example.com"}
+	first := &MalConfig{Name: "first", RepoURL: "https://first.example.com", Priority: 10}
+	second := &MalConfig{Name: "second", RepoURL: "https://second.example.com", Priority: 10}
+	broken := &MalConfig{Name: "broken", RepoURL: "https://broken.example.com", Priority: 20, Authorization: "secret"}
+	catalog := MergeIndexes([]*RepoIndex{
+		{Repo: low, Mals: []*MalConfig{{Name: "demo", Version: "v3.0.0"}, {Name: "only-low"}}},
+		{Repo: first, Mals: []*MalConfig{{Name: "demo", Version: "v1.0.0"}}},
+		{Repo: second, Mals: []*MalConfig{{Name: "demo", Version: "v2.0.0"}, {Name: "shared"}}},
+		{Repo: broken, Mals: []*MalConfig{{Name: "shared"}}, Err: errors.New("401 for secret")},
+	})
+
+	for name, source := range map[string]string{
+		// priority 相同时先配置的仓库优先
+		"demo":     "first",
+		"only-low": "low",
+		// 获取失败的索引沿用的项仍然按 priority 生效
+		"shared": "broken",
+	} {
+		if mal := catalog.Get(name); mal == nil || mal.Source != source {
+			t.Fatalf("expected %s from %s, got %+v", name, source, mal)
+		}
+	}
+	if len(catalog.Mals) != 3 {
+		t.Fatalf("expected 3 mals, got %d", len(catalog.Mals))
+	}
+
+	shadowed := make(map[string]string)
+	for _, mal := range catalog.Shadowed {
+		shadowed[mal.Name+"@"+mal.Source] = mal.ShadowedBy
+	}
+	expected := map[string]string{"demo@second": "first", "demo@low": "first", "shared@second": "broken"}
+	if len(shadowed) != len(expected) {
+		t.Fatalf("expected shadowed %v, got %v", expected, shadowed)
+	}
+	for key, by := range expected {
+		if shadowed[key] != by {
+			t.Fatalf("expected %s to be shadowed by %s, got %q", key, by, shadowed[key])
+		}
+	}
+	collisions := catalog.Collisions()
+	if len(collisions) != 2 || collisions[0].Name != "demo" || len(collisions[0].Shadowed) != 2 {
+		t.Fatalf("unexpected collisions %v", collisions)
+	}
+
+	order := make([]string, len(catalog.Repos))
+	for i, repo := range catalog.Repos {
+		order[i] = repo.Name
+		if repo.Name == "broken" && (repo.Error == "" || strings.Contains(repo.Error, "secret")) {
+			t.Fatalf("expected redacted error for broken repo, got %q", repo.Error)
+		}
+	}
+	if strings.Join(order, ",") != "broken,first,second,low" {
+		t.Fatalf("repos not ordered by priority: %v", order)
+	}
+}
@@ -0,0 +1,624 @@
+package m
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ChecksumFileSuffix = ".sha256"
+	// MaxPackageSize 限制解压后的总大小
+	MaxPackageSize int64 = 256 << 20
+)
+
+// Installer 将 mal 安装到 Root/<name>/<version>, 并在 Root/mals.lock 中记录已安装的 mal
+type Installer struct {
+	Root   string
+	Mals   []*MalConfig
+	Config MalHTTPConfig
+	// AllowMissingChecksum 为 true 时, 仓库中没有 <pkg>.tar.gz.sha256 也会安装
+	AllowMissingChecksum bool
+
+	mu sync.Mutex
+	// pending 是 lockfile 写入成功后才删除的目录, 只在持有 mu 时使用
+	pending []string
+	// backups 是被原地替换的目录, lockfile 写入成功后删除, 失败时恢复, 只在持有 mu 时使用
+	backups []backupDir
+}
+
+// backupDir 记录被替换的 dir 移动到的位置
+type backupDir struct {
+	dir    string
+	backup string
+}
+
+func NewInstaller(root string, mals []*MalConfig, config MalHTTPConfig) *Installer {
+	return &Installer{Root: root, Mals: mals, Config: config}
+}
+
+func (ins *Installer) LockFilePath() string {
+	return filepath.Join(ins.Root, LockFileName)
+}
+
+// Candidates 返回所有仓库中 name 的可用版本: MalConfig.Versions 与 MalConfig.Version,
+// 都没有设置或为 "latest" 时使用 release 中最新的 tag
+func (ins *Installer) Candidates(name string) ([]*Candidate, error) {
+	if err := checkPathSegment("mal name", name); err != nil {
+		return nil, err
+	}
+	var cands []*Candidate
+	seen := make(map[string]bool)
+	add := func(cfg *MalConfig, version string) error {
+		if version == "" || version == "latest" || seen[version] {
+			return nil
+		}
+		if err := checkPathSegment("version of "+name, version); err != nil {
+			return err
+		}
+		seen[version] = true
+		cands = append(cands, &Candidate{Name: name, Version: version, Config: cfg})
+		return nil
+	}
+	found := false
+	for _, cfg := range ins.Mals {
+		if cfg.Name != name {
+			continue
+		}
+		found = true
+		n := len(cands)
+		for _, version := range append(append([]string{}, cfg.Versions...), cfg.Version) {
+			if err := add(cfg, version); err != nil {
+				return nil, err
+			}
+		}
+		if len(cands) == n {
+			repo, err := NewRepository(cfg, ins.Config)
+			if err != nil {
+				return nil, err
+			}
+			tag, err := repo.Latest(name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve latest version of %s: %v", name, err)
+			}
+			if err := add(cfg, tag); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("mal %s not found in index", name)
+	}
+	return cands, nil
+}
+
+// Install 安装 name 及其依赖, version 为版本约束, 为空时使用索引中的最高版本.
+// 已安装的 mal 会与 name 一起重新解析, 保证所有 mal 的依赖互相兼容
+func (ins *Installer) Install(name, version string) (*InstalledMal, error) {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	return ins.update(func(lock *LockFile) (*InstalledMal, error) {
+		roots := lock.Roots()
+		roots[name] = version
+		if err := ins.apply(lock, roots, nil); err != nil {
+			return nil, err
+		}
+		installed := lock.Get(name)
+		installed.Explicit = true
+		installed.Constraint = version
+		return installed, nil
+	})
+}
+
+// Upgrade 在约束范围内重新选择 name 的版本并安装, 版本与 checksum 都未变化时不做修改
+func (ins *Installer) Upgrade(name string) (*InstalledMal, error) {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	return ins.update(func(lock *LockFile) (*InstalledMal, error) {
+		if lock.Get(name) == nil {
+			return nil, fmt.Errorf("mal %s is not installed", name)
+		}
+		if err := ins.apply(lock, lock.Roots(), map[string]bool{name: true}); err != nil {
+			return nil, err
+		}
+		return lock.Get(name), nil
+	})
+}
+
+// Uninstall 删除 name 以及不再被依赖的 mal, name 仍被其他 mal 依赖时返回错误
+func (ins *Installer) Uninstall(name string) error {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	_, err := ins.update(func(lock *LockFile) (*InstalledMal, error) {
+		installed := lock.Get(name)
+		if installed == nil {
+			return nil, fmt.Errorf("mal %s is not installed", name)
+		}
+		if dependents := lock.Dependents(name); len(dependents) > 0 {
+			return nil, fmt.Errorf("mal %s is required by %s", name, strings.Join(dependents, ", "))
+		}
+		lock.Remove(name)
+		for _, orphan := range append(lock.Orphans(), installed) {
+			ins.pending = append(ins.pending, orphan.Name)
+			lock.Remove(orphan.Name)
+		}
+		return installed, nil
+	})
+	return err
+}
+
+// List 返回已安装的 mal
+func (ins *Installer) List() ([]*InstalledMal, error) {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	lock, err := ReadLockFile(ins.LockFilePath())
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(lock.Mals, func(i, j int) bool {
+		return lock.Mals[i].Name < lock.Mals[j].Name
+	})
+	return lock.Mals, nil
+}
+
+// update 读取 lockfile, 执行 fn 成功后写回.
+// fn 加入 pending 的目录在 lockfile 写入后才删除, 写入失败时 lockfile 中记录的目录仍然存在,
+// 被原地替换的目录也在失败时恢复
+func (ins *Installer) update(fn func(lock *LockFile) (*InstalledMal, error)) (mal *InstalledMal, err error) {
+	ins.pending, ins.backups = nil, nil
+	defer func() {
+		for i := len(ins.backups) - 1; i >= 0; i-- {
+			if err != nil {
+				os.RemoveAll(ins.backups[i].dir)
+				os.Rename(ins.backups[i].backup, ins.backups[i].dir)
+			} else {
+				os.RemoveAll(ins.backups[i].backup)
+			}
+		}
+		ins.pending, ins.backups = nil, nil
+	}()
+	if err := os.MkdirAll(ins.Root, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := ReadLockFile(ins.LockFilePath())
+	if err != nil {
+		return nil, err
+	}
+	mal, err = fn(lock)
+	if err != nil {
+		return nil, err
+	}
+	if err := lock.Write(ins.LockFilePath()); err != nil {
+		return nil, err
+	}
+	for _, rel := range ins.pending {
+		ins.removeAll(rel)
+	}
+	return mal, nil
+}
+
+type downloadedPackage struct {
+	data     []byte
+	checksum string
+}
+
+// installSource 在一次安装中为 Resolver 提供 manifest, 已安装的版本直接读取本地目录,
+// 其他版本下载后缓存, 安装时不再重复下载
+type installSource struct {
+	*Installer
+	lock      *LockFile
+	upgrade   map[string]bool
+	downloads map[string]*downloadedPackage
+}
+
+func (src *installSource) installed(c *Candidate) *InstalledMal {
+	if src.upgrade[c.Name] {
+		return nil
+	}
+	if existing := src.lock.Get(c.Name); existing != nil && existing.Version == c.Version && src.exists(existing) {
+		return existing
+	}
+	return nil
+}
+
+func (src *installSource) Manifest(c *Candidate) (*Manifest, error) {
+	if existing := src.installed(c); existing != nil {
+		return LoadManifest(filepath.Join(src.Root, existing.Path))
+	}
+	pkg, err := src.fetch(c)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ReadTarGzFile(pkg.data, ManifestFileName)
+	if err != nil {
+		return nil, err
+	}
+	return ParseManifest(data)
+}
+
+func (src *installSource) fetch(c *Candidate) (*downloadedPackage, error) {
+	if pkg, ok := src.downloads[c.String()]; ok {
+		return pkg, nil
+	}
+	data, checksum, err := src.download(c.Config, c.Version)
+	if err != nil {
+		return nil, err
+	}
+	pkg := &downloadedPackage{data: data, checksum: checksum}
+	src.downloads[c.String()] = pkg
+	return pkg, nil
+}
+
+// apply 解析 roots 并安装解析结果, 成功后更新 lock, 不再需要的目录加入 pending.
+// upgrade 中的 mal 不使用锁定的版本, 并重新下载比较 checksum
+func (ins *Installer) apply(lock *LockFile, roots map[string]string, upgrade map[string]bool) (err error) {
+	src := &installSource{Installer: ins, lock: lock, upgrade: upgrade, downloads: make(map[string]*downloadedPackage)}
+	locked := make(map[string]string)
+	for _, mal := range lock.Mals {
+		if !upgrade[mal.Name] {
+			locked[mal.Name] = mal.Version
+		}
+	}
+	resolver := &Resolver{Source: src, Locked: locked}
+	res, err := resolver.Resolve(roots)
+	if err != nil {
+		return err
+	}
+
+	// 任意一个 mal 安装失败时删除本次新解压的目录, 原地替换的目录由 update 恢复, lockfile 不会更新
+	var created []string
+	defer func() {
+		if err != nil {
+			for _, dir := range created {
+				os.RemoveAll(dir)
+			}
+		}
+	}()
+	var replaced []string
+	for _, mal := range res.Mals {
+		existing := lock.Get(mal.Name)
+		relPath, err := malPath(mal.Name, mal.Version)
+		if err != nil {
+			return err
+		}
+		checksum := ""
+		if existing != nil && src.installed(mal.Candidate) != nil {
+			checksum = existing.Checksum
+		} else {
+			pkg, err := src.fetch(mal.Candidate)
+			if err != nil {
+				return err
+			}
+			checksum = pkg.checksum
+			if existing == nil || existing.Path != relPath || existing.Checksum != checksum || !ins.exists(existing) {
+				dir := filepath.Join(ins.Root, relPath)
+				backup, err := installPackage(pkg.data, dir)
+				if err != nil {
+					return fmt.Errorf("failed to extract %s: %v", mal.Candidate, err)
+				}
+				if backup != "" {
+					ins.backups = append(ins.backups, backupDir{dir: dir, backup: backup})
+				} else {
+					created = append(created, dir)
+				}
+			}
+		}
+		if existing != nil && existing.Path != relPath {
+			replaced = append(replaced, existing.Path)
+		}
+		installed := &InstalledMal{
+			Name:         mal.Name,
+			Version:      mal.Version,
+			RepoURL:      mal.Config.RepoURL,
+			Checksum:     checksum,
+			Path:         relPath,
+			Dependencies: mal.Manifest.Dependencies,
+			InstalledAt:  time.Now(),
+		}
+		if existing != nil {
+			installed.Explicit = existing.Explicit
+			installed.Constraint = existing.Constraint
+			if existing.Version == mal.Version && existing.Checksum == checksum {
+				installed.InstalledAt = existing.InstalledAt
+			}
+		}
+		lock.Set(installed)
+	}
+
+	ins.pending = append(ins.pending, replaced...)
+	for _, installed := range append([]*InstalledMal{}, lock.Mals...) {
+		if res.Get(installed.Name) == nil {
+			ins.pending = append(ins.pending, installed.Name)
+			lock.Remove(installed.Name)
+		}
+	}
+	return nil
+}
+
+// malPath 返回 name@version 相对 Root 的安装目录
+func malPath(name, version string) (string, error) {
+	if err := checkPathSegment("mal name", name); err != nil {
+		return "", err
+	}
+	if err := checkPathSegment("version of "+name, version); err != nil {
+		return "", err
+	}
+	return filepath.Join(name, version), nil
+}
+
+// removeAll 删除 Root 下的 rel, rel 中的每一级都必须是合法的目录名, 避免 lockfile 中的路径逃出 Root
+func (ins *Installer) removeAll(rel string) error {
+	for _, segment := range strings.Split(filepath.ToSlash(rel), "/") {
+		if err := checkPathSegment("path", segment); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(filepath.Join(ins.Root, rel))
+}
+
+func (ins *Installer) exists(mal *InstalledMal) bool {
+	_, err := os.Stat(filepath.Join(ins.Root, mal.Path, ManifestFileName))
+	return err == nil
+}
+
+// download 下载 <name>.tar.gz 并与 <name>.tar.gz.sha256 及签名校验, 返回 "sha256:<hex>" 形式的 checksum
+func (ins *Installer) download(cfg *MalConfig, version string) ([]byte, string, error) {
+	repo, err := NewRepository(cfg, ins.Config)
+	if err != nil {
+		return nil, "", err
+	}
+	pkg := fmt.Sprintf("%s.tar.gz", cfg.Name)
+	data, err := repo.Asset(cfg.Name, version, pkg)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to download %s@%s: %v", cfg.Name, version, err)
+	}
+	sum := sha256.Sum256(data)
+	checksum := "sha256:" + hex.EncodeToString(sum[:])
+
+	// 索引中记录了该版本的 checksum 时不再下载校验文件
+	var expected string
+	if cfg.Checksum != "" && version == cfg.Version {
+		expected, err = ParseChecksum([]byte(cfg.Checksum))
+	} else {
+		expected, err = fetchChecksum(repo, cfg.Name, version, pkg+ChecksumFileSuffix)
+	}
+	if err != nil {
+		if errors.Is(err, ErrAssetNotFound) && ins.AllowMissingChecksum {
+			return data, checksum, nil
+		}
+		return nil, "", fmt.Errorf("failed to verify %s@%s: %v", cfg.Name, version, err)
+	}
+	if !strings.EqualFold(expected, hex.EncodeToString(sum[:])) {
+		return nil, "", fmt.Errorf("checksum mismatch for %s@%s: expected sha256:%s, got %s", cfg.Name, version, expected, checksum)
+	}
+	if err := ins.verify(repo, cfg, version, pkg, data); err != nil {
+		return nil, "", err
+	}
+	return data, checksum, nil
+}
+
+// verify 使用 <name>.tar.gz.minisig 校验包的签名. 公钥与 insecure 来自 cfg, 即 CatalogMal.Config 中所在索引仓库的配置或本地配置.
+// 默认仓库 mals.yaml 中的项没有这些配置, 此时使用 ins.Config.MalConfig, 没有设置时使用 DefaultMalConfig
+func (ins *Installer) verify(repo Repository, cfg *MalConfig, version, pkg string, data []byte) error {
+	trust := cfg
+	if !cfg.catalog && cfg.PublicKey == "" && !cfg.Insecure {
+		trust = ins.Config.MalConfig
+		if trust == nil {
+			trust = DefaultMalConfig
+		}
+	}
+	if trust.Insecure {
+		return nil
+	}
+	sig, err := repo.Asset(cfg.Name, version, pkg+SignatureFileSuffix)
+	if errors.Is(err, ErrAssetNotFound) {
+		sig = nil
+	} else if err != nil {
+		return fmt.Errorf("failed to download signature of %s@%s: %v", cfg.Name, version, err)
+	}
+	return trust.VerifySignature(fmt.Sprintf("%s@%s", cfg.Name, version), data, sig)
+}
+
+// fetchChecksum 读取 sha256sum 格式的校验文件, 返回第一个字段
+func fetchChecksum(repo Repository, name, version, asset string) (string, error) {
+	data, err := repo.Asset(name, version, asset)
+	if err != nil {
+		return "", err
+	}
+	return ParseChecksum(data)
+}
+
+// ParseChecksum 解析 "<hex>" 或 "<hex>  <filename>" 形式的 sha256 校验文件
+func ParseChecksum(data []byte) (string, error) {
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty checksum file")
+	}
+	sum := strings.TrimPrefix(strings.ToLower(fields[0]), "sha256:")
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid sha256 checksum %q", fields[0])
+	}
+	return sum, nil
+}
+
+// installPackage 解压到临时目录后替换 dir, 解压失败时不影响已安装的版本.
+// dir 已存在时返回原目录移动到的 backup
+func installPackage(data []byte, dir string) (backup string, err error) {
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), "."+filepath.Base(dir)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	if err := ExtractTarGz(data, tmp); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return "", os.Rename(tmp, dir)
+	}
+	// dir 已存在时移动到 backup, 由调用者在安装完成后删除或在失败时恢复
+	backup = tmp + ".old"
+	if err := os.Rename(dir, backup); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		os.Rename(backup, dir)
+		return "", err
+	}
+	return backup, nil
+}
+
+// ExtractTarGz 将 tar.gz 解压到 dest, 拒绝绝对路径, ".." 与链接等可能逃出 dest 的条目.
+// 根目录没有 mal.yaml 且所有文件都在同一个目录下时, 去掉这一层目录
+func ExtractTarGz(data []byte, dest string) error {
+	headers, err := readTarHeaders(data)
+	if err != nil {
+		return err
+	}
+	prefix := tarStripPrefix(headers)
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	var total int64
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(path.Clean(strings.ReplaceAll(header.Name, "\\", "/")), prefix)
+		if name == "" || name == "." || name == strings.TrimSuffix(prefix, "/") {
+			continue
+		}
+		if !isLocalPath(name) {
+			return fmt.Errorf("illegal path in archive: %s", header.Name)
+		}
+		target := filepath.Join(dest, filepath.FromSlash(name))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			total += header.Size
+			if total > MaxPackageSize {
+				return fmt.Errorf("package exceeds %d bytes", MaxPackageSize)
+			}
+			if err := writeTarFile(tr, target, header); err != nil {
+				return err
+			}
+		case tar.TypeSymlink, tar.TypeLink:
+			return fmt.Errorf("links are not allowed in archive: %s", header.Name)
+		default:
+			// pax 与 GNU 扩展头由 archive/tar 处理, 其他类型忽略
+		}
+	}
+}
+
+func readTarHeaders(data []byte) ([]*tar.Header, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	var headers []*tar.Header
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return headers, nil
+		} else if err != nil {
+			return nil, err
+		}
+		headers = append(headers, header)
+	}
+}
+
+// ReadTarGzFile 读取 tar.gz 中的单个文件, 与 ExtractTarGz 一样去掉唯一的顶层目录
+func ReadTarGzFile(data []byte, name string) ([]byte, error) {
+	headers, err := readTarHeaders(data)
+	if err != nil {
+		return nil, err
+	}
+	prefix := tarStripPrefix(headers)
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s not found in archive", name)
+		} else if err != nil {
+			return nil, err
+		}
+		if strings.TrimPrefix(path.Clean(strings.ReplaceAll(header.Name, "\\", "/")), prefix) != name {
+			continue
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			return nil, fmt.Errorf("%s in archive is not a regular file", name)
+		}
+		if header.Size > MaxPackageSize {
+			return nil, fmt.Errorf("%s exceeds %d bytes", name, MaxPackageSize)
+		}
+		return io.ReadAll(io.LimitReader(tr, header.Size))
+	}
+}
+
+func tarStripPrefix(headers []*tar.Header) string {
+	var top string
+	for _, header := range headers {
+		name := strings.TrimPrefix(path.Clean(strings.ReplaceAll(header.Name, "\\", "/")), "./")
+		if name == ManifestFileName {
+			return ""
+		}
+		first := strings.SplitN(name, "/", 2)[0]
+		if top == "" {
+			top = first
+		} else if first != top {
+			return ""
+		}
+		if header.Typeflag != tar.TypeDir && !strings.Contains(name, "/") {
+			return ""
+		}
+	}
+	if top == "" {
+		return ""
+	}
+	return top + "/"
+}
+
+func writeTarFile(r io.Reader, target string, header *tar.Header) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode)&0755|0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(f, r, header.Size)
+	return err
+}
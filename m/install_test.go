@@ -0,0 +1,259 @@
+package m
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	content  string
+	typeflag byte
+	linkname string
+}
+
+func buildTarGz(t *testing.T, entries ...tarEntry) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.content)), Typeflag: entry.typeflag, Linkname: entry.linkname}
+		if header.Typeflag == 0 {
+			header.Typeflag = tar.TypeReg
+		}
+		if header.Typeflag != tar.TypeReg {
+			header.Size = 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Size > 0 {
+			if _, err := tw.Write([]byte(entry.content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractTarGzRejectsEscapes(t *testing.T) {
+	for name, entry := range map[string]tarEntry{
+		"parent":   {name: "../evil.lua", content: "x"},
+		"nested":   {name: "lib/../../evil.lua", content: "x"},
+		"absolute": {name: "/evil.lua", content: "x"},
+		"symlink":  {name: "link", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"},
+		"hardlink": {name: "link", typeflag: tar.TypeLink, linkname: "../evil.lua"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			dest := filepath.Join(root, "dest")
+			data := buildTarGz(t, tarEntry{name: ManifestFileName, content: "name: demo\n"}, entry)
+			if err := ExtractTarGz(data, dest); err == nil {
+				t.Fatalf("expected %s to be rejected", entry.name)
+			}
+			if _, err := os.Stat(filepath.Join(root, "evil.lua")); !os.IsNotExist(err) {
+				t.Fatalf("file written outside of dest: %v", err)
+			}
+		})
+	}
+}
+
+func TestExtractTarGzStripsTopDirectory(t *testing.T) {
+	dest := t.TempDir()
+	data := buildTarGz(t,
+		tarEntry{name: "demo/", typeflag: tar.TypeDir},
+		tarEntry{name: "demo/" + ManifestFileName, content: "name: demo\n"},
+		tarEntry{name: "demo/main.lua", content: "return 1\n"},
+	)
+	if err := ExtractTarGz(data, dest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, ManifestFileName)); err != nil {
+		t.Fatalf("expected top directory to be stripped: %v", err)
+	}
+}
+
+// writeLocalMal 在本地仓库 dir 中写入 name@version 的包与校验文件
+func writeLocalMal(t *testing.T, dir, name, version string, data []byte) {
+	sum := sha256.Sum256(data)
+	writeStaticRepo(t, dir, map[string]string{
+		name + "/" + version + "/" + name + ".tar.gz":                      string(data),
+		name + "/" + version + "/" + name + ".tar.gz" + ChecksumFileSuffix: hex.EncodeToString(sum[:]),
+	})
+}
+
+func TestInstallerLocalRepository(t *testing.T) {
+	repoDir, root := t.TempDir(), t.TempDir()
+	writeLocalMal(t, repoDir, "demo", "v1.0.0", buildTarGz(t,
+		tarEntry{name: ManifestFileName, content: "name: demo\nversion: v1.0.0\n"},
+		tarEntry{name: "main.lua", content: "return 1\n"},
+	))
+	ins := NewInstaller(root, []*MalConfig{{Name: "demo", Version: "v1.0.0", RepoURL: repoDir, Insecure: true}}, MalHTTPConfig{})
+
+	installed, err := ins.Install("demo", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if installed.Version != "v1.0.0" || !installed.Explicit {
+		t.Fatalf("unexpected installed mal %+v", installed)
+	}
+	if _, err := os.Stat(filepath.Join(root, "demo", "v1.0.0", "main.lua")); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := ReadLockFile(ins.LockFilePath())
+	if err != nil || lock.Get("demo") == nil {
+		t.Fatalf("expected demo in lockfile: %v", err)
+	}
+
+	if err := ins.Uninstall("demo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "demo")); !os.IsNotExist(err) {
+		t.Fatalf("expected demo to be removed: %v", err)
+	}
+}
+
+func TestInstallerRejectsTraversal(t *testing.T) {
+	for name, cfg := range map[string]*MalConfig{
+		"version": {Name: "demo", Version: "../../outside"},
+		"name":    {Name: "../outside", Version: "v1.0.0"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			base := t.TempDir()
+			repoDir, root := filepath.Join(base, "repo"), filepath.Join(base, "root")
+			cfg.RepoURL, cfg.Insecure = repoDir, true
+			ins := NewInstaller(root, []*MalConfig{cfg}, MalHTTPConfig{})
+			if _, err := ins.Install(cfg.Name, ""); err == nil {
+				t.Fatal("expected install to fail")
+			}
+			if _, err := os.Stat(filepath.Join(base, "outside")); !os.IsNotExist(err) {
+				t.Fatalf("directory created outside of root: %v", err)
+			}
+		})
+	}
+}
+
+func TestInstallerPinnedTraversal(t *testing.T) {
+	base := t.TempDir()
+	repoDir, root := filepath.Join(base, "repo"), filepath.Join(base, "root")
+	// 依赖中指定的版本不在索引中时直接从仓库获取, 同样需要校验
+	writeLocalMal(t, repoDir, "app", "v1.0.0", buildTarGz(t,
+		tarEntry{name: ManifestFileName, content: "name: app\nversion: v1.0.0\ndependencies:\n  lib: ../../outside\n"},
+	))
+	ins := NewInstaller(root, []*MalConfig{
+		{Name: "app", Version: "v1.0.0", RepoURL: repoDir, Insecure: true},
+		{Name: "lib", Version: "v1.0.0", RepoURL: repoDir, Insecure: true},
+	}, MalHTTPConfig{})
+	if _, err := ins.Install("app", ""); err == nil {
+		t.Fatal("expected install to fail")
+	}
+	if _, err := os.Stat(filepath.Join(base, "outside")); !os.IsNotExist(err) {
+		t.Fatalf("directory created outside of root: %v", err)
+	}
+}
+
+func TestInstallerUpgradeRollback(t *testing.T) {
+	repoDir, root := t.TempDir(), t.TempDir()
+	writeLocalMal(t, repoDir, "a", "v1.0.0", buildTarGz(t,
+		tarEntry{name: ManifestFileName, content: "name: a\nversion: v1.0.0\n"},
+		tarEntry{name: "main.lua", content: "return 1\n"},
+	))
+	writeLocalMal(t, repoDir, "b", "v1.0.0", buildTarGz(t,
+		tarEntry{name: ManifestFileName, content: "name: b\nversion: v1.0.0\n"},
+	))
+	ins := NewInstaller(root, []*MalConfig{
+		{Name: "a", Version: "v1.0.0", RepoURL: repoDir, Insecure: true},
+		{Name: "b", Version: "v1.0.0", RepoURL: repoDir, Insecure: true},
+	}, MalHTTPConfig{})
+	for _, name := range []string{"a", "b"} {
+		if _, err := ins.Install(name, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a 重新发布后原地替换, b 需要重新安装但解压失败, a 应恢复为原来的内容
+	writeLocalMal(t, repoDir, "a", "v1.0.0", buildTarGz(t,
+		tarEntry{name: ManifestFileName, content: "name: a\nversion: v1.0.0\n"},
+		tarEntry{name: "main.lua", content: "return 2\n"},
+	))
+	writeLocalMal(t, repoDir, "b", "v1.0.0", buildTarGz(t,
+		tarEntry{name: ManifestFileName, content: "name: b\nversion: v1.0.0\n"},
+		tarEntry{name: "../evil.lua", content: "x"},
+	))
+	if err := os.RemoveAll(filepath.Join(root, "b")); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ReadLockFile(ins.LockFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ins.Upgrade("a"); err == nil {
+		t.Fatal("expected upgrade to fail")
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, "a", "v1.0.0", "main.lua"))
+	if err != nil || string(data) != "return 1\n" {
+		t.Fatalf("expected a to be restored, got %q: %v", data, err)
+	}
+	after, err := ReadLockFile(ins.LockFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Get("a").Checksum != before.Get("a").Checksum {
+		t.Fatal("lockfile updated after failed upgrade")
+	}
+	entries, err := os.ReadDir(filepath.Join(root, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only v1.0.0 under a, got %d entries", len(entries))
+	}
+}
+
+func TestInstallerVerifyTrust(t *testing.T) {
+	signed := &MalConfig{PublicKey: "RWQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"}
+	for name, tc := range map[string]struct {
+		index   *MalConfig
+		client  *MalConfig
+		success bool
+	}{
+		// 索引仓库的配置不会被客户端配置替换
+		"catalog insecure":  {index: &MalConfig{Insecure: true}, client: signed, success: true},
+		"catalog untrusted": {index: &MalConfig{}, client: &MalConfig{Insecure: true}},
+		// 默认仓库的项使用客户端配置
+		"default insecure": {client: &MalConfig{Insecure: true}, success: true},
+		"default signed":   {client: signed},
+	} {
+		t.Run(name, func(t *testing.T) {
+			repoDir, root := t.TempDir(), t.TempDir()
+			writeLocalMal(t, repoDir, "demo", "v1.0.0", buildTarGz(t,
+				tarEntry{name: ManifestFileName, content: "name: demo\nversion: v1.0.0\n"},
+			))
+			cfg := &MalConfig{Name: "demo", Version: "v1.0.0", RepoURL: repoDir}
+			if tc.index != nil {
+				tc.index.Name = "index"
+				cfg = MergeIndexes([]*RepoIndex{{Repo: tc.index, Mals: []*MalConfig{cfg}}}).Configs()[0]
+			}
+			ins := NewInstaller(root, []*MalConfig{cfg}, MalHTTPConfig{MalConfig: tc.client})
+			_, err := ins.Install("demo", "")
+			if tc.success && err != nil {
+				t.Fatal(err)
+			} else if !tc.success && err == nil {
+				t.Fatal("expected verification to fail")
+			}
+		})
+	}
+}
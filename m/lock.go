@@ -0,0 +1,142 @@
+package m
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var LockFileName = "mals.lock"
+
+// LockFile 记录已安装的 mal, 保存在安装目录下的 mals.lock
+type LockFile struct {
+	Mals []*InstalledMal `yaml:"mals"`
+}
+
+// InstalledMal 是 lockfile 中的一项
+type InstalledMal struct {
+	Name         string            `yaml:"name"`
+	Version      string            `yaml:"version"`
+	RepoURL      string            `yaml:"repo_url"`
+	Checksum     string            `yaml:"checksum"`
+	Path         string            `yaml:"path"`
+	Dependencies map[string]string `yaml:"dependencies,omitempty"`
+	// Explicit 为 false 表示作为依赖被安装
+	Explicit bool `yaml:"explicit"`
+	// Constraint 是显式安装时指定的版本约束, 重新解析依赖时使用
+	Constraint  string    `yaml:"constraint,omitempty"`
+	InstalledAt time.Time `yaml:"installed_at"`
+}
+
+func ReadLockFile(path string) (*LockFile, error) {
+	lock := &LockFile{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return lock, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, lock); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return lock, nil
+}
+
+// Write 按名称排序后写入 path, 先写临时文件再重命名, 避免中断时留下不完整的 lockfile
+func (lock *LockFile) Write(path string) error {
+	sort.Slice(lock.Mals, func(i, j int) bool {
+		return lock.Mals[i].Name < lock.Mals[j].Name
+	})
+	data, err := yaml.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Clean(path))
+}
+
+func (lock *LockFile) Get(name string) *InstalledMal {
+	for _, mal := range lock.Mals {
+		if mal.Name == name {
+			return mal
+		}
+	}
+	return nil
+}
+
+// Set 添加或替换同名的记录
+func (lock *LockFile) Set(mal *InstalledMal) {
+	for i, installed := range lock.Mals {
+		if installed.Name == mal.Name {
+			lock.Mals[i] = mal
+			return
+		}
+	}
+	lock.Mals = append(lock.Mals, mal)
+}
+
+func (lock *LockFile) Remove(name string) {
+	for i, mal := range lock.Mals {
+		if mal.Name == name {
+			lock.Mals = append(lock.Mals[:i], lock.Mals[i+1:]...)
+			return
+		}
+	}
+}
+
+// Dependents 返回依赖 name 的已安装 mal
+func (lock *LockFile) Dependents(name string) []string {
+	var dependents []string
+	for _, mal := range lock.Mals {
+		if _, ok := mal.Dependencies[name]; ok {
+			dependents = append(dependents, mal.Name)
+		}
+	}
+	sort.Strings(dependents)
+	return dependents
+}
+
+// Roots 返回显式安装的 mal 及其版本约束
+func (lock *LockFile) Roots() map[string]string {
+	roots := make(map[string]string)
+	for _, mal := range lock.Mals {
+		if mal.Explicit {
+			roots[mal.Name] = mal.Constraint
+		}
+	}
+	return roots
+}
+
+// Orphans 返回作为依赖安装, 但已经不被任何显式安装的 mal 依赖的 mal
+func (lock *LockFile) Orphans() []*InstalledMal {
+	reachable := make(map[string]bool)
+	var walk func(name string)
+	walk = func(name string) {
+		if reachable[name] {
+			return
+		}
+		reachable[name] = true
+		if mal := lock.Get(name); mal != nil {
+			for dep := range mal.Dependencies {
+				walk(dep)
+			}
+		}
+	}
+	for name := range lock.Roots() {
+		walk(name)
+	}
+	var orphans []*InstalledMal
+	for _, mal := range lock.Mals {
+		if !reachable[mal.Name] {
+			orphans = append(orphans, mal)
+		}
+	}
+	return orphans
+}
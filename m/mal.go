@@ -1,6 +1,7 @@
 package m
 
 import (
+	"fmt"
 	"net/url"
 	"time"
 )
@@ -11,14 +12,19 @@ var (
 	DefaultMalName    = "Default"
 	DefaultMalRepoURL = "https://api.github.com/repos/chainreactors/mals/releases"
 
+	// DefaultMalPublicKey 是官方仓库的 minisign 公钥. 官方仓库尚未发布签名, 公钥为空时默认配置不校验签名,
+	// 设置公钥后默认配置自动开启校验
+	DefaultMalPublicKey = ""
+
 	DefaultMalConfig = &MalConfig{
-		//PublicKey: DefaultArmoryPublicKey,
-		RepoURL: DefaultMalRepoURL,
-		Name:    DefaultMalName,
-		Enabled: true,
+		PublicKey: DefaultMalPublicKey,
+		Insecure:  DefaultMalPublicKey == "",
+		RepoURL:   DefaultMalRepoURL,
+		Name:      DefaultMalName,
+		Enabled:   true,
 	}
 
-	//malIndexSigFileName = "mal.minisig"
+	malIndexSigFileName = "mal.minisig"
 )
 
 type MalsYaml struct {
@@ -26,20 +32,79 @@ type MalsYaml struct {
 }
 
 type MalConfig struct {
-	RepoURL          string `yaml:"repo_url"`
-	Authorization    string `yaml:"authorization"`
+	// PublicKey 是 minisign 格式的公钥, 用于校验 mals.yaml 与包的签名
+	PublicKey string `yaml:"public_key"`
+	// Insecure 为 true 时跳过签名校验
+	Insecure bool   `yaml:"insecure"`
+	RepoURL  string `yaml:"repo_url"`
+	// Type 是仓库类型: github, gitlab, gitea, http 或 local, 为空时根据 RepoURL 判断
+	Type string `yaml:"type,omitempty"`
+	// Authorization 是访问仓库的凭据, 如 "Bearer <token>", "token <token>", "user:password"
+	Authorization string `yaml:"authorization"`
+	// AuthorizationCmd 的 stdout 作为凭据, 未设置 Authorization 时使用, 结果缓存 AuthorizationCacheTTL
 	AuthorizationCmd string `yaml:"authorization_cmd"`
 	Name             string `yaml:"name"`
 	Enabled          bool   `yaml:"enabled"`
-	Version          string `yaml:"version"`
-	Help             string `yaml:"help"`
+	// Priority 用于合并多个索引仓库, 同名的 mal 由 priority 高的仓库提供
+	Priority int `yaml:"priority,omitempty"`
+	// Version 对于索引仓库是选择 release 的 tag 或 semver 范围, 为空时使用最新的正式版本
+	Version string `yaml:"version"`
+	// Prerelease 为 true 时允许选择预发布版本
+	Prerelease bool `yaml:"prerelease,omitempty"`
+	// Versions 是仓库中可供依赖解析选择的其他版本
+	Versions []string `yaml:"versions,omitempty"`
+	Help     string   `yaml:"help"`
+
+	// 以下为索引中用于展示与搜索的信息
+	Description string   `yaml:"description,omitempty"`
+	Tags        []string `yaml:"tags,omitempty"`
+	Author      string   `yaml:"author,omitempty"`
+	License     string   `yaml:"license,omitempty"`
+	Homepage    string   `yaml:"homepage,omitempty"`
+	// OS 与 Arch 是支持的 implant 平台, 如 windows, linux 与 amd64, 386, 为空表示不限制
+	OS   []string `yaml:"os,omitempty"`
+	Arch []string `yaml:"arch,omitempty"`
+	// Checksum 与 Size 描述 Version 对应的 <name>.tar.gz, Checksum 形如 "sha256:<hex>"
+	Checksum string `yaml:"checksum,omitempty"`
+	Size     int64  `yaml:"size,omitempty"`
+	// MinHostVersion 是使用该 mal 需要的最低客户端版本
+	MinHostVersion string `yaml:"min_host_version,omitempty"`
+
+	// catalog 为 true 时配置来自 CatalogMal.Config, 公钥与 insecure 只使用所在索引仓库的配置
+	catalog bool
 }
 
 // MalHTTPConfig - Configuration for armory HTTP client
 type MalHTTPConfig struct {
-	MalConfig            *MalConfig
-	IgnoreCache          bool
+	MalConfig *MalConfig
+	// CacheDir 不为空时, 索引与包按 URL 缓存到该目录, 根据 ETag 与 Cache-Control 重新验证
+	CacheDir string
+	// IgnoreCache 为 true 时不使用已有的缓存, 但仍然写入新的响应
+	IgnoreCache bool
+	// Offline 为 true 时不访问网络, 只使用 CacheDir 中的缓存
+	Offline              bool
 	ProxyURL             *url.URL
 	Timeout              time.Duration
 	DisableTLSValidation bool
 }
+
+// VerifySignature 使用 PublicKey 校验 name 的签名, sig 为 nil 表示没有找到签名文件.
+// Insecure 时不做校验, 否则没有公钥或签名都视为校验失败
+func (cfg *MalConfig) VerifySignature(name string, data, sig []byte) error {
+	if cfg == nil {
+		return fmt.Errorf("failed to verify %s: %w", name, ErrNoPublicKey)
+	}
+	if cfg.Insecure {
+		return nil
+	}
+	if cfg.PublicKey == "" {
+		return fmt.Errorf("failed to verify %s from %s: %w, set public_key or insecure", name, cfg.RepoURL, ErrNoPublicKey)
+	}
+	if sig == nil {
+		return fmt.Errorf("failed to verify %s from %s: %w", name, cfg.RepoURL, ErrSignatureNotFound)
+	}
+	if err := VerifySignature(cfg.PublicKey, data, sig); err != nil {
+		return fmt.Errorf("failed to verify %s from %s: %w", name, cfg.RepoURL, err)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package m
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/chainreactors/mals"
+	lua "github.com/yuin/gopher-lua"
+	"gopkg.in/yaml.v3"
+)
+
+var DefaultEntrypoint = "main.lua"
+
+// Manifest 是 mal 包根目录下 mal.yaml 的内容
+type Manifest struct {
+	Name       string `yaml:"name"`
+	Version    string `yaml:"version"`
+	Entrypoint string `yaml:"entrypoint"`
+	// Dependencies 为依赖的 mal 及版本约束, 如 "community-lib: ^1.2"
+	Dependencies map[string]string `yaml:"dependencies,omitempty"`
+	Permissions  Permissions       `yaml:"permissions"`
+
+	// 以下信息在打包时写入 mals.yaml 的索引项
+	Help           string   `yaml:"help,omitempty"`
+	Description    string   `yaml:"description,omitempty"`
+	Tags           []string `yaml:"tags,omitempty"`
+	Author         string   `yaml:"author,omitempty"`
+	License        string   `yaml:"license,omitempty"`
+	Homepage       string   `yaml:"homepage,omitempty"`
+	OS             []string `yaml:"os,omitempty"`
+	Arch           []string `yaml:"arch,omitempty"`
+	MinHostVersion string   `yaml:"min_host_version,omitempty"`
+}
+
+// Permissions 声明 mal 需要的权限, 未声明的访问在运行时被拒绝
+type Permissions struct {
+	// Network 可以访问的主机, 如 "api.github.com", "*.example.com", "10.0.0.1:8080"
+	Network []string `yaml:"network,omitempty"`
+	// FS 可以读写的路径, 相对路径基于 mal 目录
+	FS FSPermissions `yaml:"fs,omitempty"`
+	// Exec 是否允许执行命令
+	Exec bool `yaml:"exec,omitempty"`
+	// DB 可以使用的数据库驱动, 如 "sqlite3"
+	DB []string `yaml:"db,omitempty"`
+	// OSInfo 是否允许读取环境变量, 主机名等信息
+	OSInfo bool `yaml:"os_info,omitempty"`
+	// ProtoRegistry 是否允许加载 protobuf descriptor, 加载的类型对所有 mal 可见
+	ProtoRegistry bool `yaml:"proto_registry,omitempty"`
+}
+
+type FSPermissions struct {
+	Read  []string `yaml:"read,omitempty"`
+	Write []string `yaml:"write,omitempty"`
+}
+
+// ParseManifest 解析并校验 mal.yaml, 未设置 entrypoint 时使用 DefaultEntrypoint
+func ParseManifest(data []byte) (*Manifest, error) {
+	manifest := &Manifest{}
+	if err := yaml.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", ManifestFileName, err)
+	}
+	if manifest.Entrypoint == "" {
+		manifest.Entrypoint = DefaultEntrypoint
+	}
+	if err := manifest.Validate(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// LoadManifest 读取 dir 下的 mal.yaml
+func LoadManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	return ParseManifest(data)
+}
+
+func (manifest *Manifest) Validate() error {
+	if manifest.Name == "" {
+		return fmt.Errorf("%s: name is required", ManifestFileName)
+	}
+	if !isLocalPath(manifest.Entrypoint) {
+		return fmt.Errorf("%s: entrypoint %s must be a relative path inside the mal", ManifestFileName, manifest.Entrypoint)
+	}
+	for dep, constraint := range manifest.Dependencies {
+		if dep == "" {
+			return fmt.Errorf("%s: empty dependency name", ManifestFileName)
+		}
+		if _, err := parseConstraint(constraint); err != nil {
+			return fmt.Errorf("%s: invalid version constraint %q for %s: %v", ManifestFileName, constraint, dep, err)
+		}
+	}
+	for _, host := range manifest.Permissions.Network {
+		if host == "" {
+			return fmt.Errorf("%s: empty network host", ManifestFileName)
+		}
+	}
+	for _, path := range append(append([]string{}, manifest.Permissions.FS.Read...), manifest.Permissions.FS.Write...) {
+		if path == "" {
+			return fmt.Errorf("%s: empty fs path", ManifestFileName)
+		}
+	}
+	return nil
+}
+
+// isLocalPath 报告 path 是否为不会逃出当前目录的相对路径
+func isLocalPath(path string) bool {
+	if path == "" || filepath.IsAbs(path) || strings.HasPrefix(path, "/") || strings.HasPrefix(path, "\\") {
+		return false
+	}
+	clean := filepath.Clean(filepath.FromSlash(path))
+	return clean != ".." && !strings.HasPrefix(clean, ".."+string(filepath.Separator))
+}
+
+// checkPathSegment 检查 segment 可以作为单独的一级目录名, 索引中的名称与版本会作为安装目录
+func checkPathSegment(kind, segment string) error {
+	if segment == "" || segment == "." || segment == ".." || strings.ContainsAny(segment, "/\\:\x00") {
+		return fmt.Errorf("invalid %s %q", kind, segment)
+	}
+	return nil
+}
+
+// Sandbox 将权限转换为 mals.Sandbox, dir 为 mal 的目录, 始终可读, 相对路径基于 dir
+func (perms *Permissions) Sandbox(dir string) *mals.Sandbox {
+	sb := &mals.Sandbox{
+		Capabilities: mals.CapFSRead,
+		ReadPaths:    []string{dir},
+		Hosts:        perms.Network,
+		DBDrivers:    perms.DB,
+	}
+	for _, path := range perms.FS.Read {
+		sb.ReadPaths = append(sb.ReadPaths, resolvePath(dir, path))
+	}
+	for _, path := range perms.FS.Write {
+		sb.WritePaths = append(sb.WritePaths, resolvePath(dir, path))
+	}
+	if len(sb.WritePaths) > 0 {
+		sb.Capabilities |= mals.CapFSWrite
+	}
+	if len(perms.Network) > 0 {
+		sb.Capabilities |= mals.CapNetwork
+	}
+	if len(perms.DB) > 0 {
+		sb.Capabilities |= mals.CapDB
+	}
+	if perms.Exec {
+		sb.Capabilities |= mals.CapExec
+	}
+	if perms.OSInfo {
+		sb.Capabilities |= mals.CapOSInfo
+	}
+	if perms.ProtoRegistry {
+		sb.Capabilities |= mals.CapProtoRegistry
+	}
+	return sb
+}
+
+func resolvePath(dir, path string) string {
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[2:])
+		}
+	}
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(dir, path)
+}
+
+// Describe 返回便于审查的权限列表, 未声明任何权限时返回空
+func (perms *Permissions) Describe() []string {
+	var lines []string
+	for _, host := range perms.Network {
+		lines = append(lines, "network: "+host)
+	}
+	for _, path := range perms.FS.Read {
+		lines = append(lines, "fs read: "+path)
+	}
+	for _, path := range perms.FS.Write {
+		lines = append(lines, "fs write: "+path)
+	}
+	for _, driver := range perms.DB {
+		lines = append(lines, "db: "+driver)
+	}
+	if perms.Exec {
+		lines = append(lines, "exec")
+	}
+	if perms.OSInfo {
+		lines = append(lines, "os info")
+	}
+	if perms.ProtoRegistry {
+		lines = append(lines, "proto registry")
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// Mal 是按照 manifest 权限加载的 mal
+type Mal struct {
+	Dir      string
+	Manifest *Manifest
+	VM       *lua.LState
+}
+
+// LoadMal 读取 dir 下的 mal.yaml, 创建只拥有声明权限的 VM 并执行 entrypoint.
+// opts 会在沙箱之前传给 mals.NewLuaVM, 可以通过 mals.WithLimits 限制 entrypoint 的执行
+func LoadMal(dir string, opts ...mals.VMOption) (*Mal, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := LoadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	vm := mals.NewLuaVM(append(opts, mals.WithSandbox(manifest.Permissions.Sandbox(dir)))...)
+	// mal 内的模块可以直接 require
+	vm.SetField(vm.GetGlobal("package"), "path", lua.LString(filepath.Join(dir, "?.lua")+";"+filepath.Join(dir, "?", "init.lua")))
+	if err := mals.RunFile(vm, filepath.Join(dir, filepath.FromSlash(manifest.Entrypoint))); err != nil {
+		vm.Close()
+		return nil, fmt.Errorf("failed to load mal %s: %w", manifest.Name, err)
+	}
+	return &Mal{Dir: dir, Manifest: manifest, VM: vm}, nil
+}
+
+func (mal *Mal) Close() {
+	mal.VM.Close()
+}
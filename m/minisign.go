@@ -0,0 +1,153 @@
+package m
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+var SignatureFileSuffix = ".minisig"
+
+var (
+	ErrNoPublicKey        = errors.New("no public key configured")
+	ErrSignatureNotFound  = errors.New("signature not found")
+	ErrSignatureMismatch  = errors.New("signature mismatch")
+	ErrUntrustedSignature = errors.New("signed by untrusted key")
+)
+
+const (
+	untrustedCommentPrefix = "untrusted comment: "
+	trustedCommentPrefix   = "trusted comment: "
+)
+
+// minisign 的签名算法, "ED" 表示先对内容做 blake2b-512 再签名
+var (
+	algoEd        = [2]byte{'E', 'd'}
+	algoPrehashed = [2]byte{'E', 'D'}
+)
+
+// PublicKey 是 minisign 格式的 ed25519 公钥
+type PublicKey struct {
+	KeyID [8]byte
+	Key   ed25519.PublicKey
+}
+
+// ParsePublicKey 解析 minisign 公钥, 可以是 base64 的一行, 也可以是包含 untrusted comment 的 .pub 文件内容
+func ParsePublicKey(s string) (*PublicKey, error) {
+	var encoded string
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, untrustedCommentPrefix) {
+			continue
+		}
+		encoded = line
+		break
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	if len(raw) != 2+8+ed25519.PublicKeySize || !bytes.Equal(raw[:2], algoEd[:]) {
+		return nil, fmt.Errorf("invalid public key: not a minisign ed25519 key")
+	}
+	pk := &PublicKey{Key: ed25519.PublicKey(raw[10:])}
+	copy(pk.KeyID[:], raw[2:10])
+	return pk, nil
+}
+
+func (pk *PublicKey) String() string {
+	return keyIDString(pk.KeyID)
+}
+
+// Signature 是 .minisig 文件的内容
+type Signature struct {
+	Algorithm       [2]byte
+	KeyID           [8]byte
+	Signature       [ed25519.SignatureSize]byte
+	TrustedComment  string
+	GlobalSignature [ed25519.SignatureSize]byte
+}
+
+// ParseSignature 解析 minisign 的签名文件:
+// untrusted comment, 签名, trusted comment, 对签名与 trusted comment 的全局签名
+func ParseSignature(data []byte) (*Signature, error) {
+	lines := strings.Split(strings.ReplaceAll(strings.TrimSpace(string(data)), "\r\n", "\n"), "\n")
+	if len(lines) < 4 {
+		return nil, fmt.Errorf("invalid signature: expected 4 lines, got %d", len(lines))
+	}
+	if !strings.HasPrefix(lines[0], untrustedCommentPrefix) {
+		return nil, fmt.Errorf("invalid signature: missing untrusted comment")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %v", err)
+	}
+	if len(raw) != 2+8+ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid signature: unexpected length %d", len(raw))
+	}
+	sig := &Signature{}
+	copy(sig.Algorithm[:], raw[:2])
+	if sig.Algorithm != algoEd && sig.Algorithm != algoPrehashed {
+		return nil, fmt.Errorf("invalid signature: unsupported algorithm %q", raw[:2])
+	}
+	copy(sig.KeyID[:], raw[2:10])
+	copy(sig.Signature[:], raw[10:])
+
+	if !strings.HasPrefix(lines[2], trustedCommentPrefix) {
+		return nil, fmt.Errorf("invalid signature: missing trusted comment")
+	}
+	sig.TrustedComment = strings.TrimPrefix(lines[2], trustedCommentPrefix)
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %v", err)
+	}
+	if len(global) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid signature: unexpected global signature length %d", len(global))
+	}
+	copy(sig.GlobalSignature[:], global)
+	return sig, nil
+}
+
+// Verify 校验 data 与 trusted comment 的签名, 签名的 key id 必须与公钥一致
+func (pk *PublicKey) Verify(data []byte, sig *Signature) error {
+	if sig.KeyID != pk.KeyID {
+		return fmt.Errorf("%w: key %s, trusted key %s", ErrUntrustedSignature, keyIDString(sig.KeyID), pk)
+	}
+	message := data
+	if sig.Algorithm == algoPrehashed {
+		sum := blake2b.Sum512(data)
+		message = sum[:]
+	}
+	if !ed25519.Verify(pk.Key, message, sig.Signature[:]) {
+		return ErrSignatureMismatch
+	}
+	global := append(sig.Signature[:], []byte(sig.TrustedComment)...)
+	if !ed25519.Verify(pk.Key, global, sig.GlobalSignature[:]) {
+		return fmt.Errorf("%w: trusted comment has been tampered with", ErrSignatureMismatch)
+	}
+	return nil
+}
+
+// VerifySignature 使用 minisign 格式的公钥校验 data 与签名文件
+func VerifySignature(publicKey string, data, sig []byte) error {
+	pk, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	signature, err := ParseSignature(sig)
+	if err != nil {
+		return err
+	}
+	return pk.Verify(data, signature)
+}
+
+// keyIDString 与 minisign 一致, 按小端序显示 key id
+func keyIDString(id [8]byte) string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(id[:]))
+}
@@ -0,0 +1,103 @@
+package m
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+var testKeyID = [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+func newTestKey(t *testing.T) (string, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(bytes.NewReader(bytes.Repeat([]byte{7}, ed25519.SeedSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := append(append(append([]byte{}, algoEd[:]...), testKeyID[:]...), pub...)
+	return "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(raw) + "\n", priv
+}
+
+// signMinisign 按 minisign 的格式生成签名文件
+func signMinisign(priv ed25519.PrivateKey, algo [2]byte, keyID [8]byte, data []byte, comment string) []byte {
+	message := data
+	if algo == algoPrehashed {
+		sum := blake2b.Sum512(data)
+		message = sum[:]
+	}
+	sig := ed25519.Sign(priv, message)
+	global := ed25519.Sign(priv, append(append([]byte{}, sig...), comment...))
+	raw := append(append(append([]byte{}, algo[:]...), keyID[:]...), sig...)
+	return []byte(strings.Join([]string{
+		"untrusted comment: signature",
+		base64.StdEncoding.EncodeToString(raw),
+		trustedCommentPrefix + comment,
+		base64.StdEncoding.EncodeToString(global),
+	}, "\n") + "\n")
+}
+
+func TestVerifySignature(t *testing.T) {
+	publicKey, priv := newTestKey(t)
+	data := []byte("mals: []\n")
+	for name, tc := range map[string]struct {
+		sig      []byte
+		data     []byte
+		expected error
+	}{
+		"ed":        {sig: signMinisign(priv, algoEd, testKeyID, data, "timestamp:1")},
+		"prehashed": {sig: signMinisign(priv, algoPrehashed, testKeyID, data, "timestamp:1")},
+		"wrong key id": {
+			sig:      signMinisign(priv, algoEd, [8]byte{8, 7, 6, 5, 4, 3, 2, 1}, data, "timestamp:1"),
+			expected: ErrUntrustedSignature,
+		},
+		"tampered data": {
+			sig:      signMinisign(priv, algoPrehashed, testKeyID, data, "timestamp:1"),
+			data:     []byte("mals: [evil]\n"),
+			expected: ErrSignatureMismatch,
+		},
+		"tampered trusted comment": {
+			sig:      bytes.Replace(signMinisign(priv, algoEd, testKeyID, data, "timestamp:1"), []byte("timestamp:1"), []byte("timestamp:2"), 1),
+			expected: ErrSignatureMismatch,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			signed := data
+			if tc.data != nil {
+				signed = tc.data
+			}
+			err := VerifySignature(publicKey, signed, tc.sig)
+			if tc.expected == nil && err != nil {
+				t.Fatal(err)
+			} else if tc.expected != nil && !errors.Is(err, tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestParsePublicKeyMalformed(t *testing.T) {
+	publicKey, _ := newTestKey(t)
+	raw, err := base64.StdEncoding.DecodeString(strings.Split(publicKey, "\n")[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, key := range map[string]string{
+		"empty":      "",
+		"not base64": "RW!!!",
+		"truncated":  base64.StdEncoding.EncodeToString(raw[:len(raw)-1]),
+		"algorithm":  base64.StdEncoding.EncodeToString(append([]byte("ED"), raw[2:]...)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParsePublicKey(key); err == nil {
+				t.Fatal("expected malformed key to be rejected")
+			}
+		})
+	}
+	if _, err := ParsePublicKey(publicKey); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,19 +1,18 @@
 package m
 
 import (
+	"context"
 	"crypto/tls"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -33,6 +32,7 @@ type GithubRelease struct {
 	HTMLURL     string        `json:"html_url"`
 	TagName     string        `json:"tag_name"`
 	Body        string        `json:"body"`
+	Draft       bool          `json:"draft"`
 	Prerelease  bool          `json:"prerelease"`
 	TarballURL  string        `json:"tarball_url"`
 	ZipballURL  string        `json:"zipball_url"`
@@ -41,24 +41,76 @@ type GithubRelease struct {
 	Assets      []GithubAsset `json:"assets"`
 }
 
-func httpClient(config MalHTTPConfig) *http.Client {
-	return &http.Client{
+type transportKey struct {
+	proxy    string
+	timeout  time.Duration
+	insecure bool
+	offline  bool
+}
+
+// transports 按配置复用 http.Transport, 保持与仓库之间的连接
+var transports sync.Map
+
+func httpTransport(config MalHTTPConfig) *http.Transport {
+	key := transportKey{timeout: config.Timeout, insecure: config.DisableTLSValidation, offline: config.Offline}
+	if config.ProxyURL != nil {
+		key.proxy = config.ProxyURL.String()
+	}
+	if transport, ok := transports.Load(key); ok {
+		return transport.(*http.Transport)
+	}
+	dialer := &net.Dialer{
 		Timeout: config.Timeout,
-		Transport: &http.Transport{
-			Dial: (&net.Dialer{
-				Timeout: config.Timeout,
-			}).Dial,
-			IdleConnTimeout:     time.Millisecond,
-			Proxy:               http.ProxyURL(config.ProxyURL),
-			TLSHandshakeTimeout: config.Timeout,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: config.DisableTLSValidation,
-			},
+	}
+	dial := dialer.DialContext
+	if config.Offline {
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, fmt.Errorf("%w: dial %s", ErrNotCached, addr)
+		}
+	}
+	transport, _ := transports.LoadOrStore(key, &http.Transport{
+		DialContext:         dial,
+		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConnsPerHost: 4,
+		Proxy:               http.ProxyURL(config.ProxyURL),
+		TLSHandshakeTimeout: config.Timeout,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: config.DisableTLSValidation,
 		},
+	})
+	return transport.(*http.Transport)
+}
+
+func httpClient(config MalHTTPConfig) *http.Client {
+	return &http.Client{
+		Timeout:   config.Timeout,
+		Transport: httpTransport(config),
 	}
 }
 
+// httpRequest 发送 GET 请求, 设置了 CacheDir 时使用本地缓存
 func httpRequest(clientConfig MalHTTPConfig, reqURL string, extraHeaders http.Header) (*http.Response, []byte, error) {
+	if clientConfig.CacheDir != "" {
+		return cachedRequest(clientConfig, reqURL, extraHeaders)
+	}
+	if clientConfig.Offline {
+		return nil, nil, fmt.Errorf("%w: %s", ErrNotCached, reqURL)
+	}
+	return authorizedRequest(clientConfig, reqURL, extraHeaders)
+}
+
+// authorizedRequest 发送请求, 发往 clientConfig.MalConfig 仓库的请求会带上认证信息.
+// AuthorizationCmd 得到的 token 被拒绝时, 清除缓存重新获取一次
+func authorizedRequest(clientConfig MalHTTPConfig, reqURL string, extraHeaders http.Header) (*http.Response, []byte, error) {
+	cfg := clientConfig.MalConfig
+	resp, body, err := doHTTPRequest(clientConfig, reqURL, extraHeaders)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && invalidateAuthorization(cfg) {
+		resp, body, err = doHTTPRequest(clientConfig, reqURL, extraHeaders)
+	}
+	return resp, body, cfg.redactError(err)
+}
+
+func doHTTPRequest(clientConfig MalHTTPConfig, reqURL string, extraHeaders http.Header) (*http.Response, []byte, error) {
 	client := httpClient(clientConfig)
 	req, err := http.NewRequest(http.MethodGet, reqURL, http.NoBody)
 	if err != nil {
@@ -70,6 +122,9 @@ func httpRequest(clientConfig MalHTTPConfig, reqURL string, extraHeaders http.He
 			req.Header.Add(key, strings.Join(extraHeaders[key], ","))
 		}
 	}
+	if err := setAuthorization(req, clientConfig.MalConfig); err != nil {
+		return nil, nil, err
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, nil, err
@@ -88,6 +143,12 @@ func downloadRequest(clientConfig MalHTTPConfig, reqURL string) ([]byte, error)
 	if resp == nil {
 		return nil, err
 	}
+	if err := rateLimitError(resp); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &AssetNotFoundError{Asset: path.Base(resp.Request.URL.Path)}
+	}
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusFound {
 		return nil, fmt.Errorf("Error downloading asset: http %d", resp.StatusCode)
 	}
@@ -95,102 +156,67 @@ func downloadRequest(clientConfig MalHTTPConfig, reqURL string) ([]byte, error)
 	return body, err
 }
 
-// Intercepts 302 redirect to determine the latest version tag
-func githubTagParser(repoUrl string, version string, clientConfig MalHTTPConfig) (string, error) {
-	client := httpClient(clientConfig)
-	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-		return http.ErrUseLastResponse
-	}
-	latestURL, err := url.Parse(repoUrl)
+// ParserMalYaml 从 url 对应的仓库下载 mals.yaml, 校验签名后保存到 path
+func ParserMalYaml(url, path string, clientConfig MalHTTPConfig) (MalsYaml, error) {
+	malData, err := fetchMalYaml(url, clientConfig)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse mal pkg url '%s': %s", repoUrl, err)
+		return malData, err
 	}
-	latestURL.Path = path.Join(latestURL.Path, "releases", version)
-	latestRedirect, err := client.Get(latestURL.String())
+
+	fileData, err := yaml.Marshal(&malData)
 	if err != nil {
-		return "", fmt.Errorf("http get failed mal pkg url '%s': %s", repoUrl, err)
-	}
-	defer latestRedirect.Body.Close()
-	if latestRedirect.StatusCode != http.StatusFound && latestRedirect.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("unexpected response status (wanted 302) '%s': %s", repoUrl, latestRedirect.Status)
-	}
-	if latestRedirect.Header.Get("Location") == "" {
-		return "", fmt.Errorf("no location header in response '%s'", repoUrl)
+		return malData, fmt.Errorf("failed to marshal malData to YAML: %v", err)
 	}
-	latestLocationURL, err := url.Parse(latestRedirect.Header.Get("Location"))
+
+	filePath := filepath.Join(path, MalIndexFileName)
+	err = os.WriteFile(filePath, fileData, 0644)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse location header '%s'->'%s': %s",
-			repoUrl, latestRedirect.Header.Get("Location"), err)
-	}
-	pathSegments := strings.Split(latestLocationURL.Path, "/")
-	for index, segment := range pathSegments {
-		if segment == "tag" && index+1 < len(pathSegments) {
-			return pathSegments[index+1], nil
-		}
+		return malData, fmt.Errorf("failed to write YAML data to file: %v", err)
 	}
-	return "", errors.New("tag not found in location header")
+
+	return malData, nil
+
 }
 
-func ParserMalYaml(url, path string, clientConfig MalHTTPConfig) (MalsYaml, error) {
+// fetchMalYaml 下载并校验 url 对应仓库的 mals.yaml, 没有配置 clientConfig.MalConfig 时使用 DefaultMalConfig.
+// 索引项中的 public_key, insecure 与认证会被清除, 签名校验与认证只使用本地的仓库配置
+func fetchMalYaml(url string, clientConfig MalHTTPConfig) (MalsYaml, error) {
 	var malData MalsYaml
-	resp, body, err := httpRequest(clientConfig, url, http.Header{})
+	if clientConfig.MalConfig == nil {
+		clientConfig.MalConfig = DefaultMalConfig
+	}
+	repo, err := repositoryFromURL(url, clientConfig)
 	if err != nil {
 		return malData, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		if resp.StatusCode == http.StatusForbidden {
-			return malData, errors.New("GitHub API rate limit reached (60 req/hr), try again later")
-		}
-		return malData, errors.New(fmt.Sprintf("API returned non-200 status code: %d", resp.StatusCode))
-	}
-
-	releases := []GithubRelease{}
-	err = json.Unmarshal(body, &releases)
+	malsYaml, malsSig, err := repo.Index()
 	if err != nil {
 		return malData, err
 	}
-	release := releases[0]
-
-	var malsYaml []byte
-	for _, asset := range release.Assets {
-		if asset.Name == MalIndexFileName {
-			malsYaml, err = downloadRequest(clientConfig, asset.URL)
-			if err != nil {
-				break
-			}
-		}
+	if err := clientConfig.MalConfig.VerifySignature(MalIndexFileName, malsYaml, malsSig); err != nil {
+		return malData, err
 	}
 
 	err = yaml.Unmarshal(malsYaml, &malData)
 	if err != nil {
 		return malData, err
 	}
-
-	fileData, err := yaml.Marshal(&malData)
-	if err != nil {
-		return malData, fmt.Errorf("failed to marshal malData to YAML: %v", err)
-	}
-
-	filePath := filepath.Join(path, MalIndexFileName)
-	err = os.WriteFile(filePath, fileData, 0644)
-	if err != nil {
-		return malData, fmt.Errorf("failed to write YAML data to file: %v", err)
+	for _, mal := range malData.Mals {
+		mal.PublicKey = ""
+		mal.Insecure = false
+		mal.Authorization = ""
+		mal.AuthorizationCmd = ""
 	}
-
 	return malData, nil
-
 }
 
-// GithubMalPackageParser - Uses github.com instead of api.github.com to download packages
+// GithubMalPackageParser - Downloads <pkgName>.tar.gz of version from the repository of repoURL
 func GithubMalPackageParser(repoURL string, pkgName string, version string, downloadPath string, clientConfig MalHTTPConfig) error {
-	var tarGz []byte
-
-	tarGzURL, err := url.Parse(repoURL)
+	repo, err := repositoryFromURL(repoURL, clientConfig)
 	if err != nil {
-		return fmt.Errorf("failed to parse mal pkg url '%s': %s", repoURL, err)
+		return err
 	}
-	tarGzURL.Path = path.Join(tarGzURL.Path, "releases", "download", version, fmt.Sprintf("%s.tar.gz", pkgName))
-	tarGz, err = downloadRequest(clientConfig, tarGzURL.String())
+	tarGz, err := repo.Asset(pkgName, version, fmt.Sprintf("%s.tar.gz", pkgName))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,291 @@
+package m
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// MaxReleasePages 限制 release API 翻页的次数
+var MaxReleasePages = 10
+
+var (
+	ErrAssetNotFound   = errors.New("asset not found")
+	ErrReleaseNotFound = errors.New("release not found")
+	ErrNoReleases      = errors.New("no releases found")
+)
+
+// AssetNotFoundError 表示 release 或仓库中没有对应的文件, 可以用 errors.Is(err, ErrAssetNotFound) 判断
+type AssetNotFoundError struct {
+	Asset   string
+	Release string
+}
+
+func (e *AssetNotFoundError) Error() string {
+	if e.Release == "" {
+		return fmt.Sprintf("%s: %s", ErrAssetNotFound, e.Asset)
+	}
+	return fmt.Sprintf("%s: %s in release %s", ErrAssetNotFound, e.Asset, e.Release)
+}
+
+func (e *AssetNotFoundError) Is(target error) bool {
+	return target == ErrAssetNotFound
+}
+
+// RateLimitError 表示 API 的请求次数已用完, Reset 为零值时表示未知
+type RateLimitError struct {
+	URL   string
+	Limit int
+	Reset time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	msg := "API rate limit reached"
+	if e.Limit > 0 {
+		msg += fmt.Sprintf(" (%d req/hr)", e.Limit)
+	}
+	if !e.Reset.IsZero() {
+		msg += ", resets at " + e.Reset.Format(time.RFC3339)
+	}
+	return msg + ", configure authorization or try again later"
+}
+
+// Release 是 release API 中的一个版本
+type Release struct {
+	Tag        string
+	Prerelease bool
+	// Assets 为文件名到下载地址的映射
+	Assets map[string]string
+}
+
+// releaseLister 是通过 release API 获取版本的仓库
+type releaseLister interface {
+	// Releases 返回所有已发布的版本, 按发布时间倒序
+	Releases() ([]*Release, error)
+	Release(tag string) (*Release, error)
+}
+
+// selectRelease 按 selector 从 repo 中选择 release:
+// 空字符串或 "latest" 为最新的正式版本, semver 范围 (如 "^1.2") 为满足范围的最高版本, 其他作为 tag.
+// prerelease 为 false 时不选择预发布版本, 除非 selector 直接指定了 tag
+func selectRelease(repo releaseLister, selector string, prerelease bool) (*Release, error) {
+	if selector != "" && selector != "latest" {
+		constraint, err := parseConstraint(selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid release selector %q: %v", selector, err)
+		}
+		if constraint == nil || pinnedVersion([]Requirement{{Constraint: selector}}) == selector {
+			release, err := repo.Release(selector)
+			// "1.2.0" 与 "v1.2.0" 视为同一个版本
+			if errors.Is(err, ErrReleaseNotFound) && constraint != nil {
+				if alt, altErr := repo.Release(toggleVersionPrefix(selector)); altErr == nil {
+					return alt, nil
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+			return release, nil
+		}
+	}
+
+	releases, err := repo.Releases()
+	if err != nil {
+		return nil, err
+	}
+	if len(releases) == 0 {
+		return nil, ErrNoReleases
+	}
+	var selected *Release
+	for _, release := range releases {
+		if release.Prerelease && !prerelease {
+			continue
+		}
+		if selector == "" || selector == "latest" {
+			return release, nil
+		}
+		if !satisfiesRelease(release.Tag, selector, prerelease) {
+			continue
+		}
+		if selected == nil || compareVersions(release.Tag, selected.Tag) > 0 {
+			selected = release
+		}
+	}
+	if selected == nil {
+		if selector == "" || selector == "latest" {
+			return nil, fmt.Errorf("%w: all %d releases are prereleases", ErrNoReleases, len(releases))
+		}
+		return nil, fmt.Errorf("%w: no release matches %q", ErrReleaseNotFound, selector)
+	}
+	return selected, nil
+}
+
+func toggleVersionPrefix(version string) string {
+	if strings.HasPrefix(version, "v") {
+		return strings.TrimPrefix(version, "v")
+	}
+	return "v" + version
+}
+
+// satisfiesRelease 与 satisfies 相同, prerelease 为 true 时约束也匹配预发布版本
+func satisfiesRelease(tag, selector string, prerelease bool) bool {
+	if satisfies(tag, selector) {
+		return true
+	}
+	if !prerelease {
+		return false
+	}
+	v, err := semver.NewVersion(tag)
+	if err != nil || v.Prerelease() == "" {
+		return false
+	}
+	release, _ := v.SetPrerelease("")
+	return satisfies(release.Original(), selector) || satisfies(release.String(), selector)
+}
+
+// releaseSelector 返回 MalConfig 中用于选择索引 release 的版本与是否允许预发布版本
+func releaseSelector(cfg *MalConfig) (string, bool) {
+	if cfg == nil {
+		return "", false
+	}
+	return cfg.Version, cfg.Prerelease
+}
+
+// releaseIndex 从选中的 release 中下载 mals.yaml 与 mal.minisig
+func releaseIndex(repo releaseLister, clientConfig MalHTTPConfig) ([]byte, []byte, error) {
+	selector, prerelease := releaseSelector(clientConfig.MalConfig)
+	release, err := selectRelease(repo, selector, prerelease)
+	if err != nil {
+		return nil, nil, err
+	}
+	indexURL, ok := release.Assets[MalIndexFileName]
+	if !ok {
+		return nil, nil, &AssetNotFoundError{Asset: MalIndexFileName, Release: release.Tag}
+	}
+	index, err := downloadRequest(clientConfig, indexURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to download %s: %w", MalIndexFileName, err)
+	}
+	var sig []byte
+	if sigURL, ok := release.Assets[malIndexSigFileName]; ok {
+		sig, err = downloadRequest(clientConfig, sigURL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to download %s: %w", malIndexSigFileName, err)
+		}
+	}
+	return index, sig, nil
+}
+
+func releaseLatest(repo releaseLister) (string, error) {
+	release, err := selectRelease(repo, "latest", false)
+	if err != nil {
+		return "", err
+	}
+	return release.Tag, nil
+}
+
+func releaseAsset(repo releaseLister, clientConfig MalHTTPConfig, version, asset string) ([]byte, error) {
+	release, err := repo.Release(version)
+	if err != nil {
+		return nil, err
+	}
+	assetURL, ok := release.Assets[asset]
+	if !ok {
+		return nil, &AssetNotFoundError{Asset: asset, Release: version}
+	}
+	return downloadRequest(clientConfig, assetURL)
+}
+
+// listReleases 按 Link 头翻页读取 release 列表, convert 返回 nil 的 release 被忽略.
+// 超过 MaxReleasePages 页时返回错误, 避免只根据部分 release 选择版本
+func listReleases[T any](clientConfig MalHTTPConfig, reqURL string, convert func(*T) *Release) ([]*Release, error) {
+	var result []*Release
+	first := reqURL
+	for page := 0; reqURL != ""; page++ {
+		if page >= MaxReleasePages {
+			return nil, fmt.Errorf("%s has more than %d pages of releases, increase MaxReleasePages", first, MaxReleasePages)
+		}
+		var releases []T
+		next, err := getJSON(clientConfig, reqURL, &releases)
+		if err != nil {
+			return nil, err
+		}
+		for i := range releases {
+			if release := convert(&releases[i]); release != nil {
+				result = append(result, release)
+			}
+		}
+		reqURL = next
+	}
+	return result, nil
+}
+
+// getJSON 请求 reqURL 并解析 json, 返回 Link 头中下一页的地址
+func getJSON(clientConfig MalHTTPConfig, reqURL string, v interface{}) (string, error) {
+	resp, body, err := httpRequest(clientConfig, reqURL, http.Header{"Accept": {"application/json"}})
+	if err != nil {
+		return "", err
+	}
+	if err := rateLimitError(resp); err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return "", fmt.Errorf("%w: %s", ErrReleaseNotFound, reqURL)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("API returned non-200 status code: %d", resp.StatusCode)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return "", fmt.Errorf("failed to parse API response of %s: %v", reqURL, err)
+	}
+	return nextLink(resp.Header.Get("Link")), nil
+}
+
+// rateLimitError 识别 GitHub (X-RateLimit-*), GitLab (RateLimit-*) 与 Retry-After 的限流响应
+func rateLimitError(resp *http.Response) error {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return nil
+	}
+	header := resp.Header
+	remaining := header.Get("X-RateLimit-Remaining")
+	if remaining == "" {
+		remaining = header.Get("RateLimit-Remaining")
+	}
+	retryAfter := header.Get("Retry-After")
+	if resp.StatusCode == http.StatusForbidden && remaining != "0" && retryAfter == "" {
+		return nil
+	}
+	e := &RateLimitError{URL: resp.Request.URL.String()}
+	for _, key := range []string{"X-RateLimit-Limit", "RateLimit-Limit"} {
+		if limit, err := strconv.Atoi(header.Get(key)); err == nil {
+			e.Limit = limit
+			break
+		}
+	}
+	for _, key := range []string{"X-RateLimit-Reset", "RateLimit-Reset"} {
+		if reset, err := strconv.ParseInt(header.Get(key), 10, 64); err == nil {
+			e.Reset = time.Unix(reset, 0)
+			break
+		}
+	}
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && e.Reset.IsZero() {
+		e.Reset = time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+	return e
+}
+
+var linkNextPattern = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+func nextLink(link string) string {
+	if match := linkNextPattern.FindStringSubmatch(link); match != nil {
+		return match[1]
+	}
+	return ""
+}
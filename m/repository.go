@@ -0,0 +1,423 @@
+package m
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// MalConfig.Type 支持的仓库类型, 为空时 file:// 与本地路径使用 local, 其他使用 github
+const (
+	RepoTypeGithub = "github"
+	RepoTypeGitlab = "gitlab"
+	RepoTypeGitea  = "gitea"
+	RepoTypeHTTP   = "http"
+	RepoTypeLocal  = "local"
+)
+
+// Repository 是存放 mals.yaml 与 mal 包的仓库
+type Repository interface {
+	// Index 返回 mals.yaml 的内容与签名, 仓库中没有签名时 sig 为 nil
+	Index() (index []byte, sig []byte, err error)
+	// Latest 返回 name 的最新版本
+	Latest(name string) (string, error)
+	// Asset 下载 name@version 中的文件, 如 "<name>.tar.gz", 不存在时返回 ErrAssetNotFound
+	Asset(name, version, asset string) ([]byte, error)
+}
+
+// NewRepository 根据 cfg.Type 与 cfg.RepoURL 创建仓库.
+// 认证来自 cfg: CatalogMal.Config 已经继承了所在索引仓库的认证, 本地配置自带认证;
+// 两者都不是时 cfg 为默认仓库 mals.yaml 中的项, 从 clientConfig.MalConfig 继承认证
+func NewRepository(cfg *MalConfig, clientConfig MalHTTPConfig) (Repository, error) {
+	if !cfg.catalog && cfg.Authorization == "" && cfg.AuthorizationCmd == "" {
+		cfg = inheritAuthorization(cfg, clientConfig.MalConfig)
+	}
+	clientConfig.MalConfig = cfg
+	switch repoType(cfg) {
+	case RepoTypeGithub:
+		return NewGithubRepository(cfg.RepoURL, clientConfig)
+	case RepoTypeGitlab:
+		return NewGitlabRepository(cfg.RepoURL, clientConfig)
+	case RepoTypeGitea:
+		return NewGiteaRepository(cfg.RepoURL, clientConfig)
+	case RepoTypeHTTP:
+		return &HTTPRepository{URL: strings.TrimSuffix(cfg.RepoURL, "/"), Config: clientConfig}, nil
+	case RepoTypeLocal:
+		return &LocalRepository{Dir: localRepoPath(cfg.RepoURL)}, nil
+	default:
+		return nil, fmt.Errorf("unknown repository type %q for %s", cfg.Type, cfg.RepoURL)
+	}
+}
+
+// repositoryFromURL 为只传入 url 的旧接口创建仓库, clientConfig.MalConfig 指向同一个仓库时使用其配置
+func repositoryFromURL(repoURL string, clientConfig MalHTTPConfig) (Repository, error) {
+	cfg := &MalConfig{RepoURL: repoURL}
+	if clientConfig.MalConfig != nil && clientConfig.MalConfig.RepoURL == repoURL {
+		cfg = clientConfig.MalConfig
+	}
+	return NewRepository(cfg, clientConfig)
+}
+
+func repoType(cfg *MalConfig) string {
+	if cfg.Type != "" {
+		return strings.ToLower(cfg.Type)
+	}
+	if u, err := url.Parse(cfg.RepoURL); err != nil || u.Scheme == "" || u.Scheme == "file" || filepath.IsAbs(cfg.RepoURL) {
+		return RepoTypeLocal
+	}
+	return RepoTypeGithub
+}
+
+func localRepoPath(repoURL string) string {
+	if u, err := url.Parse(repoURL); err == nil && u.Scheme == "file" {
+		return filepath.FromSlash(u.Path)
+	}
+	return repoURL
+}
+
+// GithubRepository 使用 api.github.com 读取 release, 使用 github.com 下载包以避免 API 的频率限制.
+// RepoURL 可以是 https://github.com/owner/repo 或 https://api.github.com/repos/owner/repo/releases,
+// 其他主机 (如 GitHub Enterprise) 的 API 与下载使用同一个地址
+type GithubRepository struct {
+	APIURL string
+	WebURL string
+	Config MalHTTPConfig
+}
+
+func NewGithubRepository(repoURL string, clientConfig MalHTTPConfig) (*GithubRepository, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mal repo url '%s': %s", repoURL, err)
+	}
+	base := strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/releases")
+	api, web := *u, *u
+	api.Path, web.Path = base, base
+	switch u.Host {
+	case "github.com":
+		api.Host = "api.github.com"
+		api.Path = "/repos" + base
+	case "api.github.com":
+		web.Host = "github.com"
+		web.Path = strings.TrimPrefix(base, "/repos")
+	}
+	return &GithubRepository{APIURL: api.String(), WebURL: web.String(), Config: clientConfig}, nil
+}
+
+func (repo *GithubRepository) Releases() ([]*Release, error) {
+	return listReleases(repo.Config, repo.APIURL+"/releases?per_page=100", func(release *GithubRelease) *Release {
+		if release.Draft {
+			return nil
+		}
+		return release.release()
+	})
+}
+
+func (repo *GithubRepository) Release(tag string) (*Release, error) {
+	var release GithubRelease
+	if _, err := getJSON(repo.Config, repo.APIURL+"/releases/tags/"+url.PathEscape(tag), &release); err != nil {
+		return nil, err
+	}
+	return release.release(), nil
+}
+
+func (release *GithubRelease) release() *Release {
+	r := &Release{Tag: release.TagName, Prerelease: release.Prerelease, Assets: make(map[string]string)}
+	for _, asset := range release.Assets {
+		r.Assets[asset.Name] = asset.URL
+	}
+	return r
+}
+
+func (repo *GithubRepository) Index() ([]byte, []byte, error) {
+	return releaseIndex(repo, repo.Config)
+}
+
+// Latest 使用 releases/latest API 获取最新的正式版本, 与其他请求一样经过缓存, 离线时同样可用
+func (repo *GithubRepository) Latest(name string) (string, error) {
+	var release GithubRelease
+	if _, err := getJSON(repo.Config, repo.APIURL+"/releases/latest", &release); err != nil {
+		return "", err
+	}
+	if release.TagName == "" {
+		return "", fmt.Errorf("%w: no tag in latest release of %s", ErrReleaseNotFound, repo.APIURL)
+	}
+	return release.TagName, nil
+}
+
+func (repo *GithubRepository) Asset(name, version, asset string) ([]byte, error) {
+	if err := checkAssetPath(name, version, asset); err != nil {
+		return nil, err
+	}
+	return downloadRequest(repo.Config, repo.WebURL+"/releases/download/"+url.PathEscape(version)+"/"+url.PathEscape(asset))
+}
+
+// GitlabRepository 使用 GitLab 的 releases API, RepoURL 为 https://gitlab.example.com/group/project.
+// GitLab 没有 prerelease 标记, 尚未发布的 upcoming release 视为 prerelease
+type GitlabRepository struct {
+	APIURL string
+	Config MalHTTPConfig
+}
+
+func NewGitlabRepository(repoURL string, clientConfig MalHTTPConfig) (*GitlabRepository, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mal repo url '%s': %s", repoURL, err)
+	}
+	project := strings.Trim(u.Path, "/")
+	apiURL := fmt.Sprintf("%s://%s/api/v4/projects/%s", u.Scheme, u.Host, url.PathEscape(project))
+	return &GitlabRepository{APIURL: apiURL, Config: clientConfig}, nil
+}
+
+type gitlabRelease struct {
+	TagName         string `json:"tag_name"`
+	UpcomingRelease bool   `json:"upcoming_release"`
+	Assets          struct {
+		Links []struct {
+			Name           string `json:"name"`
+			URL            string `json:"url"`
+			DirectAssetURL string `json:"direct_asset_url"`
+		} `json:"links"`
+	} `json:"assets"`
+}
+
+func (release *gitlabRelease) release() *Release {
+	r := &Release{Tag: release.TagName, Prerelease: release.UpcomingRelease, Assets: make(map[string]string)}
+	for _, link := range release.Assets.Links {
+		if link.DirectAssetURL != "" {
+			r.Assets[link.Name] = link.DirectAssetURL
+		} else {
+			r.Assets[link.Name] = link.URL
+		}
+	}
+	return r
+}
+
+func (repo *GitlabRepository) Releases() ([]*Release, error) {
+	return listReleases(repo.Config, repo.APIURL+"/releases?per_page=100", (*gitlabRelease).release)
+}
+
+func (repo *GitlabRepository) Release(tag string) (*Release, error) {
+	var release gitlabRelease
+	if _, err := getJSON(repo.Config, repo.APIURL+"/releases/"+url.PathEscape(tag), &release); err != nil {
+		return nil, err
+	}
+	return release.release(), nil
+}
+
+func (repo *GitlabRepository) Index() ([]byte, []byte, error) {
+	return releaseIndex(repo, repo.Config)
+}
+
+func (repo *GitlabRepository) Latest(name string) (string, error) {
+	return releaseLatest(repo)
+}
+
+func (repo *GitlabRepository) Asset(name, version, asset string) ([]byte, error) {
+	if err := checkAssetPath(name, version, asset); err != nil {
+		return nil, err
+	}
+	return releaseAsset(repo, repo.Config, version, asset)
+}
+
+// GiteaRepository 使用 Gitea (以及 Forgejo) 的 releases API, RepoURL 为 https://gitea.example.com/owner/repo
+type GiteaRepository struct {
+	APIURL string
+	Config MalHTTPConfig
+}
+
+func NewGiteaRepository(repoURL string, clientConfig MalHTTPConfig) (*GiteaRepository, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mal repo url '%s': %s", repoURL, err)
+	}
+	api := *u
+	api.Path = "/api/v1/repos/" + strings.Trim(u.Path, "/")
+	return &GiteaRepository{APIURL: api.String(), Config: clientConfig}, nil
+}
+
+type giteaRelease struct {
+	TagName    string `json:"tag_name"`
+	Draft      bool   `json:"draft"`
+	Prerelease bool   `json:"prerelease"`
+	Assets     []struct {
+		Name               string `json:"name"`
+		BrowserDownloadURL string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (release *giteaRelease) release() *Release {
+	r := &Release{Tag: release.TagName, Prerelease: release.Prerelease, Assets: make(map[string]string)}
+	for _, asset := range release.Assets {
+		r.Assets[asset.Name] = asset.BrowserDownloadURL
+	}
+	return r
+}
+
+func (repo *GiteaRepository) Releases() ([]*Release, error) {
+	return listReleases(repo.Config, repo.APIURL+"/releases?limit=50", func(release *giteaRelease) *Release {
+		if release.Draft {
+			return nil
+		}
+		return release.release()
+	})
+}
+
+func (repo *GiteaRepository) Release(tag string) (*Release, error) {
+	var release giteaRelease
+	if _, err := getJSON(repo.Config, repo.APIURL+"/releases/tags/"+url.PathEscape(tag), &release); err != nil {
+		return nil, err
+	}
+	return release.release(), nil
+}
+
+func (repo *GiteaRepository) Index() ([]byte, []byte, error) {
+	return releaseIndex(repo, repo.Config)
+}
+
+func (repo *GiteaRepository) Latest(name string) (string, error) {
+	return releaseLatest(repo)
+}
+
+func (repo *GiteaRepository) Asset(name, version, asset string) ([]byte, error) {
+	if err := checkAssetPath(name, version, asset); err != nil {
+		return nil, err
+	}
+	return releaseAsset(repo, repo.Config, version, asset)
+}
+
+// HTTPRepository 是静态 HTTP 目录, 布局为:
+//
+//	<url>/mals.yaml
+//	<url>/mal.minisig
+//	<url>/<name>/<version>/<name>.tar.gz
+type HTTPRepository struct {
+	URL    string
+	Config MalHTTPConfig
+}
+
+func (repo *HTTPRepository) Index() ([]byte, []byte, error) {
+	index, err := downloadRequest(repo.Config, repo.URL+"/"+MalIndexFileName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to download %s: %w", MalIndexFileName, err)
+	}
+	sig, err := downloadRequest(repo.Config, repo.URL+"/"+malIndexSigFileName)
+	if errors.Is(err, ErrAssetNotFound) {
+		return index, nil, nil
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("failed to download %s: %w", malIndexSigFileName, err)
+	}
+	return index, sig, nil
+}
+
+func (repo *HTTPRepository) Latest(name string) (string, error) {
+	index, _, err := repo.Index()
+	if err != nil {
+		return "", err
+	}
+	return indexLatest(index, name)
+}
+
+func (repo *HTTPRepository) Asset(name, version, asset string) ([]byte, error) {
+	if err := checkAssetPath(name, version, asset); err != nil {
+		return nil, err
+	}
+	return downloadRequest(repo.Config, repo.URL+"/"+path.Join(url.PathEscape(name), url.PathEscape(version), url.PathEscape(asset)))
+}
+
+// LocalRepository 是本地目录, 布局与 HTTPRepository 相同
+type LocalRepository struct {
+	Dir string
+}
+
+func (repo *LocalRepository) read(elem ...string) ([]byte, error) {
+	for _, e := range elem {
+		if !isLocalPath(e) {
+			return nil, fmt.Errorf("illegal path %s", e)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(append([]string{repo.Dir}, elem...)...))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrAssetNotFound, path.Join(elem...))
+	}
+	return data, err
+}
+
+func (repo *LocalRepository) Index() ([]byte, []byte, error) {
+	index, err := repo.read(MalIndexFileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	sig, err := repo.read(malIndexSigFileName)
+	if errors.Is(err, ErrAssetNotFound) {
+		return index, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return index, sig, nil
+}
+
+func (repo *LocalRepository) Latest(name string) (string, error) {
+	index, _, err := repo.Index()
+	if err != nil {
+		return "", err
+	}
+	return indexLatest(index, name)
+}
+
+func (repo *LocalRepository) Asset(name, version, asset string) ([]byte, error) {
+	if err := checkAssetPath(name, version, asset); err != nil {
+		return nil, err
+	}
+	return repo.read(name, version, asset)
+}
+
+// checkAssetPath 校验 Asset 的参数, 它们会作为一段拼接到 URL 或本地路径中
+func checkAssetPath(name, version, asset string) error {
+	if err := checkPathSegment("mal name", name); err != nil {
+		return err
+	}
+	if err := checkPathSegment("version of "+name, version); err != nil {
+		return err
+	}
+	return checkPathSegment("asset of "+name, asset)
+}
+
+// indexLatest 返回索引中 name 的最高正式版本, 只有预发布版本时返回最高的预发布版本
+func indexLatest(index []byte, name string) (string, error) {
+	var malsYaml MalsYaml
+	if err := yaml.Unmarshal(index, &malsYaml); err != nil {
+		return "", fmt.Errorf("failed to parse %s: %v", MalIndexFileName, err)
+	}
+	latest, prerelease := "", ""
+	for _, cfg := range malsYaml.Mals {
+		if cfg.Name != name {
+			continue
+		}
+		for _, version := range append([]string{cfg.Version}, cfg.Versions...) {
+			if version == "" || version == "latest" {
+				continue
+			}
+			if v, err := semver.NewVersion(version); err == nil && v.Prerelease() != "" {
+				if prerelease == "" || compareVersions(version, prerelease) > 0 {
+					prerelease = version
+				}
+			} else if latest == "" || compareVersions(version, latest) > 0 {
+				latest = version
+			}
+		}
+	}
+	if latest == "" {
+		latest = prerelease
+	}
+	if latest == "" {
+		return "", fmt.Errorf("no version of %s found in %s", name, MalIndexFileName)
+	}
+	return latest, nil
+}
@@ -0,0 +1,399 @@
+package m
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testIndex = `mals:
+  - name: demo
+    version: v1.0.0
+    versions: [v1.1.0-beta.1]
+`
+
+// releaseServer 模拟 release API, handler 之外的路径返回 404, 同时记录收到的 Authorization 头
+type releaseServer struct {
+	*httptest.Server
+	mux  *http.ServeMux
+	auth []string
+}
+
+func newReleaseServer(t *testing.T) *releaseServer {
+	srv := &releaseServer{mux: http.NewServeMux()}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.auth = append(srv.auth, r.Header.Get("Authorization"))
+		srv.mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (srv *releaseServer) json(pattern string, v interface{}) {
+	srv.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	})
+}
+
+func (srv *releaseServer) file(pattern, content string) {
+	srv.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(content))
+	})
+}
+
+func TestGithubRepository(t *testing.T) {
+	srv := newReleaseServer(t)
+	asset := func(name, path string) map[string]interface{} {
+		return map[string]interface{}{"name": name, "url": srv.URL + path}
+	}
+	releases := []map[string]interface{}{
+		{"tag_name": "v2.0.0", "draft": true},
+		{"tag_name": "v1.1.0-beta.1", "prerelease": true},
+		{"tag_name": "v1.0.0", "assets": []interface{}{asset(MalIndexFileName, "/files/mals.yaml")}},
+	}
+	srv.json("/owner/repo/releases", releases)
+	srv.json("/owner/repo/releases/tags/v1.0.0", releases[2])
+	srv.file("/files/mals.yaml", testIndex)
+	srv.file("/owner/repo/releases/download/v1.0.0/demo.tar.gz", "package")
+	srv.json("/owner/repo/releases/latest", releases[2])
+
+	cfg := &MalConfig{RepoURL: srv.URL + "/owner/repo", Type: RepoTypeGithub, Authorization: "token secret"}
+	repo, err := NewRepository(cfg, MalHTTPConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := repo.(releaseLister).Releases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].Tag != "v1.1.0-beta.1" || !all[0].Prerelease {
+		t.Fatalf("drafts should be skipped, got %+v", all)
+	}
+	index, sig, err := repo.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(index) != testIndex || sig != nil {
+		t.Fatalf("unexpected index %q, sig %q", index, sig)
+	}
+	if latest, err := repo.Latest("demo"); err != nil || latest != "v1.0.0" {
+		t.Fatalf("Latest() = %q, %v", latest, err)
+	}
+	if data, err := repo.Asset("demo", "v1.0.0", "demo.tar.gz"); err != nil || string(data) != "package" {
+		t.Fatalf("Asset() = %q, %v", data, err)
+	}
+	if _, err := repo.Asset("demo", "v1.0.0", "missing.tar.gz"); !errors.Is(err, ErrAssetNotFound) {
+		t.Fatalf("expected ErrAssetNotFound, got %v", err)
+	}
+	for _, auth := range srv.auth {
+		if auth != "token secret" {
+			t.Fatalf("expected authorization on every request to the repo host, got %q", auth)
+		}
+	}
+}
+
+func TestGitlabRepository(t *testing.T) {
+	srv := newReleaseServer(t)
+	release := func(tag string, upcoming bool) map[string]interface{} {
+		return map[string]interface{}{
+			"tag_name":         tag,
+			"upcoming_release": upcoming,
+			"assets": map[string]interface{}{"links": []interface{}{
+				map[string]interface{}{"name": MalIndexFileName, "url": srv.URL + "/links/" + tag, "direct_asset_url": srv.URL + "/files/" + tag + "/mals.yaml"},
+				map[string]interface{}{"name": "demo.tar.gz", "url": srv.URL + "/files/" + tag + "/demo.tar.gz"},
+			}},
+		}
+	}
+	releases := []map[string]interface{}{release("v1.1.0", true), release("v1.0.0", false)}
+	// 项目路径在 API 中编码为 group%2Fproject
+	srv.mux.HandleFunc("/api/v4/projects/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/api/v4/projects/group%2Fproject/releases":
+			json.NewEncoder(w).Encode(releases)
+		case "/api/v4/projects/group%2Fproject/releases/v1.0.0":
+			json.NewEncoder(w).Encode(releases[1])
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	srv.file("/files/v1.0.0/mals.yaml", testIndex)
+	srv.file("/files/v1.0.0/demo.tar.gz", "package")
+
+	repo, err := NewRepository(&MalConfig{RepoURL: srv.URL + "/group/project", Type: RepoTypeGitlab}, MalHTTPConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest, err := repo.Latest("demo"); err != nil || latest != "v1.0.0" {
+		t.Fatalf("upcoming releases should be prereleases, Latest() = %q, %v", latest, err)
+	}
+	if index, _, err := repo.Index(); err != nil || string(index) != testIndex {
+		t.Fatalf("Index() = %q, %v", index, err)
+	}
+	if data, err := repo.Asset("demo", "v1.0.0", "demo.tar.gz"); err != nil || string(data) != "package" {
+		t.Fatalf("Asset() = %q, %v", data, err)
+	}
+	if _, err := repo.Asset("demo", "v9.0.0", "demo.tar.gz"); !errors.Is(err, ErrReleaseNotFound) {
+		t.Fatalf("expected ErrReleaseNotFound, got %v", err)
+	}
+}
+
+func TestGiteaRepositoryPaging(t *testing.T) {
+	srv := newReleaseServer(t)
+	release := func(tag string) map[string]interface{} {
+		return map[string]interface{}{
+			"tag_name": tag,
+			"assets": []interface{}{
+				map[string]interface{}{"name": "demo.tar.gz", "browser_download_url": srv.URL + "/files/" + tag + "/demo.tar.gz"},
+			},
+		}
+	}
+	srv.mux.HandleFunc("/api/v1/repos/owner/repo/releases", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			json.NewEncoder(w).Encode([]interface{}{release("v1.0.0")})
+			return
+		}
+		w.Header().Set("Link", fmt.Sprintf(`<%s/api/v1/repos/owner/repo/releases?limit=50&page=2>; rel="next"`, srv.URL))
+		json.NewEncoder(w).Encode([]interface{}{map[string]interface{}{"tag_name": "v3.0.0", "draft": true}, release("v2.0.0")})
+	})
+	srv.json("/api/v1/repos/owner/repo/releases/tags/v1.0.0", release("v1.0.0"))
+	srv.file("/files/v1.0.0/demo.tar.gz", "package")
+
+	repo, err := NewRepository(&MalConfig{RepoURL: srv.URL + "/owner/repo", Type: RepoTypeGitea}, MalHTTPConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	releases, err := repo.(releaseLister).Releases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(releases) != 2 || releases[0].Tag != "v2.0.0" || releases[1].Tag != "v1.0.0" {
+		t.Fatalf("expected releases from both pages without drafts, got %+v", releases)
+	}
+	if data, err := repo.Asset("demo", "v1.0.0", "demo.tar.gz"); err != nil || string(data) != "package" {
+		t.Fatalf("Asset() = %q, %v", data, err)
+	}
+}
+
+// writeStaticRepo 按 HTTPRepository 与 LocalRepository 的布局写入 dir
+func writeStaticRepo(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStaticRepositories(t *testing.T) {
+	dir := t.TempDir()
+	writeStaticRepo(t, dir, map[string]string{
+		MalIndexFileName:                testIndex,
+		"demo/v1.0.0/demo.tar.gz":       "package",
+		"demo/v1.0.0/demo.tar.gz.extra": "extra",
+	})
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer srv.Close()
+
+	for _, cfg := range []*MalConfig{
+		{RepoURL: srv.URL, Type: RepoTypeHTTP},
+		{RepoURL: dir},
+	} {
+		repo, err := NewRepository(cfg, MalHTTPConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(fmt.Sprintf("%T", repo), func(t *testing.T) {
+			index, sig, err := repo.Index()
+			if err != nil || string(index) != testIndex || sig != nil {
+				t.Fatalf("Index() = %q, %q, %v", index, sig, err)
+			}
+			if latest, err := repo.Latest("demo"); err != nil || latest != "v1.0.0" {
+				t.Fatalf("Latest() = %q, %v", latest, err)
+			}
+			if data, err := repo.Asset("demo", "v1.0.0", "demo.tar.gz"); err != nil || string(data) != "package" {
+				t.Fatalf("Asset() = %q, %v", data, err)
+			}
+			if _, err := repo.Asset("demo", "v1.0.0", "demo.tar.gz.sha256"); !errors.Is(err, ErrAssetNotFound) {
+				t.Fatalf("expected ErrAssetNotFound, got %v", err)
+			}
+			if _, err := repo.Asset("demo", "..", MalIndexFileName); err == nil {
+				t.Fatal("expected error for path outside of the mal")
+			}
+		})
+	}
+}
+
+func TestRepositoryAssetRejectsUnsafeSegments(t *testing.T) {
+	srv := newReleaseServer(t)
+	dir := t.TempDir()
+	for _, cfg := range []*MalConfig{
+		{RepoURL: srv.URL + "/owner/repo", Type: RepoTypeGithub},
+		{RepoURL: srv.URL + "/group/project", Type: RepoTypeGitlab},
+		{RepoURL: srv.URL + "/owner/repo", Type: RepoTypeGitea},
+		{RepoURL: srv.URL, Type: RepoTypeHTTP},
+		{RepoURL: dir},
+	} {
+		repo, err := NewRepository(cfg, MalHTTPConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(fmt.Sprintf("%T", repo), func(t *testing.T) {
+			for _, args := range [][3]string{
+				{"demo", "..", "demo.tar.gz"},
+				{"demo", "v1.0.0/../..", "demo.tar.gz"},
+				{"demo", "v1.0.0", "../" + MalIndexFileName},
+				{"demo", "v1.0.0", ""},
+				{"..", "v1.0.0", "demo.tar.gz"},
+			} {
+				if _, err := repo.Asset(args[0], args[1], args[2]); err == nil || errors.Is(err, ErrAssetNotFound) {
+					t.Fatalf("expected Asset%q to be rejected, got %v", args, err)
+				}
+			}
+			if len(srv.auth) != 0 {
+				t.Fatalf("unsafe asset requested from server %d times", len(srv.auth))
+			}
+		})
+	}
+
+	t.Run("GithubMalPackageParser", func(t *testing.T) {
+		download := t.TempDir()
+		if err := GithubMalPackageParser(srv.URL+"/owner/repo", "demo", "../v1.0.0", download, MalHTTPConfig{}); err == nil {
+			t.Fatal("expected unsafe version to be rejected")
+		}
+		if len(srv.auth) != 0 {
+			t.Fatalf("unsafe asset requested from server %d times", len(srv.auth))
+		}
+	})
+}
+
+func TestFetchMalYamlIgnoresIndexCredentials(t *testing.T) {
+	dir := t.TempDir()
+	writeStaticRepo(t, dir, map[string]string{MalIndexFileName: `mals:
+  - name: demo
+    version: v1.0.0
+    repo_url: https://example.com/demo
+    authorization_cmd: touch pwned
+    authorization: token leaked
+    public_key: untrusted
+    insecure: true
+`})
+	repo := &MalConfig{RepoURL: dir, Insecure: true}
+	malsYaml, err := fetchMalYaml(dir, MalHTTPConfig{MalConfig: repo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mal := malsYaml.Mals[0]
+	if mal.AuthorizationCmd != "" || mal.Authorization != "" || mal.PublicKey != "" || mal.Insecure {
+		t.Fatalf("index entry kept credentials or trust settings: %+v", mal)
+	}
+
+	index := &MalConfig{RepoURL: "https://example.com/index", Authorization: "token local"}
+	entry := &MalConfig{RepoURL: "https://other.example.com/demo", AuthorizationCmd: "touch pwned"}
+	if inherited := inheritAuthorization(entry, index); inherited.AuthorizationCmd != "" || inherited.Authorization != "" {
+		t.Fatalf("entry on another host should not have credentials: %+v", inherited)
+	}
+	entry.RepoURL = "https://example.com/demo"
+	if inherited := inheritAuthorization(entry, index); inherited.AuthorizationCmd != "" || inherited.Authorization != "token local" {
+		t.Fatalf("entry should inherit only the index credentials: %+v", inherited)
+	}
+}
+
+func TestGithubLatestOffline(t *testing.T) {
+	srv := newReleaseServer(t)
+	srv.json("/owner/repo/releases/latest", map[string]interface{}{"tag_name": "v1.0.0"})
+	cfg := &MalConfig{RepoURL: srv.URL + "/owner/repo", Type: RepoTypeGithub}
+	config := MalHTTPConfig{CacheDir: t.TempDir()}
+
+	repo, err := NewRepository(cfg, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest, err := repo.Latest("demo"); err != nil || latest != "v1.0.0" {
+		t.Fatalf("Latest() = %q, %v", latest, err)
+	}
+	config.Offline = true
+	if repo, err = NewRepository(cfg, config); err != nil {
+		t.Fatal(err)
+	}
+	if latest, err := repo.Latest("demo"); err != nil || latest != "v1.0.0" {
+		t.Fatalf("offline Latest() = %q, %v", latest, err)
+	}
+}
+
+func TestCacheSeparatesCredentials(t *testing.T) {
+	srv := newReleaseServer(t)
+	srv.mux.HandleFunc("/private", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Write([]byte("private"))
+	})
+	dir := t.TempDir()
+	authorized := MalHTTPConfig{CacheDir: dir, MalConfig: &MalConfig{RepoURL: srv.URL, Authorization: "secret"}}
+	if data, err := downloadRequest(authorized, srv.URL+"/private"); err != nil || string(data) != "private" {
+		t.Fatalf("downloadRequest() = %q, %v", data, err)
+	}
+
+	anonymous := MalHTTPConfig{CacheDir: dir, MalConfig: &MalConfig{RepoURL: srv.URL}}
+	if data, err := downloadRequest(anonymous, srv.URL+"/private"); err == nil {
+		t.Fatalf("authenticated response replayed without credentials: %q", data)
+	}
+	anonymous.Offline = true
+	if _, err := downloadRequest(anonymous, srv.URL+"/private"); !errors.Is(err, ErrNotCached) {
+		t.Fatalf("expected ErrNotCached, got %v", err)
+	}
+}
+
+type fakeReleases map[string]*Release
+
+func (releases fakeReleases) Releases() ([]*Release, error) {
+	var result []*Release
+	for _, release := range releases {
+		result = append(result, release)
+	}
+	return result, nil
+}
+
+func (releases fakeReleases) Release(tag string) (*Release, error) {
+	if release, ok := releases[tag]; ok {
+		return release, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrReleaseNotFound, tag)
+}
+
+func TestSelectReleaseVersionPrefix(t *testing.T) {
+	releases := fakeReleases{"v1.2.0": {Tag: "v1.2.0"}, "2.0.0": {Tag: "2.0.0"}}
+	for selector, want := range map[string]string{"1.2.0": "v1.2.0", "v1.2.0": "v1.2.0", "v2.0.0": "2.0.0"} {
+		if release, err := selectRelease(releases, selector, false); err != nil || release.Tag != want {
+			t.Errorf("selectRelease(%q) = %v, %v, want %s", selector, release, err, want)
+		}
+	}
+	if _, err := selectRelease(releases, "1.3.0", false); !errors.Is(err, ErrReleaseNotFound) {
+		t.Errorf("expected ErrReleaseNotFound, got %v", err)
+	}
+}
+
+func TestListReleasesTruncated(t *testing.T) {
+	srv := newReleaseServer(t)
+	srv.mux.HandleFunc("/releases", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", fmt.Sprintf(`<%s/releases?page=2>; rel="next"`, srv.URL))
+		w.Write([]byte(`[{"tag_name": "v1.0.0"}]`))
+	})
+	defer func(pages int) { MaxReleasePages = pages }(MaxReleasePages)
+	MaxReleasePages = 2
+	_, err := listReleases(MalHTTPConfig{}, srv.URL+"/releases", (*giteaRelease).release)
+	if err == nil {
+		t.Fatal("expected error when releases exceed MaxReleasePages")
+	}
+}
@@ -0,0 +1,379 @@
+package m
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// maxResolveRounds 限制重新选择版本的轮数, 避免依赖之间互相推翻时无法结束
+var maxResolveRounds = 100
+
+// Candidate 是某个仓库提供的 mal 的一个版本
+type Candidate struct {
+	Name    string
+	Version string
+	Config  *MalConfig
+}
+
+func (c *Candidate) String() string {
+	return c.Name + "@" + c.Version
+}
+
+// PackageSource 为 Resolver 提供候选版本与对应版本的 manifest
+type PackageSource interface {
+	// Candidates 返回所有仓库中 name 的可用版本, 同一版本出现多次时靠前的仓库优先
+	Candidates(name string) ([]*Candidate, error)
+	Manifest(c *Candidate) (*Manifest, error)
+}
+
+// Requirement 是一条版本约束, From 为空表示用户直接安装
+type Requirement struct {
+	From       string
+	Constraint string
+}
+
+func (req Requirement) String() string {
+	from := req.From
+	if from == "" {
+		from = "install"
+	}
+	constraint := req.Constraint
+	if constraint == "" {
+		constraint = "*"
+	}
+	return fmt.Sprintf("%s requires %s", from, constraint)
+}
+
+// ResolvedMal 是解析后确定安装的版本
+type ResolvedMal struct {
+	*Candidate
+	Manifest     *Manifest
+	Requirements []Requirement
+}
+
+// Resolution 是一组互相兼容的 mal, 依赖排在依赖它的 mal 之前
+type Resolution struct {
+	Mals []*ResolvedMal
+}
+
+func (res *Resolution) Get(name string) *ResolvedMal {
+	for _, mal := range res.Mals {
+		if mal.Name == name {
+			return mal
+		}
+	}
+	return nil
+}
+
+// ConflictError 表示没有版本能同时满足所有约束
+type ConflictError struct {
+	Name         string
+	Requirements []Requirement
+	Available    []string
+}
+
+func (e *ConflictError) Error() string {
+	reqs := make([]string, len(e.Requirements))
+	for i, req := range e.Requirements {
+		reqs[i] = req.String()
+	}
+	available := "none"
+	if len(e.Available) > 0 {
+		available = strings.Join(e.Available, ", ")
+	}
+	return fmt.Sprintf("dependency conflict: no version of %s satisfies %s (available: %s)",
+		e.Name, strings.Join(reqs, ", "), available)
+}
+
+// CycleError 表示依赖中存在环
+type CycleError struct {
+	Path []string
+}
+
+func (e *CycleError) Error() string {
+	return "dependency cycle detected: " + strings.Join(e.Path, " -> ")
+}
+
+// Resolver 根据 manifest 中的 semver 约束计算需要安装的 mal 及版本
+type Resolver struct {
+	Source PackageSource
+	// Locked 中的版本满足约束时优先使用, 通常来自 lockfile
+	Locked map[string]string
+}
+
+// Resolve 解析 roots 及其依赖, roots 为 name 到版本约束的映射.
+// 约束可以是 semver 范围 (如 "^1.2", ">=1.0 <2.0"), 具体的 tag (如 "nightly"), 或者空表示任意版本
+func (r *Resolver) Resolve(roots map[string]string) (*Resolution, error) {
+	selected := make(map[string]*ResolvedMal)
+	candidates := make(map[string][]*Candidate)
+	for round := 0; ; round++ {
+		if round >= maxResolveRounds {
+			return nil, fmt.Errorf("dependency resolution did not converge after %d rounds", maxResolveRounds)
+		}
+		requirements := r.requirements(roots, selected)
+		changed := false
+		for _, name := range sortedKeys(requirements) {
+			reqs := requirements[name]
+			if current := selected[name]; current != nil && satisfiesAll(current.Version, reqs) {
+				current.Requirements = reqs
+				continue
+			}
+			if _, ok := candidates[name]; !ok {
+				cands, err := r.Source.Candidates(name)
+				if err != nil {
+					return nil, err
+				}
+				candidates[name] = cands
+			}
+			candidate, err := r.choose(name, candidates[name], reqs)
+			if err != nil {
+				return nil, err
+			}
+			manifest, err := r.Source.Manifest(candidate)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read manifest of %s: %v", candidate, err)
+			}
+			if manifest.Name != name {
+				return nil, fmt.Errorf("package %s contains mal %s", candidate, manifest.Name)
+			}
+			selected[name] = &ResolvedMal{Candidate: candidate, Manifest: manifest, Requirements: reqs}
+			changed = true
+		}
+		// 不再被依赖的 mal 在下一轮之前移除, 它们的约束也随之失效
+		for name := range selected {
+			if _, ok := requirements[name]; !ok {
+				delete(selected, name)
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	return r.order(roots, selected)
+}
+
+func (r *Resolver) requirements(roots map[string]string, selected map[string]*ResolvedMal) map[string][]Requirement {
+	requirements := make(map[string][]Requirement)
+	for name, constraint := range roots {
+		requirements[name] = append(requirements[name], Requirement{Constraint: constraint})
+	}
+	// 只有从 roots 可达的 mal 的依赖才生效
+	visited := make(map[string]bool)
+	var walk func(name string)
+	walk = func(name string) {
+		if visited[name] {
+			return
+		}
+		visited[name] = true
+		mal := selected[name]
+		if mal == nil {
+			return
+		}
+		for dep, constraint := range mal.Manifest.Dependencies {
+			requirements[dep] = append(requirements[dep], Requirement{From: mal.String(), Constraint: constraint})
+			walk(dep)
+		}
+	}
+	for _, name := range sortedKeys(roots) {
+		walk(name)
+	}
+	for name := range requirements {
+		sort.Slice(requirements[name], func(i, j int) bool {
+			return requirements[name][i].From < requirements[name][j].From
+		})
+	}
+	return requirements
+}
+
+// choose 优先使用锁定的版本, 否则选择满足约束的最高版本
+func (r *Resolver) choose(name string, cands []*Candidate, reqs []Requirement) (*Candidate, error) {
+	if len(cands) == 0 {
+		return nil, &ConflictError{Name: name, Requirements: reqs}
+	}
+	first := cands[0]
+	cands = append([]*Candidate{}, cands...)
+	sort.SliceStable(cands, func(i, j int) bool {
+		return compareVersions(cands[i].Version, cands[j].Version) > 0
+	})
+	var matched []*Candidate
+	for _, c := range cands {
+		if satisfiesAll(c.Version, reqs) {
+			matched = append(matched, c)
+		}
+	}
+	if len(matched) == 0 {
+		// 索引中没有列出的具体版本直接从第一个仓库获取
+		if pinned := pinnedVersion(reqs); pinned != "" {
+			return &Candidate{Name: name, Version: pinned, Config: first.Config}, nil
+		}
+		available := make([]string, len(cands))
+		for i, c := range cands {
+			available[i] = c.Version
+		}
+		return nil, &ConflictError{Name: name, Requirements: reqs, Available: available}
+	}
+	if locked, ok := r.Locked[name]; ok {
+		for _, c := range matched {
+			if c.Version == locked {
+				return c, nil
+			}
+		}
+	}
+	return matched[0], nil
+}
+
+// order 按依赖关系排序, 同时检查依赖环
+func (r *Resolver) order(roots map[string]string, selected map[string]*ResolvedMal) (*Resolution, error) {
+	res := &Resolution{}
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int)
+	var path []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case done:
+			return nil
+		case visiting:
+			start := 0
+			for i, p := range path {
+				if p == name {
+					start = i
+				}
+			}
+			return &CycleError{Path: append(append([]string{}, path[start:]...), name)}
+		}
+		state[name] = visiting
+		path = append(path, name)
+		mal := selected[name]
+		for _, dep := range sortedKeys(mal.Manifest.Dependencies) {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = done
+		res.Mals = append(res.Mals, mal)
+		return nil
+	}
+	for _, name := range sortedKeys(roots) {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parseConstraint 解析 semver 约束, 空字符串, "*" 与 "latest" 表示任意版本.
+// 无法解析为 semver 约束的字符串作为 tag 精确匹配, 返回 nil
+func parseConstraint(constraint string) (*semver.Constraints, error) {
+	switch constraint {
+	case "", "*", "latest":
+		return semver.NewConstraint("*")
+	}
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		if strings.ContainsAny(constraint, "<>=~^|, ") {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return c, nil
+}
+
+// satisfies 报告 version 是否满足 constraint, 与 constraint 完全相同的 tag 总是满足
+func satisfies(version, constraint string) bool {
+	if version == constraint {
+		return true
+	}
+	c, err := parseConstraint(constraint)
+	if err != nil || c == nil {
+		return false
+	}
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		// 非 semver 的 tag 如 nightly 只在不限制版本时可选
+		return constraint == "" || constraint == "*" || constraint == "latest"
+	}
+	return c.Check(v)
+}
+
+func satisfiesAll(version string, reqs []Requirement) bool {
+	for _, req := range reqs {
+		if !satisfies(version, req.Constraint) {
+			return false
+		}
+	}
+	return true
+}
+
+// pinnedVersion 返回约束中唯一指定的具体版本, 如 "v1.2.0" 或 "nightly"
+func pinnedVersion(reqs []Requirement) string {
+	pinned := ""
+	for _, req := range reqs {
+		constraint := req.Constraint
+		if constraint == "" || constraint == "*" || constraint == "latest" || isRange(constraint) {
+			continue
+		}
+		if v, err := semver.NewVersion(constraint); err == nil && strings.Count(v.Original(), ".") < 2 {
+			// "1" 与 "1.2" 是范围而不是具体版本
+			continue
+		}
+		if pinned != "" && pinned != constraint {
+			return ""
+		}
+		pinned = constraint
+	}
+	if pinned == "" || !satisfiesAll(pinned, reqs) {
+		return ""
+	}
+	return pinned
+}
+
+// isRange 报告 constraint 是否为范围: 包含比较符, 空格, "*", 或者 "1.x" 这样以 x/X 作为完整一段的版本.
+// "next", "fix-1" 等包含 x 的 tag 仍然是具体版本
+func isRange(constraint string) bool {
+	if strings.ContainsAny(constraint, "<>=~^|,* ") {
+		return true
+	}
+	core := strings.TrimPrefix(strings.TrimPrefix(constraint, "v"), "V")
+	if i := strings.IndexAny(core, "-+"); i >= 0 {
+		core = core[:i]
+	}
+	for _, part := range strings.Split(core, ".") {
+		if part == "x" || part == "X" {
+			return true
+		}
+	}
+	return false
+}
+
+// compareVersions 比较两个版本, semver 版本高于非 semver 的 tag
+func compareVersions(a, b string) int {
+	va, errA := semver.NewVersion(a)
+	vb, errB := semver.NewVersion(b)
+	switch {
+	case errA == nil && errB == nil:
+		return va.Compare(vb)
+	case errA == nil:
+		return 1
+	case errB == nil:
+		return -1
+	}
+	return 0
+}
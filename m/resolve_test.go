@@ -0,0 +1,120 @@
+package m
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// fakeSource 以 name -> version -> dependencies 描述仓库中的 mal
+type fakeSource map[string]map[string]map[string]string
+
+func (src fakeSource) Candidates(name string) ([]*Candidate, error) {
+	var cands []*Candidate
+	for version := range src[name] {
+		cands = append(cands, &Candidate{Name: name, Version: version, Config: &MalConfig{Name: name}})
+	}
+	return cands, nil
+}
+
+func (src fakeSource) Manifest(c *Candidate) (*Manifest, error) {
+	deps, ok := src[c.Name][c.Version]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", c)
+	}
+	return &Manifest{Name: c.Name, Version: c.Version, Dependencies: deps}, nil
+}
+
+func TestResolver(t *testing.T) {
+	libs := map[string]map[string]string{"v1.0.0": nil, "v1.3.0": nil, "v2.0.0": nil}
+	for name, tc := range map[string]struct {
+		source   fakeSource
+		roots    map[string]string
+		locked   map[string]string
+		expected map[string]string
+		conflict string
+		cycle    bool
+	}{
+		"diamond": {
+			source: fakeSource{
+				"a":   {"v1.0.0": {"lib": "^1.0"}},
+				"b":   {"v1.0.0": {"lib": ">=1.2"}},
+				"lib": libs,
+			},
+			roots:    map[string]string{"a": "", "b": ""},
+			expected: map[string]string{"a": "v1.0.0", "b": "v1.0.0", "lib": "v1.3.0"},
+		},
+		"diamond conflict": {
+			source: fakeSource{
+				"a":   {"v1.0.0": {"lib": "^1.0"}},
+				"b":   {"v1.0.0": {"lib": "^2.0"}},
+				"lib": libs,
+			},
+			roots:    map[string]string{"a": "", "b": ""},
+			conflict: "lib",
+		},
+		"cycle": {
+			source: fakeSource{
+				"a": {"v1.0.0": {"b": ""}},
+				"b": {"v1.0.0": {"c": ""}},
+				"c": {"v1.0.0": {"a": ""}},
+			},
+			roots: map[string]string{"a": ""},
+			cycle: true,
+		},
+		"locked": {
+			source:   fakeSource{"a": {"v1.0.0": {"lib": "^1.0"}}, "lib": libs},
+			roots:    map[string]string{"a": ""},
+			locked:   map[string]string{"lib": "v1.0.0"},
+			expected: map[string]string{"a": "v1.0.0", "lib": "v1.0.0"},
+		},
+		"locked out of range": {
+			source:   fakeSource{"a": {"v1.0.0": {"lib": "^1.0"}}, "lib": libs},
+			roots:    map[string]string{"a": ""},
+			locked:   map[string]string{"lib": "v2.0.0"},
+			expected: map[string]string{"a": "v1.0.0", "lib": "v1.3.0"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			res, err := (&Resolver{Source: tc.source, Locked: tc.locked}).Resolve(tc.roots)
+			var conflictErr *ConflictError
+			var cycleErr *CycleError
+			switch {
+			case tc.conflict != "":
+				if !errors.As(err, &conflictErr) || conflictErr.Name != tc.conflict {
+					t.Fatalf("expected conflict on %s, got %v", tc.conflict, err)
+				}
+				if len(conflictErr.Requirements) != 2 {
+					t.Fatalf("expected both requirements to be reported, got %v", conflictErr.Requirements)
+				}
+				return
+			case tc.cycle:
+				if !errors.As(err, &cycleErr) {
+					t.Fatalf("expected cycle error, got %v", err)
+				}
+				if path := cycleErr.Path; len(path) != 4 || path[0] != path[len(path)-1] {
+					t.Fatalf("unexpected cycle path %v", path)
+				}
+				return
+			case err != nil:
+				t.Fatal(err)
+			}
+			if len(res.Mals) != len(tc.expected) {
+				t.Fatalf("expected %d mals, got %d", len(tc.expected), len(res.Mals))
+			}
+			seen := make(map[string]bool)
+			for _, mal := range res.Mals {
+				if mal.Version != tc.expected[mal.Name] {
+					t.Fatalf("expected %s@%s, got %s", mal.Name, tc.expected[mal.Name], mal)
+				}
+				// 依赖排在依赖它的 mal 之前
+				for dep := range mal.Manifest.Dependencies {
+					if !seen[dep] {
+						t.Fatalf("%s ordered before its dependency %s", mal.Name, dep)
+					}
+				}
+				seen[mal.Name] = true
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package m
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// platformAliases 将常见的平台别名统一为 GOOS/GOARCH 的写法
+var platformAliases = map[string]string{
+	"win":     "windows",
+	"macos":   "darwin",
+	"osx":     "darwin",
+	"x64":     "amd64",
+	"x86_64":  "amd64",
+	"x86":     "386",
+	"i386":    "386",
+	"i686":    "386",
+	"aarch64": "arm64",
+}
+
+func normalizePlatform(platform string) string {
+	platform = strings.ToLower(strings.TrimSpace(platform))
+	if alias, ok := platformAliases[platform]; ok {
+		return alias
+	}
+	return platform
+}
+
+// SearchQuery 是搜索 mal 的条件, 为空的条件不做过滤
+type SearchQuery struct {
+	// Keyword 按空格分词, 每个词都需要出现在名称, 说明, 标签或作者中, 不区分大小写
+	Keyword string
+	// Tags 中的标签都需要存在
+	Tags   []string
+	Author string
+	// OS 与 Arch 是 implant 的平台, 没有声明平台的 mal 视为支持所有平台
+	OS   string
+	Arch string
+	// HostVersion 是当前客户端版本, 过滤 MinHostVersion 更高的 mal
+	HostVersion string
+}
+
+// Match 报告 cfg 是否满足所有条件
+func (query *SearchQuery) Match(cfg *MalConfig) bool {
+	return query.score(cfg) > 0
+}
+
+// score 返回匹配程度, 0 表示不匹配. 名称匹配的排在说明匹配之前
+func (query *SearchQuery) score(cfg *MalConfig) int {
+	for _, tag := range query.Tags {
+		if !containsFold(cfg.Tags, tag) {
+			return 0
+		}
+	}
+	if query.Author != "" && !strings.EqualFold(cfg.Author, query.Author) {
+		return 0
+	}
+	if !cfg.SupportsPlatform(query.OS, query.Arch) {
+		return 0
+	}
+	if query.HostVersion != "" && !cfg.SupportsHost(query.HostVersion) {
+		return 0
+	}
+
+	score := 1
+	name := strings.ToLower(cfg.Name)
+	for _, word := range strings.Fields(strings.ToLower(query.Keyword)) {
+		switch {
+		case name == word:
+			score += 8
+		case strings.HasPrefix(name, word):
+			score += 4
+		case strings.Contains(name, word):
+			score += 3
+		case containsFold(cfg.Tags, word):
+			score += 2
+		case strings.Contains(strings.ToLower(cfg.Description), word),
+			strings.Contains(strings.ToLower(cfg.Help), word),
+			strings.Contains(strings.ToLower(cfg.Author), word):
+			score++
+		default:
+			return 0
+		}
+	}
+	return score
+}
+
+// SupportsPlatform 报告 cfg 是否支持 os/arch, 空字符串表示不限制
+func (cfg *MalConfig) SupportsPlatform(os, arch string) bool {
+	return supports(cfg.OS, os) && supports(cfg.Arch, arch)
+}
+
+func supports(platforms []string, platform string) bool {
+	if platform == "" || len(platforms) == 0 {
+		return true
+	}
+	platform = normalizePlatform(platform)
+	for _, p := range platforms {
+		if normalizePlatform(p) == platform {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsHost 报告客户端版本 version 是否满足 MinHostVersion, 无法解析的版本不做限制
+func (cfg *MalConfig) SupportsHost(version string) bool {
+	if cfg.MinHostVersion == "" {
+		return true
+	}
+	min, err := semver.NewVersion(cfg.MinHostVersion)
+	if err != nil {
+		return true
+	}
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return true
+	}
+	return !v.LessThan(min)
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Query 返回满足 query 的 mal, 按匹配程度与名称排序
+func (catalog *Catalog) Query(query SearchQuery) []*CatalogMal {
+	return rank(catalog.Mals, func(mal *CatalogMal) *MalConfig { return &mal.MalConfig }, query)
+}
+
+// rank 过滤 items 并按匹配程度与名称排序
+func rank[T any](items []T, config func(T) *MalConfig, query SearchQuery) []T {
+	type result struct {
+		item  T
+		name  string
+		score int
+	}
+	var results []result
+	for _, item := range items {
+		cfg := config(item)
+		if score := query.score(cfg); score > 0 {
+			results = append(results, result{item: item, name: cfg.Name, score: score})
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].name < results[j].name
+	})
+	ranked := make([]T, len(results))
+	for i, r := range results {
+		ranked[i] = r.item
+	}
+	return ranked
+}
+
+// Tags 返回所有标签及使用它们的 mal 数量, 用于按标签浏览
+func (catalog *Catalog) Tags() map[string]int {
+	tags := make(map[string]int)
+	for _, mal := range catalog.Mals {
+		seen := make(map[string]bool)
+		for _, tag := range mal.Tags {
+			tag = strings.ToLower(tag)
+			if !seen[tag] {
+				seen[tag] = true
+				tags[tag]++
+			}
+		}
+	}
+	return tags
+}
+
+// Search 在单个索引中查找满足 query 的 mal, 按匹配程度与名称排序
+func (malsYaml *MalsYaml) Search(query SearchQuery) []*MalConfig {
+	return rank(malsYaml.Mals, func(cfg *MalConfig) *MalConfig { return cfg }, query)
+}
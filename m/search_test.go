@@ -0,0 +1,60 @@
+package m
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	index := &MalsYaml{Mals: []*MalConfig{
+		{Name: "scanner", Description: "port scanner", Tags: []string{"Recon", "network"}, Author: "alice"},
+		{Name: "netscan", Description: "scan the local network", Tags: []string{"recon"}, OS: []string{"windows"}, Arch: []string{"x64"}},
+		{Name: "dumper", Description: "credential dumper", Tags: []string{"creds"}, OS: []string{"Windows", "linux"}, MinHostVersion: "v2.0.0"},
+		{Name: "futuristic", Help: "needs a newer client", MinHostVersion: "v3.0.0"},
+	}}
+	for name, tc := range map[string]struct {
+		query    SearchQuery
+		expected string
+	}{
+		"all":              {expected: "dumper,futuristic,netscan,scanner"},
+		"name before desc": {query: SearchQuery{Keyword: "scan"}, expected: "scanner,netscan"},
+		"every keyword":    {query: SearchQuery{Keyword: "SCAN network"}, expected: "scanner,netscan"},
+		"help":             {query: SearchQuery{Keyword: "newer"}, expected: "futuristic"},
+		"no match":         {query: SearchQuery{Keyword: "scan creds"}},
+		"tags":             {query: SearchQuery{Tags: []string{"recon", "NETWORK"}}, expected: "scanner"},
+		"author":           {query: SearchQuery{Author: "Alice"}, expected: "scanner"},
+		// 没有声明平台的 mal 支持所有平台
+		"os alias":   {query: SearchQuery{OS: "win"}, expected: "dumper,futuristic,netscan,scanner"},
+		"os":         {query: SearchQuery{OS: "darwin"}, expected: "futuristic,scanner"},
+		"arch alias": {query: SearchQuery{OS: "windows", Arch: "x86_64"}, expected: "dumper,futuristic,netscan,scanner"},
+		"arch":       {query: SearchQuery{Arch: "arm64"}, expected: "dumper,futuristic,scanner"},
+		"host":       {query: SearchQuery{HostVersion: "2.1.0"}, expected: "dumper,netscan,scanner"},
+		"old host":   {query: SearchQuery{HostVersion: "v1.9.0"}, expected: "netscan,scanner"},
+		// 无法解析的客户端版本不做限制
+		"dev host": {query: SearchQuery{HostVersion: "dev"}, expected: "dumper,futuristic,netscan,scanner"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var names []string
+			for _, cfg := range index.Search(tc.query) {
+				names = append(names, cfg.Name)
+			}
+			if got := strings.Join(names, ","); got != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestCatalogTags(t *testing.T) {
+	catalog := &Catalog{Mals: []*CatalogMal{
+		{MalConfig: MalConfig{Name: "a", Tags: []string{"Recon", "recon", "network"}}},
+		{MalConfig: MalConfig{Name: "b", Tags: []string{"RECON"}}},
+	}}
+	tags := catalog.Tags()
+	if len(tags) != 2 || tags["recon"] != 2 || tags["network"] != 1 {
+		t.Fatalf("unexpected tags %v", tags)
+	}
+	if mals := catalog.Query(SearchQuery{Tags: []string{"network"}}); len(mals) != 1 || mals[0].Name != "a" {
+		t.Fatalf("unexpected query result %v", mals)
+	}
+}
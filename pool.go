@@ -0,0 +1,337 @@
+package mals
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// VMPoolOptions 配置 VMPool
+type VMPoolOptions struct {
+	// MaxSize 为同时存在的 VM 数量上限, 达到上限后 Get 会等待, 0 表示不限制
+	MaxSize int
+	// IdleTimeout 大于 0 时, 空闲超过该时间的 VM 会被关闭
+	IdleTimeout time.Duration
+	// Registry 中的包会预加载到每个 VM
+	Registry *Registry
+	// VMOptions 传给 NewLuaVM, 如 WithSandbox
+	VMOptions []VMOption
+	// Init 在 VM 创建后执行, 用于注册额外的库或 protobuf message
+	Init func(L *lua.LState) error
+}
+
+// VMPoolMetrics 是 VMPool 的运行统计
+type VMPoolMetrics struct {
+	Total   int // 当前存在的 VM 数量
+	Idle    int // 空闲的 VM 数量
+	InUse   int // 正在使用的 VM 数量
+	Waiting int // 等待空闲 VM 的调用数量
+
+	Created uint64 // 累计创建的 VM 数量
+	Evicted uint64 // 累计因空闲超时关闭的 VM 数量
+	Gets    uint64 // 累计 Get 次数
+	Hits    uint64 // 累计复用空闲 VM 的次数
+}
+
+type pooledVM struct {
+	L *lua.LState
+	// tables 为创建时可以从全局变量, registry 与内置元表访问到的所有表的内容
+	tables     map[*lua.LTable]map[lua.LValue]lua.LValue
+	metatables map[*lua.LTable]lua.LValue
+	lastUsed   time.Time
+}
+
+// VMPool 管理一组预加载了库与注册包的 lua.LState.
+// lua.LState 不是并发安全的, 每次 Get 得到的 VM 只能在一个 goroutine 中使用, 用完后通过 Put 归还,
+// 归还时会恢复创建时所有可访问的表 (全局变量, 已加载模块, string 等内置库) 的内容与元表, 避免脚本之间互相影响.
+type VMPool struct {
+	opts VMPoolOptions
+
+	mu      sync.Mutex
+	idle    []*pooledVM
+	inUse   map[*lua.LState]*pooledVM
+	slots   chan struct{}
+	closed  bool
+	done    chan struct{}
+	metrics VMPoolMetrics
+}
+
+func NewVMPool(opts VMPoolOptions) *VMPool {
+	p := &VMPool{
+		opts:  opts,
+		inUse: make(map[*lua.LState]*pooledVM),
+		done:  make(chan struct{}),
+	}
+	if opts.MaxSize > 0 {
+		p.slots = make(chan struct{}, opts.MaxSize)
+	}
+	if opts.IdleTimeout > 0 {
+		go p.janitor()
+	}
+	return p
+}
+
+func (p *VMPool) newVM() (*pooledVM, error) {
+	L := NewLuaVM(p.opts.VMOptions...)
+	if p.opts.Registry != nil {
+		p.opts.Registry.Preload(L)
+	}
+	if p.opts.Init != nil {
+		if err := p.opts.Init(L); err != nil {
+			L.Close()
+			return nil, err
+		}
+	}
+	vm := &pooledVM{L: L}
+	vm.snapshot()
+	return vm, nil
+}
+
+// Get 取出一个空闲 VM, 没有空闲 VM 时创建新的, 达到 MaxSize 时等待直到 ctx 结束
+func (p *VMPool) Get(ctx context.Context) (*lua.LState, error) {
+	if p.slots != nil {
+		p.mu.Lock()
+		p.metrics.Waiting++
+		p.mu.Unlock()
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			p.mu.Lock()
+			p.metrics.Waiting--
+			p.mu.Unlock()
+			return nil, ctx.Err()
+		case <-p.done:
+			p.mu.Lock()
+			p.metrics.Waiting--
+			p.mu.Unlock()
+			return nil, fmt.Errorf("vm pool closed")
+		}
+		p.mu.Lock()
+		p.metrics.Waiting--
+		p.mu.Unlock()
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.releaseSlot()
+		return nil, fmt.Errorf("vm pool closed")
+	}
+	p.metrics.Gets++
+	if n := len(p.idle); n > 0 {
+		vm := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.inUse[vm.L] = vm
+		p.metrics.Hits++
+		p.mu.Unlock()
+		vm.L.SetContext(ctx)
+		return vm.L, nil
+	}
+	p.mu.Unlock()
+
+	vm, err := p.newVM()
+	if err != nil {
+		p.releaseSlot()
+		return nil, err
+	}
+	p.mu.Lock()
+	p.inUse[vm.L] = vm
+	p.metrics.Created++
+	p.mu.Unlock()
+	vm.L.SetContext(ctx)
+	return vm.L, nil
+}
+
+// Put 归还 Get 得到的 VM, 池已关闭时直接关闭 VM
+func (p *VMPool) Put(L *lua.LState) {
+	p.mu.Lock()
+	vm, ok := p.inUse[L]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.inUse, L)
+	closed := p.closed
+	p.mu.Unlock()
+	defer p.releaseSlot()
+
+	if closed {
+		L.Close()
+		return
+	}
+	vm.reset()
+	vm.lastUsed = time.Now()
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		L.Close()
+		return
+	}
+	p.idle = append(p.idle, vm)
+	p.mu.Unlock()
+}
+
+// Discard 关闭 VM 而不放回池中, 用于脚本出错后状态不可信的情况
+func (p *VMPool) Discard(L *lua.LState) {
+	p.mu.Lock()
+	_, ok := p.inUse[L]
+	delete(p.inUse, L)
+	p.mu.Unlock()
+	if ok {
+		L.Close()
+		p.releaseSlot()
+	}
+}
+
+// Do 取出一个 VM 执行 fn 后归还
+func (p *VMPool) Do(ctx context.Context, fn func(L *lua.LState) error) error {
+	L, err := p.Get(ctx)
+	if err != nil {
+		return err
+	}
+	defer p.Put(L)
+	return fn(L)
+}
+
+// Metrics 返回当前的统计信息
+func (p *VMPool) Metrics() VMPoolMetrics {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	metrics := p.metrics
+	metrics.Idle = len(p.idle)
+	metrics.InUse = len(p.inUse)
+	metrics.Total = metrics.Idle + metrics.InUse
+	return metrics
+}
+
+// Close 关闭所有空闲 VM 并唤醒等待中的 Get, 正在使用的 VM 会在 Put 时关闭
+func (p *VMPool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	close(p.done)
+	p.mu.Unlock()
+
+	for _, vm := range idle {
+		vm.L.Close()
+	}
+}
+
+func (p *VMPool) releaseSlot() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+func (p *VMPool) janitor() {
+	interval := p.opts.IdleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.evictIdle()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *VMPool) evictIdle() {
+	deadline := time.Now().Add(-p.opts.IdleTimeout)
+	var evicted []*pooledVM
+	p.mu.Lock()
+	idle := p.idle[:0]
+	for _, vm := range p.idle {
+		if vm.lastUsed.Before(deadline) {
+			evicted = append(evicted, vm)
+		} else {
+			idle = append(idle, vm)
+		}
+	}
+	p.idle = idle
+	p.metrics.Evicted += uint64(len(evicted))
+	p.mu.Unlock()
+
+	for _, vm := range evicted {
+		vm.L.Close()
+	}
+}
+
+// reset 清空栈与 context, 将创建时可访问的所有表恢复为快照中的内容与元表.
+// 脚本创建的表随引用它们的表一起被丢弃, 对 string, table 等内置库及已加载模块的修改都会被撤销
+func (vm *pooledVM) reset() {
+	L := vm.L
+	L.SetTop(0)
+	L.RemoveContext()
+	L.SetField(L.Get(lua.RegistryIndex), contextRegistryKey, lua.LNil)
+	for tbl, entries := range vm.tables {
+		restoreTable(tbl, entries)
+		tbl.Metatable = vm.metatables[tbl]
+	}
+}
+
+// snapshot 记录从全局变量, registry (包含 package.loaded 与类型元表) 和 string 元表可以访问到的所有表
+func (vm *pooledVM) snapshot() {
+	L := vm.L
+	vm.tables = make(map[*lua.LTable]map[lua.LValue]lua.LValue)
+	vm.metatables = make(map[*lua.LTable]lua.LValue)
+	var walk func(value lua.LValue)
+	walk = func(value lua.LValue) {
+		tbl, ok := value.(*lua.LTable)
+		if !ok {
+			return
+		}
+		if _, ok := vm.tables[tbl]; ok {
+			return
+		}
+		entries := snapshotTable(tbl)
+		vm.tables[tbl] = entries
+		vm.metatables[tbl] = tbl.Metatable
+		for key, value := range entries {
+			walk(key)
+			walk(value)
+		}
+		walk(tbl.Metatable)
+	}
+	walk(L.G.Global)
+	walk(L.Get(lua.RegistryIndex))
+	walk(L.GetMetatable(lua.LString("")))
+}
+
+func snapshotTable(tbl *lua.LTable) map[lua.LValue]lua.LValue {
+	snapshot := make(map[lua.LValue]lua.LValue)
+	tbl.ForEach(func(key, value lua.LValue) {
+		snapshot[key] = value
+	})
+	return snapshot
+}
+
+func restoreTable(tbl *lua.LTable, snapshot map[lua.LValue]lua.LValue) {
+	var added []lua.LValue
+	tbl.ForEach(func(key, value lua.LValue) {
+		if _, ok := snapshot[key]; !ok {
+			added = append(added, key)
+		}
+	})
+	for _, key := range added {
+		tbl.RawSet(key, lua.LNil)
+	}
+	for key, value := range snapshot {
+		if tbl.RawGet(key) != value {
+			tbl.RawSet(key, value)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package mals
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestVMPoolIsolation(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register(newTestFunction("m", "hello", func() string { return "hello" })); err != nil {
+		t.Fatal(err)
+	}
+	for name, tc := range map[string]struct {
+		dirty, check string
+	}{
+		"global":          {dirty: `leaked = 1`, check: `assert(leaked == nil)`},
+		"overwritten":     {dirty: `print = nil`, check: `assert(print ~= nil)`},
+		"builtin library": {dirty: `string.upper = function() return "x" end`, check: `assert(string.upper("a") == "A")`},
+		"string metatable": {
+			dirty: `getmetatable("").__index = {len = function() return -1 end}`,
+			check: `assert(("abc"):len() == 3)`,
+		},
+		"global metatable": {
+			dirty: `setmetatable(_G, {__index = function() return 1 end})`,
+			check: `assert(missing == nil)`,
+		},
+		"loaded module": {dirty: `require("m").hello = nil`, check: `assert(require("m").hello() == "hello")`},
+		"package.loaded": {
+			dirty: `package.loaded.json = {encode = function() return "x" end}`,
+			check: `assert(require("json").encode({}) == "[]")`,
+		},
+		"registry context": {
+			dirty: `context.with_timeout(1, error, "boom")`,
+			check: `assert(context.remaining() == nil)`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			pool := NewVMPool(VMPoolOptions{MaxSize: 1, Registry: r})
+			defer pool.Close()
+			ctx := context.Background()
+			_ = pool.Do(ctx, func(L *lua.LState) error {
+				return L.DoString(`local context = require("context")` + "\n" + tc.dirty)
+			})
+			if err := pool.Do(ctx, func(L *lua.LState) error {
+				return L.DoString(`local context = require("context")` + "\n" + tc.check)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if metrics := pool.Metrics(); metrics.Created != 1 || metrics.Hits != 1 {
+				t.Fatalf("expected the vm to be reused, got %+v", metrics)
+			}
+		})
+	}
+}
+
+func TestVMPoolMaxSize(t *testing.T) {
+	pool := NewVMPool(VMPoolOptions{MaxSize: 1})
+	defer pool.Close()
+
+	L, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Get to wait for a free vm, got %v", err)
+	}
+
+	// Discard 释放名额, 之后创建新的 VM
+	pool.Discard(L)
+	other, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == L {
+		t.Fatal("discarded vm returned by Get")
+	}
+	pool.Put(other)
+	if metrics := pool.Metrics(); metrics.Created != 2 || metrics.Idle != 1 || metrics.InUse != 0 {
+		t.Fatalf("unexpected metrics %+v", metrics)
+	}
+
+	pool.Close()
+	if _, err := pool.Get(context.Background()); err == nil {
+		t.Fatal("expected Get on a closed pool to fail")
+	}
+}
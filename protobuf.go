@@ -0,0 +1,798 @@
+package mals
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chainreactors/utils/iutils"
+	lua "github.com/yuin/gopher-lua"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	luar "layeh.com/gopher-luar"
+)
+
+const (
+	ProtobufMessageTypeName = "ProtobufMessage"
+	ProtobufListTypeName    = "ProtobufList"
+	ProtobufMapTypeName     = "ProtobufMap"
+)
+
+// NewProtoMessageFromValue 根据 lua 转换得到的 map 创建 t 类型的 message, t 为生成代码的指针类型
+func NewProtoMessageFromValue(t reflect.Type, value interface{}) (proto.Message, error) {
+	if t.Kind() != reflect.Ptr || !t.Implements(protoMessageType) {
+		return nil, fmt.Errorf("%s is not a proto.Message", t)
+	}
+	msg := reflect.New(t.Elem()).Interface().(proto.Message)
+	if err := SetProtoMessage(msg.ProtoReflect(), value); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// SetProtoMessage 将 value 写入 msg, value 可以是同类型的 message 或者字段名到值的 map.
+// 字段名支持 proto 名, json 名以及 Go 字段名, 嵌套 message, repeated, map, enum 名称与 oneof 均会递归处理
+func SetProtoMessage(msg protoreflect.Message, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case proto.Message:
+		src := v.ProtoReflect()
+		if src.Descriptor().FullName() != msg.Descriptor().FullName() {
+			return fmt.Errorf("cannot use %s as %s", src.Descriptor().FullName(), msg.Descriptor().FullName())
+		}
+		proto.Merge(msg.Interface(), v)
+		return nil
+	case map[string]interface{}:
+		for name, fieldValue := range v {
+			if err := SetProtoField(msg, name, fieldValue); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		// 空的 lua table 会被识别为数组
+		if len(v) == 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot convert %T to %s", value, msg.Descriptor().FullName())
+}
+
+// FindProtoField 按 proto 名, json 名或 Go 字段名查找字段
+func FindProtoField(md protoreflect.MessageDescriptor, name string) protoreflect.FieldDescriptor {
+	fields := md.Fields()
+	if fd := fields.ByName(protoreflect.Name(name)); fd != nil {
+		return fd
+	}
+	if fd := fields.ByJSONName(name); fd != nil {
+		return fd
+	}
+	// Go 字段名, 如 TaskId -> task_id
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if strings.EqualFold(strings.ReplaceAll(string(fd.Name()), "_", ""), name) {
+			return fd
+		}
+	}
+	return nil
+}
+
+// SetProtoField 设置单个字段, value 为 nil 时清空字段
+func SetProtoField(msg protoreflect.Message, name string, value interface{}) error {
+	fd := FindProtoField(msg.Descriptor(), name)
+	if fd == nil {
+		return fmt.Errorf("%s has no field %s", msg.Descriptor().FullName(), name)
+	}
+	if value == nil {
+		msg.Clear(fd)
+		return nil
+	}
+	val, err := protoFieldValue(msg, fd, value)
+	if err != nil {
+		return fmt.Errorf("%s.%s: %v", msg.Descriptor().FullName(), fd.Name(), err)
+	}
+	msg.Set(fd, val)
+	return nil
+}
+
+func protoFieldValue(msg protoreflect.Message, fd protoreflect.FieldDescriptor, value interface{}) (protoreflect.Value, error) {
+	switch {
+	case fd.IsList():
+		if v, ok := value.(*ProtoList); ok {
+			value = v.Values()
+		}
+		items, ok := value.([]interface{})
+		if !ok {
+			if rv := reflect.ValueOf(value); rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() != reflect.Uint8 {
+				items = make([]interface{}, rv.Len())
+				for i := range items {
+					items[i] = rv.Index(i).Interface()
+				}
+			} else {
+				return protoreflect.Value{}, fmt.Errorf("expected list, got %T", value)
+			}
+		}
+		list := msg.NewField(fd).List()
+		for i, item := range items {
+			elem, err := protoSingularValue(list.NewElement, fd, item)
+			if err != nil {
+				return protoreflect.Value{}, fmt.Errorf("index %d: %v", i+1, err)
+			}
+			list.Append(elem)
+		}
+		return protoreflect.ValueOfList(list), nil
+	case fd.IsMap():
+		if v, ok := value.(*ProtoMap); ok {
+			value = v.Values()
+		}
+		entries, ok := value.(map[string]interface{})
+		if !ok {
+			// 键为 1..n 的 lua table 会被转换为数组, 按 map 字段的定义还原为以下标为键的 map
+			items, isList := value.([]interface{})
+			if !isList {
+				return protoreflect.Value{}, fmt.Errorf("expected map, got %T", value)
+			}
+			entries = make(map[string]interface{}, len(items))
+			for i, item := range items {
+				entries[strconv.Itoa(i+1)] = item
+			}
+		}
+		m := msg.NewField(fd).Map()
+		for k, v := range entries {
+			key, err := protoMapKey(fd.MapKey(), k)
+			if err != nil {
+				return protoreflect.Value{}, err
+			}
+			val, err := protoSingularValue(m.NewValue, fd.MapValue(), v)
+			if err != nil {
+				return protoreflect.Value{}, fmt.Errorf("key %s: %v", k, err)
+			}
+			m.Set(key, val)
+		}
+		return protoreflect.ValueOfMap(m), nil
+	default:
+		return protoSingularValue(func() protoreflect.Value { return msg.NewField(fd) }, fd, value)
+	}
+}
+
+func protoMapKey(fd protoreflect.FieldDescriptor, key interface{}) (protoreflect.MapKey, error) {
+	val, err := protoScalarValue(fd, key)
+	if err != nil {
+		return protoreflect.MapKey{}, fmt.Errorf("map key %v: %v", key, err)
+	}
+	return val.MapKey(), nil
+}
+
+// protoSingularValue 转换单个值, newMessage 用于创建嵌套 message
+func protoSingularValue(newMessage func() protoreflect.Value, fd protoreflect.FieldDescriptor, value interface{}) (protoreflect.Value, error) {
+	if fd.Kind() != protoreflect.MessageKind && fd.Kind() != protoreflect.GroupKind {
+		return protoScalarValue(fd, value)
+	}
+	val := newMessage()
+	if ok, err := setWellKnownMessage(val.Message(), value); ok {
+		return val, err
+	}
+	if err := SetProtoMessage(val.Message(), value); err != nil {
+		return protoreflect.Value{}, err
+	}
+	return val, nil
+}
+
+// setWellKnownMessage 处理 Timestamp, Duration 与 Any 的简写形式:
+// Timestamp 接受 unix 秒数或 RFC3339 字符串, Duration 接受秒数或 "1m30s", Any 接受任意 message
+func setWellKnownMessage(msg protoreflect.Message, value interface{}) (bool, error) {
+	fields := msg.Descriptor().Fields()
+	switch msg.Descriptor().FullName() {
+	case "google.protobuf.Timestamp":
+		var t time.Time
+		switch v := value.(type) {
+		case string:
+			parsed, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return true, err
+			}
+			t = parsed
+		case int64, float64:
+			f, _ := toFloat64(v)
+			sec, frac := math.Modf(f)
+			t = time.Unix(int64(sec), int64(frac*1e9))
+		default:
+			return false, nil
+		}
+		msg.Set(fields.ByName("seconds"), protoreflect.ValueOfInt64(t.Unix()))
+		msg.Set(fields.ByName("nanos"), protoreflect.ValueOfInt32(int32(t.Nanosecond())))
+		return true, nil
+	case "google.protobuf.Duration":
+		var d time.Duration
+		switch v := value.(type) {
+		case string:
+			parsed, err := time.ParseDuration(v)
+			if err != nil {
+				return true, err
+			}
+			d = parsed
+		case int64, float64:
+			f, _ := toFloat64(v)
+			d = time.Duration(f * float64(time.Second))
+		default:
+			return false, nil
+		}
+		msg.Set(fields.ByName("seconds"), protoreflect.ValueOfInt64(int64(d/time.Second)))
+		msg.Set(fields.ByName("nanos"), protoreflect.ValueOfInt32(int32(d%time.Second)))
+		return true, nil
+	case "google.protobuf.Any":
+		v, ok := value.(proto.Message)
+		if !ok || v.ProtoReflect().Descriptor().FullName() == "google.protobuf.Any" {
+			return false, nil
+		}
+		data, err := proto.Marshal(v)
+		if err != nil {
+			return true, err
+		}
+		msg.Set(fields.ByName("type_url"), protoreflect.ValueOfString("type.googleapis.com/"+string(v.ProtoReflect().Descriptor().FullName())))
+		msg.Set(fields.ByName("value"), protoreflect.ValueOfBytes(data))
+		return true, nil
+	}
+	return false, nil
+}
+
+func protoScalarValue(fd protoreflect.FieldDescriptor, value interface{}) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		switch v := value.(type) {
+		case bool:
+			return protoreflect.ValueOfBool(v), nil
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return protoreflect.Value{}, err
+			}
+			return protoreflect.ValueOfBool(b), nil
+		}
+	case protoreflect.StringKind:
+		if s, ok := value.(string); ok {
+			return protoreflect.ValueOfString(s), nil
+		}
+		return protoreflect.ValueOfString(iutils.ToString(value)), nil
+	case protoreflect.BytesKind:
+		switch v := value.(type) {
+		case string:
+			return protoreflect.ValueOfBytes([]byte(v)), nil
+		case []byte:
+			return protoreflect.ValueOfBytes(v), nil
+		}
+	case protoreflect.EnumKind:
+		switch v := value.(type) {
+		case string:
+			if ev := fd.Enum().Values().ByName(protoreflect.Name(v)); ev != nil {
+				return protoreflect.ValueOfEnum(ev.Number()), nil
+			}
+			return protoreflect.Value{}, fmt.Errorf("unknown enum value %s of %s", v, fd.Enum().FullName())
+		default:
+			n, err := toInt64(value)
+			if err != nil {
+				return protoreflect.Value{}, err
+			}
+			return protoreflect.ValueOfEnum(protoreflect.EnumNumber(n)), nil
+		}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		n, err := toInt64(value)
+		if err != nil {
+			return protoreflect.Value{}, err
+		}
+		if n < math.MinInt32 || n > math.MaxInt32 {
+			return protoreflect.Value{}, fmt.Errorf("%d overflows int32", n)
+		}
+		return protoreflect.ValueOfInt32(int32(n)), nil
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		n, err := toInt64(value)
+		if err != nil {
+			return protoreflect.Value{}, err
+		}
+		return protoreflect.ValueOfInt64(n), nil
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		n, err := toInt64(value)
+		if err != nil {
+			return protoreflect.Value{}, err
+		}
+		if n < 0 || n > math.MaxUint32 {
+			return protoreflect.Value{}, fmt.Errorf("%d overflows uint32", n)
+		}
+		return protoreflect.ValueOfUint32(uint32(n)), nil
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		n, err := toInt64(value)
+		if err != nil {
+			return protoreflect.Value{}, err
+		}
+		if n < 0 {
+			return protoreflect.Value{}, fmt.Errorf("%d overflows uint64", n)
+		}
+		return protoreflect.ValueOfUint64(uint64(n)), nil
+	case protoreflect.FloatKind:
+		f, err := toFloat64(value)
+		if err != nil {
+			return protoreflect.Value{}, err
+		}
+		return protoreflect.ValueOfFloat32(float32(f)), nil
+	case protoreflect.DoubleKind:
+		f, err := toFloat64(value)
+		if err != nil {
+			return protoreflect.Value{}, err
+		}
+		return protoreflect.ValueOfFloat64(f), nil
+	}
+	return protoreflect.Value{}, fmt.Errorf("cannot convert %T to %s", value, fd.Kind())
+}
+
+func toInt64(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, fmt.Errorf("%v is not an integer", v)
+		}
+		return int64(v), nil
+	case string:
+		return strconv.ParseInt(v, 0, 64)
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), nil
+	}
+	return 0, fmt.Errorf("cannot convert %T to integer", value)
+}
+
+func toFloat64(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	n, err := toInt64(value)
+	if err != nil {
+		return 0, fmt.Errorf("cannot convert %T to number", value)
+	}
+	return float64(n), nil
+}
+
+// ProtoList 是 repeated 字段在 lua 中的视图, 修改会直接写回所属 message
+type ProtoList struct {
+	List  protoreflect.List
+	Field protoreflect.FieldDescriptor
+	// owner 不为 nil 时 List 是只读的, 第一次修改时才通过 Mutable 取得可写的列表, 只读取不会让字段变为已设置
+	owner protoreflect.Message
+}
+
+// mutable 返回可以修改的列表
+func (l *ProtoList) mutable() protoreflect.List {
+	if l.owner != nil {
+		l.List = l.owner.Mutable(l.Field).List()
+		l.owner = nil
+	}
+	return l.List
+}
+
+// Values 返回列表元素的 Go 值
+func (l *ProtoList) Values() []interface{} {
+	values := make([]interface{}, l.List.Len())
+	for i := range values {
+		values[i] = protoValueInterface(l.Field, l.List.Get(i))
+	}
+	return values
+}
+
+// ProtoMap 是 map 字段在 lua 中的视图, 修改会直接写回所属 message
+type ProtoMap struct {
+	Map   protoreflect.Map
+	Field protoreflect.FieldDescriptor
+	// owner 与 ProtoList.owner 相同, 第一次修改时才调用 Mutable
+	owner protoreflect.Message
+}
+
+// mutable 返回可以修改的 map
+func (m *ProtoMap) mutable() protoreflect.Map {
+	if m.owner != nil {
+		m.Map = m.owner.Mutable(m.Field).Map()
+		m.owner = nil
+	}
+	return m.Map
+}
+
+// Values 返回 map 的 Go 值, key 统一转换为字符串
+func (m *ProtoMap) Values() map[string]interface{} {
+	values := make(map[string]interface{}, m.Map.Len())
+	m.Map.Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+		values[k.String()] = protoValueInterface(m.Field.MapValue(), v)
+		return true
+	})
+	return values
+}
+
+func protoValueInterface(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return v.Message().Interface()
+	case protoreflect.EnumKind:
+		return int64(v.Enum())
+	default:
+		return v.Interface()
+	}
+}
+
+// NewLuaProtoMessage 将 message 封装为带 ProtobufMessage 元表的 userdata
+func NewLuaProtoMessage(L *lua.LState, msg proto.Message) lua.LValue {
+	if rv := reflect.ValueOf(msg); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return lua.LNil
+	}
+	mt := L.GetTypeMetatable(ProtobufMessageTypeName)
+	if mt == lua.LNil {
+		RegisterProtobufMessageType(L)
+		mt = L.GetTypeMetatable(ProtobufMessageTypeName)
+	}
+	ud := L.NewUserData()
+	ud.Value = msg
+	L.SetMetatable(ud, mt)
+	return ud
+}
+
+func newLuaProtoContainer(L *lua.LState, container interface{}) lua.LValue {
+	if L.GetTypeMetatable(ProtobufListTypeName) == lua.LNil {
+		RegisterProtobufContainerTypes(L)
+	}
+	ud := L.NewUserData()
+	ud.Value = container
+	switch container.(type) {
+	case *ProtoList:
+		L.SetMetatable(ud, L.GetTypeMetatable(ProtobufListTypeName))
+	case *ProtoMap:
+		L.SetMetatable(ud, L.GetTypeMetatable(ProtobufMapTypeName))
+	}
+	return ud
+}
+
+// ProtoValueToLua 将单个 protobuf 值转换为 lua 值, enum 返回名称, Timestamp 与 Duration 返回秒数, Any 自动解包
+func ProtoValueToLua(L *lua.LState, fd protoreflect.FieldDescriptor, v protoreflect.Value) lua.LValue {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return lua.LBool(v.Bool())
+	case protoreflect.StringKind:
+		return lua.LString(v.String())
+	case protoreflect.BytesKind:
+		return lua.LString(v.Bytes())
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return lua.LString(ev.Name())
+		}
+		return lua.LNumber(v.Enum())
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return lua.LNumber(v.Int())
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return lua.LNumber(v.Uint())
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return lua.LNumber(v.Float())
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return protoMessageToLua(L, v.Message())
+	}
+	return lua.LNil
+}
+
+func protoMessageToLua(L *lua.LState, msg protoreflect.Message) lua.LValue {
+	fields := msg.Descriptor().Fields()
+	switch msg.Descriptor().FullName() {
+	case "google.protobuf.Timestamp", "google.protobuf.Duration":
+		seconds := msg.Get(fields.ByName("seconds")).Int()
+		nanos := msg.Get(fields.ByName("nanos")).Int()
+		return lua.LNumber(float64(seconds) + float64(nanos)/1e9)
+	case "google.protobuf.Any":
+		typeURL := msg.Get(fields.ByName("type_url")).String()
+		if mt, err := FindProtoMessageTypeByURL(typeURL); err == nil {
+			inner := mt.New()
+			if err := proto.Unmarshal(msg.Get(fields.ByName("value")).Bytes(), inner.Interface()); err == nil {
+				return NewLuaProtoMessage(L, inner.Interface())
+			}
+		}
+	}
+	return NewLuaProtoMessage(L, msg.Interface())
+}
+
+// protoFieldToLua 读取字段, 未设置的 message 字段返回 nil, repeated 与 map 返回可修改的视图
+func protoFieldToLua(L *lua.LState, msg protoreflect.Message, fd protoreflect.FieldDescriptor) lua.LValue {
+	switch {
+	case fd.IsList():
+		return newLuaProtoContainer(L, &ProtoList{List: msg.Get(fd).List(), Field: fd, owner: msg})
+	case fd.IsMap():
+		return newLuaProtoContainer(L, &ProtoMap{Map: msg.Get(fd).Map(), Field: fd, owner: msg})
+	case fd.HasPresence() && !msg.Has(fd):
+		return lua.LNil
+	default:
+		return ProtoValueToLua(L, fd, msg.Get(fd))
+	}
+}
+
+func checkProtoMessage(L *lua.LState, n int) proto.Message {
+	ud := L.CheckUserData(n)
+	if msg, ok := ud.Value.(proto.Message); ok {
+		return msg
+	}
+	L.ArgError(n, "ProtobufMessage expected")
+	return nil
+}
+
+// __index 元方法：获取 Protobuf 消息的字段值, oneof 名称返回当前设置的字段名, 未知名称回退到 Go 方法
+func protoIndex(L *lua.LState) int {
+	msg := checkProtoMessage(L, 1)
+	name := L.CheckString(2)
+	m := msg.ProtoReflect()
+
+	if fd := FindProtoField(m.Descriptor(), name); fd != nil {
+		L.Push(protoFieldToLua(L, m, fd))
+		return 1
+	}
+	if od := m.Descriptor().Oneofs().ByName(protoreflect.Name(name)); od != nil {
+		if fd := m.WhichOneof(od); fd != nil {
+			L.Push(lua.LString(fd.Name()))
+		} else {
+			L.Push(lua.LNil)
+		}
+		return 1
+	}
+	if method := reflect.ValueOf(msg).MethodByName(name); method.IsValid() {
+		L.Push(L.GetField(luar.New(L, msg), name))
+		return 1
+	}
+	L.RaiseError("%s has no field %s", m.Descriptor().FullName(), name)
+	return 0
+}
+
+// __newindex 元方法：设置 Protobuf 消息的字段值
+func protoNewIndex(L *lua.LState) int {
+	msg := checkProtoMessage(L, 1)
+	if err := SetProtoField(msg.ProtoReflect(), L.CheckString(2), ConvertLuaValueToGo(L.Get(3))); err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+	return 0
+}
+
+// RegisterProtobufContainerTypes 注册 repeated 与 map 字段视图的元表
+//
+//	msg.tasks:append(task); #msg.tasks; for i, task in msg.tasks:iter() do ... end
+//	msg.labels.key = "value"; for k, v in msg.labels:iter() do ... end
+func RegisterProtobufContainerTypes(L *lua.LState) {
+	listMethods := map[string]lua.LGFunction{
+		"append":  protoListAppend,
+		"len":     protoContainerLen,
+		"iter":    protoListIter,
+		"totable": protoContainerToTable,
+	}
+	mt := L.NewTypeMetatable(ProtobufListTypeName)
+	L.SetField(mt, "__index", L.NewFunction(func(L *lua.LState) int {
+		list := checkProtoList(L)
+		if key, ok := L.Get(2).(lua.LString); ok {
+			if method, ok := listMethods[string(key)]; ok {
+				L.Push(L.NewFunction(method))
+				return 1
+			}
+		}
+		i := L.CheckInt(2)
+		if i < 1 || i > list.List.Len() {
+			L.Push(lua.LNil)
+			return 1
+		}
+		L.Push(ProtoValueToLua(L, list.Field, list.List.Get(i-1)))
+		return 1
+	}))
+	L.SetField(mt, "__newindex", L.NewFunction(protoListNewIndex))
+	L.SetField(mt, "__len", L.NewFunction(protoContainerLen))
+	L.SetField(mt, "__tostring", L.NewFunction(protoContainerToString))
+
+	mapMethods := map[string]lua.LGFunction{
+		"len":     protoContainerLen,
+		"iter":    protoMapIter,
+		"keys":    protoMapKeys,
+		"totable": protoContainerToTable,
+	}
+	mt = L.NewTypeMetatable(ProtobufMapTypeName)
+	L.SetField(mt, "__index", L.NewFunction(func(L *lua.LState) int {
+		m := checkProtoMap(L)
+		key, err := protoMapKey(m.Field.MapKey(), ConvertLuaValueToGo(L.CheckAny(2)))
+		if err == nil && m.Map.Has(key) {
+			L.Push(ProtoValueToLua(L, m.Field.MapValue(), m.Map.Get(key)))
+			return 1
+		}
+		if name, ok := L.Get(2).(lua.LString); ok {
+			if method, ok := mapMethods[string(name)]; ok {
+				L.Push(L.NewFunction(method))
+				return 1
+			}
+		}
+		L.Push(lua.LNil)
+		return 1
+	}))
+	L.SetField(mt, "__newindex", L.NewFunction(protoMapNewIndex))
+	L.SetField(mt, "__len", L.NewFunction(protoContainerLen))
+	L.SetField(mt, "__tostring", L.NewFunction(protoContainerToString))
+}
+
+func checkProtoList(L *lua.LState) *ProtoList {
+	ud := L.CheckUserData(1)
+	if list, ok := ud.Value.(*ProtoList); ok {
+		return list
+	}
+	L.ArgError(1, "ProtobufList expected")
+	return nil
+}
+
+func checkProtoMap(L *lua.LState) *ProtoMap {
+	ud := L.CheckUserData(1)
+	if m, ok := ud.Value.(*ProtoMap); ok {
+		return m
+	}
+	L.ArgError(1, "ProtobufMap expected")
+	return nil
+}
+
+func protoListElement(L *lua.LState, list *ProtoList, n int) protoreflect.Value {
+	val, err := protoSingularValue(list.mutable().NewElement, list.Field, ConvertLuaValueToGo(L.Get(n)))
+	if err != nil {
+		L.ArgError(n, err.Error())
+	}
+	return val
+}
+
+func protoListAppend(L *lua.LState) int {
+	list := checkProtoList(L)
+	for i := 2; i <= L.GetTop(); i++ {
+		list.mutable().Append(protoListElement(L, list, i))
+	}
+	return 0
+}
+
+// list[i] = v, i 为 len+1 时追加
+func protoListNewIndex(L *lua.LState) int {
+	list := checkProtoList(L)
+	i := L.CheckInt(2)
+	switch {
+	case i >= 1 && i <= list.List.Len():
+		list.mutable().Set(i-1, protoListElement(L, list, 3))
+	case i == list.List.Len()+1:
+		list.mutable().Append(protoListElement(L, list, 3))
+	default:
+		L.ArgError(2, fmt.Sprintf("index %d out of range [1, %d]", i, list.List.Len()+1))
+	}
+	return 0
+}
+
+func protoListIter(L *lua.LState) int {
+	list := checkProtoList(L)
+	i := 0
+	L.Push(L.NewFunction(func(L *lua.LState) int {
+		if i >= list.List.Len() {
+			L.Push(lua.LNil)
+			return 1
+		}
+		i++
+		L.Push(lua.LNumber(i))
+		L.Push(ProtoValueToLua(L, list.Field, list.List.Get(i-1)))
+		return 2
+	}))
+	return 1
+}
+
+// m[k] = v, v 为 nil 时删除
+func protoMapNewIndex(L *lua.LState) int {
+	m := checkProtoMap(L)
+	key, err := protoMapKey(m.Field.MapKey(), ConvertLuaValueToGo(L.CheckAny(2)))
+	if err != nil {
+		L.ArgError(2, err.Error())
+	}
+	if L.Get(3) == lua.LNil {
+		if m.Map.Has(key) {
+			m.mutable().Clear(key)
+		}
+		return 0
+	}
+	val, err := protoSingularValue(m.mutable().NewValue, m.Field.MapValue(), ConvertLuaValueToGo(L.Get(3)))
+	if err != nil {
+		L.ArgError(3, err.Error())
+	}
+	m.mutable().Set(key, val)
+	return 0
+}
+
+func sortedProtoMapKeys(m *ProtoMap) []protoreflect.MapKey {
+	var keys []protoreflect.MapKey
+	m.Map.Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+		keys = append(keys, k)
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+	return keys
+}
+
+func protoMapIter(L *lua.LState) int {
+	m := checkProtoMap(L)
+	keys := sortedProtoMapKeys(m)
+	i := 0
+	L.Push(L.NewFunction(func(L *lua.LState) int {
+		for i < len(keys) {
+			key := keys[i]
+			i++
+			if !m.Map.Has(key) {
+				continue
+			}
+			L.Push(ProtoValueToLua(L, m.Field.MapKey(), key.Value()))
+			L.Push(ProtoValueToLua(L, m.Field.MapValue(), m.Map.Get(key)))
+			return 2
+		}
+		L.Push(lua.LNil)
+		return 1
+	}))
+	return 1
+}
+
+func protoMapKeys(L *lua.LState) int {
+	m := checkProtoMap(L)
+	tbl := L.NewTable()
+	for _, key := range sortedProtoMapKeys(m) {
+		tbl.Append(ProtoValueToLua(L, m.Field.MapKey(), key.Value()))
+	}
+	L.Push(tbl)
+	return 1
+}
+
+func protoContainerLen(L *lua.LState) int {
+	switch v := L.CheckUserData(1).Value.(type) {
+	case *ProtoList:
+		L.Push(lua.LNumber(v.List.Len()))
+	case *ProtoMap:
+		L.Push(lua.LNumber(v.Map.Len()))
+	default:
+		L.ArgError(1, "ProtobufList or ProtobufMap expected")
+	}
+	return 1
+}
+
+// totable 返回浅拷贝的 lua table, message 元素仍为 ProtobufMessage
+func protoContainerToTable(L *lua.LState) int {
+	tbl := L.NewTable()
+	switch v := L.CheckUserData(1).Value.(type) {
+	case *ProtoList:
+		for i := 0; i < v.List.Len(); i++ {
+			tbl.Append(ProtoValueToLua(L, v.Field, v.List.Get(i)))
+		}
+	case *ProtoMap:
+		v.Map.Range(func(k protoreflect.MapKey, val protoreflect.Value) bool {
+			tbl.RawSet(ProtoValueToLua(L, v.Field.MapKey(), k.Value()), ProtoValueToLua(L, v.Field.MapValue(), val))
+			return true
+		})
+	default:
+		L.ArgError(1, "ProtobufList or ProtobufMap expected")
+	}
+	L.Push(tbl)
+	return 1
+}
+
+func protoContainerToString(L *lua.LState) int {
+	switch v := L.CheckUserData(1).Value.(type) {
+	case *ProtoList:
+		L.Push(lua.LString(fmt.Sprintf("<%s: %s len=%d>", ProtobufListTypeName, v.Field.FullName(), v.List.Len())))
+	case *ProtoMap:
+		L.Push(lua.LString(fmt.Sprintf("<%s: %s len=%d>", ProtobufMapTypeName, v.Field.FullName(), v.Map.Len())))
+	default:
+		L.Push(lua.LString("<invalid protobuf container>"))
+	}
+	return 1
+}
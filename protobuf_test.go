@@ -0,0 +1,226 @@
+package mals
+
+import (
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	// 注册测试使用的 well-known 类型
+	_ "google.golang.org/protobuf/types/known/anypb"
+	_ "google.golang.org/protobuf/types/known/structpb"
+)
+
+// testDescriptorSet 返回 mals.test.Task 的 FileDescriptorSet, 包含 enum, repeated, map, 嵌套 message 与 well-known 类型字段
+func testDescriptorSet(t *testing.T) []byte {
+	field := func(name string, number int32, label descriptorpb.FieldDescriptorProto_Label, typ descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		fd := &descriptorpb.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(number), Label: label.Enum(), Type: typ.Enum()}
+		if typeName != "" {
+			fd.TypeName = proto.String(typeName)
+		}
+		return fd
+	}
+	optional, repeated := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL, descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+	message := descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+	file := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("mals/test/task.proto"),
+		Package:    proto.String("mals.test"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/any.proto", "google/protobuf/duration.proto", "google/protobuf/timestamp.proto"},
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("State"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("STATE_UNKNOWN"), Number: proto.Int32(0)},
+				{Name: proto.String("STATE_RUNNING"), Number: proto.Int32(1)},
+			},
+		}},
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Task"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("name", 1, optional, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+				field("tags", 2, repeated, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+				field("counts", 3, repeated, message, ".mals.test.Task.CountsEntry"),
+				field("state", 4, optional, descriptorpb.FieldDescriptorProto_TYPE_ENUM, ".mals.test.State"),
+				field("created", 5, optional, message, ".google.protobuf.Timestamp"),
+				field("ttl", 6, optional, message, ".google.protobuf.Duration"),
+				field("detail", 7, optional, message, ".google.protobuf.Any"),
+				field("children", 8, repeated, message, ".mals.test.Task"),
+			},
+			NestedType: []*descriptorpb.DescriptorProto{{
+				Name: proto.String("CountsEntry"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("key", 1, optional, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+					field("value", 2, optional, descriptorpb.FieldDescriptorProto_TYPE_INT64, ""),
+				},
+				Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+			}},
+		}},
+	}
+	data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestProtobufContainers(t *testing.T) {
+	for name, script := range map[string]string{
+		"map of messages": `
+			local s = ProtobufMessage.New("google.protobuf.Struct", {fields = {name = {string_value = "scan"}}})
+			assert(s.fields.name.string_value == "scan")
+			assert(s.fields.name.kind == "string_value")
+			s.fields.count = {number_value = 2}
+			assert(s.fields:len() == 2 and #s.fields == 2)
+			local keys = s.fields:keys()
+			assert(keys[1] == "count" and keys[2] == "name")
+			s.fields.name = nil
+			assert(s.fields:len() == 1 and s.fields.name == nil)
+			for k, v in s.fields:iter() do assert(k == "count" and v.number_value == 2) end
+			assert(s.fields:totable().count.number_value == 2)`,
+		"list of messages": `
+			local l = ProtobufMessage.New("google.protobuf.ListValue", {values = {{bool_value = true}}})
+			l.values:append({string_value = "a"}, {string_value = "b"})
+			l.values[4] = {number_value = 4}
+			l.values[1] = {null_value = "NULL_VALUE"}
+			assert(#l.values == 4 and l.values[5] == nil)
+			assert(l.values[1].kind == "null_value" and l.values[3].string_value == "b")
+			local n = 0
+			for i, v in l.values:iter() do n = n + i end
+			assert(n == 10 and #l.values:totable() == 4)
+			assert(not pcall(function() l.values[9] = {} end))`,
+		"library": `
+			local protobuf = require("protobuf")
+			local s = ProtobufMessage.New("google.protobuf.Struct", {fields = {a = {string_value = "x"}}})
+			local copy = protobuf.clone(s)
+			assert(protobuf.equal(s, copy))
+			copy.fields.b = {bool_value = true}
+			assert(not protobuf.equal(s, copy) and s.fields.b == nil)
+			local decoded = protobuf.unmarshal("google.protobuf.Struct", protobuf.marshal(copy))
+			assert(protobuf.equal(decoded, copy))
+			local parsed = protobuf.from_json("google.protobuf.Struct", protobuf.to_json(s))
+			assert(protobuf.equal(parsed, s))
+			-- table 中的字段整体替换, message 按 proto.Merge 合并
+			protobuf.merge(s, {fields = {c = {number_value = 1}}})
+			assert(s.fields:len() == 1 and s.fields.c.number_value == 1)
+			assert(protobuf.merge(s, copy) == s and s.fields:len() == 3)
+			protobuf.clear(s, "fields")
+			assert(not protobuf.has(s, "fields"))
+			local v, err = protobuf.from_json("google.protobuf.Struct", "{")
+			assert(v == nil and err)`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := newTestVM(t, nil).DoString(script); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestProtobufWellKnownTypes(t *testing.T) {
+	if _, err := LoadProtoDescriptorSet(testDescriptorSet(t)); err != nil {
+		t.Fatal(err)
+	}
+	for name, tc := range map[string]struct {
+		field, value, want string
+		err                bool
+	}{
+		"timestamp seconds": {field: "created", value: `10.5`, want: `10.5`},
+		"timestamp rfc3339": {field: "created", value: `"2024-01-02T03:04:05Z"`, want: `1704164645`},
+		"timestamp invalid": {field: "created", value: `"yesterday"`, err: true},
+		"duration seconds":  {field: "ttl", value: `1.5`, want: `1.5`},
+		"duration string":   {field: "ttl", value: `"1m30s"`, want: `90`},
+		"duration invalid":  {field: "ttl", value: `"soon"`, err: true},
+		"timestamp assign":  {field: "created", value: `0`, want: `0`},
+		"any message":       {field: "detail", value: `ProtobufMessage.New("mals.test.Task", {name = "inner"})`, want: `"inner"`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			L := newTestVM(t, nil)
+			script := `local task = ProtobufMessage.New("mals.test.Task", {` + tc.field + ` = ` + tc.value + `})` + "\n"
+			if tc.field == "detail" {
+				script += `assert(task.detail.name == ` + tc.want + `)`
+			} else {
+				script += `assert(task.` + tc.field + ` == ` + tc.want + `, tostring(task.` + tc.field + `))`
+			}
+			err := L.DoString(script)
+			if tc.err && err == nil {
+				t.Fatal("expected conversion to fail")
+			} else if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	// Go 一侧得到的是标准的 well-known message
+	L := newTestVM(t, nil)
+	if err := L.DoString(`task = ProtobufMessage.New("mals.test.Task", {created = "2024-01-02T03:04:05.5Z", ttl = "1m30s"})`); err != nil {
+		t.Fatal(err)
+	}
+	task := L.GetGlobal("task").(*lua.LUserData).Value.(proto.Message).ProtoReflect()
+	fields := task.Descriptor().Fields()
+	created, ttl := &timestamppb.Timestamp{}, &durationpb.Duration{}
+	proto.Merge(created, task.Get(fields.ByName("created")).Message().Interface())
+	proto.Merge(ttl, task.Get(fields.ByName("ttl")).Message().Interface())
+	if created.AsTime().UnixMilli() != 1704164645500 || ttl.AsDuration().Seconds() != 90 {
+		t.Fatalf("unexpected well-known values %v %v", created, ttl)
+	}
+}
+
+func TestProtobufDynamicDescriptor(t *testing.T) {
+	L := newTestVM(t, nil)
+	L.SetGlobal("descriptors", lua.LString(testDescriptorSet(t)))
+	if err := L.DoString(`
+		local protobuf = require("protobuf")
+		assert(protobuf.parse_descriptor_set(descriptors))
+		local none, err = protobuf.parse_descriptor_set("invalid")
+		assert(none == nil and err:find("invalid FileDescriptorSet"))
+
+		task = ProtobufMessage.New("mals.test.Task", {
+			name = "scan",
+			tags = {"a", "b"},
+			counts = {x = 1, y = 2},
+			state = "STATE_RUNNING",
+			detail = ProtobufMessage.New("mals.test.Task", {name = "inner"}),
+			children = {{name = "child", ttl = 1.5}},
+		})
+		assert(task.name == "scan" and task.state == "STATE_RUNNING")
+		assert(task.tags[2] == "b" and #task.tags == 2)
+		task.tags:append("c")
+		assert(task.counts.y == 2 and task.counts:len() == 2)
+		task.counts.z = 3
+		task.counts.x = nil
+		assert(task.detail.name == "inner")
+		assert(task.children[1].name == "child" and task.children[1].ttl == 1.5)
+
+		local decoded = protobuf.unmarshal("mals.test.Task", protobuf.marshal(task))
+		assert(protobuf.equal(decoded, task) and decoded.detail.name == "inner")
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	mt, err := FindProtoMessageType("mals.test.Task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := L.GetGlobal("task").(*lua.LUserData).Value.(proto.Message).ProtoReflect()
+	if task.Descriptor() != mt.Descriptor() {
+		t.Fatal("message not created from the loaded descriptor")
+	}
+	fields := task.Descriptor().Fields()
+	if tags := task.Get(fields.ByName("tags")).List(); tags.Len() != 3 || tags.Get(2).String() != "c" {
+		t.Fatalf("unexpected tags %v", tags)
+	}
+	counts := task.Get(fields.ByName("counts")).Map()
+	if counts.Len() != 2 || counts.Has(protoreflect.ValueOfString("x").MapKey()) || counts.Get(protoreflect.ValueOfString("z").MapKey()).Int() != 3 {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+
+	// 重复加载同一文件会被跳过
+	names, err := LoadProtoDescriptorSet(testDescriptorSet(t))
+	if err != nil || len(names) != 0 {
+		t.Fatalf("expected reload to be skipped, got %v: %v", names, err)
+	}
+}
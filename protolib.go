@@ -0,0 +1,216 @@
+package mals
+
+import (
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// RegisterProtobufMessage 生成的元表中保存 message 全名的字段
+const protoTypeNameField = "__proto"
+
+// ProtobufLoader is the loader of the lua "protobuf" module.
+//
+//	local protobuf = require("protobuf")
+//	local data = protobuf.marshal(req)
+//	local msg = protobuf.unmarshal("clientpb.Task", data)
+//	print(protobuf.to_json(msg, {indent = "  "}))
+//	protobuf.load_descriptor_set("service.pb")
+func ProtobufLoader(L *lua.LState) int {
+	mod := L.NewTable()
+	L.SetFuncs(mod, map[string]lua.LGFunction{
+		"marshal":   protobufMarshal,
+		"unmarshal": protobufUnmarshal,
+		"to_json":   protobufToJSON,
+		"from_json": protobufFromJSON,
+		"clone":     protobufClone,
+		"equal":     protobufEqual,
+		"merge":     protobufMerge,
+		"reset":     protobufReset,
+		"has":       protobufHas,
+		"clear":     protobufClear,
+
+		"load_descriptor_set":  protobufLoadDescriptorSet,
+		"parse_descriptor_set": protobufParseDescriptorSet,
+	})
+	L.Push(mod)
+	return 1
+}
+
+// checkProtoMessageType 解析第 n 个参数表示的 message 类型, 支持全名字符串, RegisterProtobufMessage 注册的元表以及 message 实例.
+// 返回的元表用于设置新 message 的元表, 为 nil 时使用 ProtobufMessage
+func checkProtoMessageType(L *lua.LState, n int) (protoreflect.MessageType, lua.LValue) {
+	switch v := L.Get(n).(type) {
+	case lua.LString:
+		mt, err := FindProtoMessageType(string(v))
+		if err != nil {
+			L.ArgError(n, err.Error())
+		}
+		return mt, nil
+	case *lua.LTable:
+		name, ok := L.GetField(v, protoTypeNameField).(lua.LString)
+		if !ok {
+			L.ArgError(n, "not a protobuf message type")
+		}
+		mt, err := FindProtoMessageType(string(name))
+		if err != nil {
+			L.ArgError(n, err.Error())
+		}
+		return mt, v
+	case *lua.LUserData:
+		if msg, ok := v.Value.(proto.Message); ok {
+			return msg.ProtoReflect().Type(), v.Metatable
+		}
+	}
+	L.ArgError(n, "message type name, type or instance expected")
+	return nil, nil
+}
+
+// pushProtoMessage 返回 msg, mt 不为 nil 时使用 mt 作为元表
+func pushProtoMessage(L *lua.LState, msg proto.Message, mt lua.LValue) {
+	if mt == nil || mt == lua.LNil {
+		L.Push(NewLuaProtoMessage(L, msg))
+		return
+	}
+	ud := L.NewUserData()
+	ud.Value = msg
+	L.SetMetatable(ud, mt)
+	L.Push(ud)
+}
+
+func pushProtoError(L *lua.LState, err error) int {
+	L.Push(lua.LNil)
+	L.Push(lua.LString(err.Error()))
+	return 2
+}
+
+// marshal(msg) 返回 wire 格式的 bytes
+func protobufMarshal(L *lua.LState) int {
+	data, err := proto.Marshal(checkProtoMessage(L, 1))
+	if err != nil {
+		return pushProtoError(L, err)
+	}
+	L.Push(lua.LString(data))
+	return 1
+}
+
+// unmarshal(type, bytes) 将 bytes 解析为 type 类型的 message
+func protobufUnmarshal(L *lua.LState) int {
+	mt, meta := checkProtoMessageType(L, 1)
+	msg := mt.New().Interface()
+	if err := proto.Unmarshal([]byte(L.CheckString(2)), msg); err != nil {
+		return pushProtoError(L, err)
+	}
+	pushProtoMessage(L, msg, meta)
+	return 1
+}
+
+// to_json(msg, opts) 使用 protojson 序列化, opts 支持 indent, use_proto_names, emit_unpopulated, use_enum_numbers
+func protobufToJSON(L *lua.LState) int {
+	msg := checkProtoMessage(L, 1)
+	var marshaler protojson.MarshalOptions
+	if opts := L.OptTable(2, nil); opts != nil {
+		marshaler.Indent = lua.LVAsString(L.GetField(opts, "indent"))
+		marshaler.UseProtoNames = lua.LVAsBool(L.GetField(opts, "use_proto_names"))
+		marshaler.EmitUnpopulated = lua.LVAsBool(L.GetField(opts, "emit_unpopulated"))
+		marshaler.UseEnumNumbers = lua.LVAsBool(L.GetField(opts, "use_enum_numbers"))
+	}
+	data, err := marshaler.Marshal(msg)
+	if err != nil {
+		return pushProtoError(L, err)
+	}
+	L.Push(lua.LString(data))
+	return 1
+}
+
+// from_json(type, json, opts) 解析 protojson, opts 支持 discard_unknown
+func protobufFromJSON(L *lua.LState) int {
+	mt, meta := checkProtoMessageType(L, 1)
+	var unmarshaler protojson.UnmarshalOptions
+	if opts := L.OptTable(3, nil); opts != nil {
+		unmarshaler.DiscardUnknown = lua.LVAsBool(L.GetField(opts, "discard_unknown"))
+	}
+	msg := mt.New().Interface()
+	if err := unmarshaler.Unmarshal([]byte(L.CheckString(2)), msg); err != nil {
+		return pushProtoError(L, err)
+	}
+	pushProtoMessage(L, msg, meta)
+	return 1
+}
+
+// clone(msg) 深拷贝, 保留原有的元表
+func protobufClone(L *lua.LState) int {
+	msg := checkProtoMessage(L, 1)
+	pushProtoMessage(L, proto.Clone(msg), L.CheckUserData(1).Metatable)
+	return 1
+}
+
+func protobufEqual(L *lua.LState) int {
+	L.Push(lua.LBool(proto.Equal(checkProtoMessage(L, 1), checkProtoMessage(L, 2))))
+	return 1
+}
+
+// merge(dst, src) 将 src 合并到 dst 并返回 dst, src 可以是同类型的 message 或 table
+func protobufMerge(L *lua.LState) int {
+	dst := checkProtoMessage(L, 1)
+	if err := SetProtoMessage(dst.ProtoReflect(), ConvertLuaValueToGo(L.CheckAny(2))); err != nil {
+		L.ArgError(2, err.Error())
+	}
+	L.Push(L.Get(1))
+	return 1
+}
+
+func protobufReset(L *lua.LState) int {
+	proto.Reset(checkProtoMessage(L, 1))
+	return 0
+}
+
+func checkProtoField(L *lua.LState, msg proto.Message, n int) protoreflect.FieldDescriptor {
+	md := msg.ProtoReflect().Descriptor()
+	name := L.CheckString(n)
+	fd := FindProtoField(md, name)
+	if fd == nil {
+		L.ArgError(n, fmt.Sprintf("%s has no field %s", md.FullName(), name))
+	}
+	return fd
+}
+
+// has(msg, field) 字段是否被设置, repeated 与 map 字段非空时为 true
+func protobufHas(L *lua.LState) int {
+	msg := checkProtoMessage(L, 1)
+	L.Push(lua.LBool(msg.ProtoReflect().Has(checkProtoField(L, msg, 2))))
+	return 1
+}
+
+func protobufClear(L *lua.LState) int {
+	msg := checkProtoMessage(L, 1)
+	msg.ProtoReflect().Clear(checkProtoField(L, msg, 2))
+	return 0
+}
+
+func pushProtoTypeNames(L *lua.LState, names []string, err error) int {
+	if err != nil {
+		return pushProtoError(L, err)
+	}
+	tbl := L.NewTable()
+	for _, name := range names {
+		tbl.Append(lua.LString(name))
+	}
+	L.Push(tbl)
+	return 1
+}
+
+// load_descriptor_set(path) 加载 FileDescriptorSet 文件, 返回新加载的 message 全名
+func protobufLoadDescriptorSet(L *lua.LState) int {
+	names, err := LoadProtoDescriptorSetFile(L.CheckString(1))
+	return pushProtoTypeNames(L, names, err)
+}
+
+// parse_descriptor_set(bytes) 加载 FileDescriptorSet 的二进制内容
+func protobufParseDescriptorSet(L *lua.LState) int {
+	names, err := LoadProtoDescriptorSet([]byte(L.CheckString(1)))
+	return pushProtoTypeNames(L, names, err)
+}
@@ -0,0 +1,231 @@
+package mals
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Registry keeps MalFunctions indexed by package and name.
+type Registry struct {
+	mu        sync.RWMutex
+	packages  map[string]map[string]*MalFunction
+	errorMode ErrorMode
+	// wrappers caches the lua wrappers of registered functions by *MalFunction.
+	wrappers sync.Map
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		packages: make(map[string]map[string]*MalFunction),
+	}
+}
+
+// NewRegistryFromMap builds a registry from the legacy name -> function map,
+// functions without a Name take the map key as their name. The caller's
+// functions are copied before naming, so the map is left untouched.
+func NewRegistryFromMap(fns map[string]*MalFunction) *Registry {
+	r := NewRegistry()
+	for name, fn := range fns {
+		if fn.Name == "" {
+			named := *fn
+			named.Name = name
+			fn = &named
+		}
+		r.Replace(fn)
+	}
+	return r
+}
+
+// SetErrorMode sets how errors are returned to lua for functions that
+// keep ErrorModeDefault.
+func (r *Registry) SetErrorMode(mode ErrorMode) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errorMode = mode
+}
+
+func (r *Registry) ErrorMode() ErrorMode {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.errorMode
+}
+
+// Register adds fn to its package, it fails if the name is already taken.
+func (r *Registry) Register(fn *MalFunction) error {
+	if fn == nil {
+		return fmt.Errorf("nil function")
+	}
+	if fn.Name == "" {
+		return fmt.Errorf("function %s has no name", fn.RawName)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	funcs, ok := r.packages[fn.Package]
+	if !ok {
+		funcs = make(map[string]*MalFunction)
+		r.packages[fn.Package] = funcs
+	}
+	if _, ok := funcs[fn.Name]; ok {
+		return fmt.Errorf("function %s already registered", fn.String())
+	}
+	funcs[fn.Name] = fn
+	return nil
+}
+
+// RegisterFunctions registers every fn, stopping at the first duplicate.
+func (r *Registry) RegisterFunctions(fns ...*MalFunction) error {
+	for _, fn := range fns {
+		if err := r.Register(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replace registers fn, overwriting any function with the same package and name.
+func (r *Registry) Replace(fn *MalFunction) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	funcs, ok := r.packages[fn.Package]
+	if !ok {
+		funcs = make(map[string]*MalFunction)
+		r.packages[fn.Package] = funcs
+	}
+	if old, ok := funcs[fn.Name]; ok {
+		deleteLuaFunctionCache(old, r)
+	}
+	funcs[fn.Name] = fn
+}
+
+// Unregister removes pkg.name and reports whether it was registered.
+func (r *Registry) Unregister(pkg, name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	funcs, ok := r.packages[pkg]
+	if !ok {
+		return false
+	}
+	fn, ok := funcs[name]
+	if !ok {
+		return false
+	}
+	deleteLuaFunctionCache(fn, r)
+	delete(funcs, name)
+	if len(funcs) == 0 {
+		delete(r.packages, pkg)
+	}
+	return true
+}
+
+// UnregisterPackage removes every function of pkg.
+func (r *Registry) UnregisterPackage(pkg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, fn := range r.packages[pkg] {
+		deleteLuaFunctionCache(fn, r)
+	}
+	delete(r.packages, pkg)
+}
+
+func (r *Registry) Get(pkg, name string) (*MalFunction, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	fn, ok := r.packages[pkg][name]
+	return fn, ok
+}
+
+func (r *Registry) HasPackage(pkg string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.packages[pkg]
+	return ok
+}
+
+// Packages returns the sorted names of all registered packages.
+func (r *Registry) Packages() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	pkgs := make([]string, 0, len(r.packages))
+	for pkg := range r.packages {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	return pkgs
+}
+
+// Package returns a copy of the name -> function map of pkg.
+func (r *Registry) Package(pkg string) map[string]*MalFunction {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	fns := make(map[string]*MalFunction, len(r.packages[pkg]))
+	for name, fn := range r.packages[pkg] {
+		fns[name] = fn
+	}
+	return fns
+}
+
+// Functions returns the functions of pkg sorted by name.
+func (r *Registry) Functions(pkg string) []*MalFunction {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	fns := make([]*MalFunction, 0, len(r.packages[pkg]))
+	for _, fn := range r.packages[pkg] {
+		fns = append(fns, fn)
+	}
+	sort.Slice(fns, func(i, j int) bool {
+		return fns[i].Name < fns[j].Name
+	})
+	return fns
+}
+
+// Groups returns the functions of pkg keyed by Helper.Group, functions
+// without a group are listed under "". Each group is sorted by name.
+func (r *Registry) Groups(pkg string) map[string][]*MalFunction {
+	groups := make(map[string][]*MalFunction)
+	for _, fn := range r.Functions(pkg) {
+		var group string
+		if fn.Helper != nil {
+			group = fn.Helper.Group
+		}
+		groups[group] = append(groups[group], fn)
+	}
+	return groups
+}
+
+// GroupNames returns the sorted group names of pkg.
+func (r *Registry) GroupNames(pkg string) []string {
+	var names []string
+	for group := range r.Groups(pkg) {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PackageLoader returns a lua module loader exposing only the functions of pkg.
+func (r *Registry) PackageLoader(pkg string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		mod := L.NewTable()
+		L.SetField(mod, "_NAME", lua.LString(pkg))
+		for _, fn := range r.Functions(pkg) {
+			mod.RawSetString(fn.Name, L.NewFunction(wrapFuncForLua(fn, r)))
+		}
+		L.Push(mod)
+		return 1
+	}
+}
+
+// Loader is a lua module loader that resolves the package by the required name.
+func (r *Registry) Loader(L *lua.LState) int {
+	return r.PackageLoader(L.ToString(1))(L)
+}
+
+// Preload registers every package of the registry in package.preload.
+func (r *Registry) Preload(L *lua.LState) {
+	for _, pkg := range r.Packages() {
+		L.PreloadModule(pkg, r.PackageLoader(pkg))
+	}
+}
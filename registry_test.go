@@ -0,0 +1,120 @@
+package mals
+
+import (
+	"errors"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// newTestVM 创建预加载了 r 中所有包的 VM, 测试结束时关闭
+func newTestVM(t *testing.T, r *Registry, opts ...VMOption) *lua.LState {
+	L := NewLuaVM(opts...)
+	if r != nil {
+		r.Preload(L)
+	}
+	t.Cleanup(L.Close)
+	return L
+}
+
+func newTestFunction(pkg, name string, fn interface{}) *MalFunction {
+	malFn := WrapInternalFunc(fn)
+	malFn.Package, malFn.Name = pkg, name
+	return malFn
+}
+
+func TestRegistryRegister(t *testing.T) {
+	for name, tc := range map[string]struct {
+		fns []*MalFunction
+		err bool
+	}{
+		"distinct":  {fns: []*MalFunction{{Package: "a", Name: "f"}, {Package: "a", Name: "g"}, {Package: "b", Name: "f"}}},
+		"duplicate": {fns: []*MalFunction{{Package: "a", Name: "f"}, {Package: "a", Name: "f"}}, err: true},
+		"no name":   {fns: []*MalFunction{{Package: "a", RawName: "raw"}}, err: true},
+		"nil":       {fns: []*MalFunction{nil}, err: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := NewRegistry()
+			err := r.RegisterFunctions(tc.fns...)
+			if tc.err != (err != nil) {
+				t.Fatalf("unexpected error %v", err)
+			}
+		})
+	}
+
+	r := NewRegistry()
+	first := &MalFunction{Package: "a", Name: "f"}
+	if err := r.Register(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(&MalFunction{Package: "a", Name: "f"}); err == nil {
+		t.Fatal("expected duplicate to be rejected")
+	}
+	if fn, ok := r.Get("a", "f"); !ok || fn != first {
+		t.Fatal("duplicate registration replaced the original function")
+	}
+}
+
+func TestRegistryLoader(t *testing.T) {
+	r := NewRegistry()
+	if err := r.RegisterFunctions(
+		newTestFunction("calc", "add", func(a, b int) int { return a + b }),
+		newTestFunction("other", "hidden", func() string { return "hidden" }),
+	); err != nil {
+		t.Fatal(err)
+	}
+	L := newTestVM(t, r)
+	if err := L.DoString(`
+		local calc = require("calc")
+		assert(calc.add(1, 2) == 3)
+		assert(calc.hidden == nil, "functions of other packages leaked into calc")
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace 之后新的 VM 使用新的函数, 而不是缓存的包装
+	r.Replace(newTestFunction("calc", "add", func(a, b int) int { return a * b }))
+	if err := newTestVM(t, r).DoString(`assert(require("calc").add(2, 3) == 6)`); err != nil {
+		t.Fatal(err)
+	}
+	if !r.Unregister("calc", "add") || r.HasPackage("calc") {
+		t.Fatal("expected calc to be removed with its last function")
+	}
+}
+
+func TestRegistryErrorMode(t *testing.T) {
+	fail := func() (string, error) {
+		return "", NewMalError(7, "boom", errors.New("cause"))
+	}
+	for name, tc := range map[string]struct {
+		registry ErrorMode
+		function ErrorMode
+		script   string
+	}{
+		"raise by default": {script: `
+			local ok, err = pcall(m.fail)
+			assert(not ok and tostring(err):find("boom"))`},
+		"registry return": {registry: ErrorModeReturn, script: `
+			local v, err = m.fail()
+			assert(v == nil and err == "boom: cause")`},
+		"registry object": {registry: ErrorModeObject, script: `
+			local v, err = m.fail()
+			assert(v == nil and err.code == 7 and err.message == "boom" and err.cause == "cause")`},
+		"function overrides registry": {registry: ErrorModeObject, function: ErrorModeReturn, script: `
+			local v, err = m.fail()
+			assert(type(err) == "string")`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := NewRegistry()
+			fn := newTestFunction("m", "fail", fail)
+			fn.ErrorMode = tc.function
+			if err := r.Register(fn); err != nil {
+				t.Fatal(err)
+			}
+			r.SetErrorMode(tc.registry)
+			if err := newTestVM(t, r).DoString(`local m = require("m")` + tc.script); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,639 @@
+package mals
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cjoudrey/gluahttp"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Capability 表示 VM 可以使用的一类敏感能力
+type Capability uint
+
+const (
+	CapExec          Capability = 1 << iota // 执行命令, os.execute, io.popen, cmd
+	CapFSRead                               // 读取文件, io.open("r"), dofile, 从文件 require, ioutil.read_file
+	CapFSWrite                              // 写入文件, io.open("w"), os.remove, ioutil.write_file, storage
+	CapNetwork                              // 网络访问, http, tcp
+	CapDB                                   // 数据库, db. sqlite 的 DSN 受 fs 路径限制, 但 ATTACH 等语句仍可访问其他文件, 授予 db 即视为授予文件访问
+	CapOSInfo                               // 主机信息, os.getenv, goos.hostname
+	CapProtoRegistry                        // 向进程内所有 VM 共享的 protobuf 类型注册表加载 descriptor, protobuf.load_descriptor_set/parse_descriptor_set
+
+	CapNone Capability = 0
+	CapAll             = CapExec | CapFSRead | CapFSWrite | CapNetwork | CapDB | CapOSInfo | CapProtoRegistry
+)
+
+var capabilityNames = []struct {
+	cap  Capability
+	name string
+}{
+	{CapExec, "exec"},
+	{CapFSRead, "fs_read"},
+	{CapFSWrite, "fs_write"},
+	{CapNetwork, "network"},
+	{CapDB, "db"},
+	{CapOSInfo, "os_info"},
+	{CapProtoRegistry, "proto_registry"},
+}
+
+func (c Capability) String() string {
+	var names []string
+	for _, item := range capabilityNames {
+		if c&item.cap != 0 {
+			names = append(names, item.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseCapability 解析 "exec", "fs_read" 等名称, "all" 表示全部能力
+func ParseCapability(name string) (Capability, error) {
+	if name == "all" {
+		return CapAll, nil
+	}
+	for _, item := range capabilityNames {
+		if item.name == name {
+			return item.cap, nil
+		}
+	}
+	return CapNone, fmt.Errorf("unknown capability %s", name)
+}
+
+// Sandbox 描述 VM 被授予的能力, 通过 WithSandbox 传给 NewLuaVM.
+// 范围列表为空时只检查 Capabilities, 不为空时访问的路径, 主机或数据库驱动必须在列表中
+type Sandbox struct {
+	Capabilities Capability
+	// ReadPaths 可读的目录或文件, WritePaths 中的路径同样可读
+	ReadPaths  []string
+	WritePaths []string
+	// Hosts 可以访问的主机, 支持 "example.com", "example.com:443", "*.example.com" 与 "*"
+	Hosts []string
+	// DBDrivers 可以使用的数据库驱动, 如 "sqlite3", "mysql"
+	DBDrivers []string
+}
+
+func NewSandbox(caps Capability) *Sandbox {
+	return &Sandbox{Capabilities: caps}
+}
+
+// Allow 报告是否拥有 caps 中的全部能力
+func (sb *Sandbox) Allow(caps Capability) bool {
+	return sb.Capabilities&caps == caps
+}
+
+// Check 在缺少能力时返回 error, name 为脚本调用的函数名
+func (sb *Sandbox) Check(name string, caps Capability) error {
+	if sb.Allow(caps) {
+		return nil
+	}
+	return fmt.Errorf("permission denied: %s requires %s capability", name, caps&^sb.Capabilities)
+}
+
+// CheckPath 检查 path 是否在允许读取或写入的范围内
+func (sb *Sandbox) CheckPath(name, path string, write bool) error {
+	caps, roots := CapFSRead, append(append([]string{}, sb.ReadPaths...), sb.WritePaths...)
+	if write {
+		caps, roots = CapFSWrite, sb.WritePaths
+	}
+	if err := sb.Check(name, caps); err != nil {
+		return err
+	}
+	if len(sb.ReadPaths) == 0 && len(sb.WritePaths) == 0 {
+		return nil
+	}
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return fmt.Errorf("permission denied: %s %s: %v", name, path, err)
+	}
+	for _, root := range roots {
+		if root, err := resolvePath(root); err == nil && withinPath(root, resolved) {
+			return nil
+		}
+	}
+	return fmt.Errorf("permission denied: %s %s is outside of the allowed %s paths", name, path, caps)
+}
+
+// resolvePath 返回 path 解析符号链接后的绝对路径.
+// path 不存在时解析最近的已存在的上级目录, 避免通过目录中的符号链接访问范围之外的文件
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	dir, rest := abs, ""
+	for {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return abs, nil
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+		dir = parent
+	}
+}
+
+func withinPath(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// CheckHost 检查是否允许连接 address, address 可以是 URL, host 或 host:port
+func (sb *Sandbox) CheckHost(name, address string) error {
+	if err := sb.Check(name, CapNetwork); err != nil {
+		return err
+	}
+	if len(sb.Hosts) == 0 {
+		return nil
+	}
+	host, port := address, ""
+	if u, err := url.Parse(address); err == nil && u.Host != "" {
+		host, port = u.Hostname(), u.Port()
+	} else if h, p, err := net.SplitHostPort(address); err == nil {
+		host, port = h, p
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range sb.Hosts {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" {
+			return nil
+		}
+		patternHost, patternPort := pattern, ""
+		if h, p, err := net.SplitHostPort(pattern); err == nil {
+			patternHost, patternPort = h, p
+		}
+		if patternPort != "" && patternPort != port {
+			continue
+		}
+		if patternHost == host || strings.HasPrefix(patternHost, "*.") && strings.HasSuffix(host, patternHost[1:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("permission denied: %s %s is not an allowed host", name, address)
+}
+
+// CheckDBDriver 检查是否允许使用数据库驱动 driver
+func (sb *Sandbox) CheckDBDriver(name, driver string) error {
+	if err := sb.Check(name, CapDB); err != nil {
+		return err
+	}
+	if len(sb.DBDrivers) == 0 {
+		return nil
+	}
+	for _, allowed := range sb.DBDrivers {
+		if allowed == driver {
+			return nil
+		}
+	}
+	return fmt.Errorf("permission denied: %s driver %s is not allowed", name, driver)
+}
+
+// CheckDB 检查是否允许以 dsn 打开数据库, sqlite3 的 DSN 是文件路径, 需要同时满足写入路径的限制
+func (sb *Sandbox) CheckDB(name, driver, dsn string) error {
+	if err := sb.CheckDBDriver(name, driver); err != nil {
+		return err
+	}
+	if driver != "sqlite3" {
+		return nil
+	}
+	path := strings.TrimPrefix(dsn, "file:")
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	if path == "" || path == ":memory:" {
+		return nil
+	}
+	return sb.CheckPath(name, path, true)
+}
+
+type vmConfig struct {
+	sandbox *Sandbox
+	limits  *Limits
+}
+
+// VMOption 配置 NewLuaVM
+type VMOption func(*vmConfig)
+
+// WithSandbox 按照 sb 限制 VM 的能力
+func WithSandbox(sb *Sandbox) VMOption {
+	return func(config *vmConfig) {
+		config.sandbox = sb
+	}
+}
+
+// WithCapabilities 只授予 VM caps 中的能力
+func WithCapabilities(caps Capability) VMOption {
+	return WithSandbox(NewSandbox(caps))
+}
+
+// capabilityCheck 在被保护的函数调用前执行, 可以根据参数决定需要的能力
+type capabilityCheck func(L *lua.LState, sb *Sandbox, name string) error
+
+func need(caps Capability) capabilityCheck {
+	return func(L *lua.LState, sb *Sandbox, name string) error {
+		return sb.Check(name, caps)
+	}
+}
+
+// needPath 检查第 n 个参数中的路径
+func needPath(n int, write bool) capabilityCheck {
+	return func(L *lua.LState, sb *Sandbox, name string) error {
+		return sb.CheckPath(name, L.CheckString(n), write)
+	}
+}
+
+// needAll 依次执行 checks, 全部通过时才允许调用
+func needAll(checks ...capabilityCheck) capabilityCheck {
+	return func(L *lua.LState, sb *Sandbox, name string) error {
+		for _, check := range checks {
+			if err := check(L, sb, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// needHost 检查第 n 个参数中的地址
+func needHost(n int) capabilityCheck {
+	return func(L *lua.LState, sb *Sandbox, name string) error {
+		return sb.CheckHost(name, L.CheckString(n))
+	}
+}
+
+// needTempDir 用于 os.tmpname 等在临时目录创建文件的函数
+func needTempDir(L *lua.LState, sb *Sandbox, name string) error {
+	return sb.CheckPath(name, os.TempDir(), true)
+}
+
+// 需要整体授权的模块, 未授权时 require 得到的模块在访问任意字段时报错
+var moduleCapabilities = map[string]Capability{
+	"cmd":     CapExec,
+	"http":    CapNetwork,
+	"tcp":     CapNetwork,
+	"db":      CapDB,
+	"storage": CapFSRead | CapFSWrite,
+}
+
+// 按函数授权的模块
+var functionCapabilities = map[string]map[string]capabilityCheck{
+	"ioutil": {
+		"read_file":  needPath(1, false),
+		"write_file": needPath(1, true),
+	},
+	"goos": {
+		"stat":         needPath(1, false),
+		"hostname":     need(CapOSInfo),
+		"get_pagesize": need(CapOSInfo),
+		"mkdir_all":    needPath(1, true),
+	},
+	"filepath": {
+		"glob": func(L *lua.LState, sb *Sandbox, name string) error {
+			return sb.CheckPath(name, globBase(L.CheckString(1)), false)
+		},
+		"eval_symlinks": needPath(1, false),
+	},
+	"log": {
+		"new": logOutputCheck(1),
+	},
+	"storage": {
+		"open": needPath(1, true),
+	},
+	"http": {
+		"get":    needHost(1),
+		"delete": needHost(1),
+		"head":   needHost(1),
+		"patch":  needHost(1),
+		"post":   needHost(1),
+		"put":    needHost(1),
+		"request": func(L *lua.LState, sb *Sandbox, name string) error {
+			return sb.CheckHost(name, L.CheckString(2))
+		},
+		"request_batch": func(L *lua.LState, sb *Sandbox, name string) error {
+			var err error
+			L.CheckTable(1).ForEach(func(_, value lua.LValue) {
+				if req, ok := value.(*lua.LTable); ok && err == nil {
+					err = sb.CheckHost(name, req.RawGetInt(2).String())
+				}
+			})
+			return err
+		},
+	},
+	"tcp": {
+		"open": needHost(1),
+	},
+	"db": {
+		"open": func(L *lua.LState, sb *Sandbox, name string) error {
+			return sb.CheckDB(name, L.CheckString(1), L.CheckString(2))
+		},
+	},
+	// 加载的类型对进程内所有 VM 可见, 可以遮蔽其他 mal 使用的类型
+	"protobuf": {
+		"load_descriptor_set":  needAll(need(CapProtoRegistry), needPath(1, false)),
+		"parse_descriptor_set": need(CapProtoRegistry),
+	},
+}
+
+// 模块加载后注册的 userdata 元表中的方法
+var methodCapabilities = map[string]map[string]map[string]capabilityCheck{
+	"log": {
+		"logger_ud": {"set_output": logOutputCheck(2)},
+	},
+	"template": {
+		"template_ud": {"render_file": needPath(2, false)},
+	},
+}
+
+var baseCapabilities = map[string]capabilityCheck{
+	"dofile":   needPath(1, false),
+	"loadfile": needPath(1, false),
+}
+
+var osCapabilities = map[string]capabilityCheck{
+	"execute": need(CapExec),
+	"exit":    need(CapExec),
+	"getenv":  need(CapOSInfo),
+	"setenv":  need(CapOSInfo),
+	"remove":  needPath(1, true),
+	"rename": func(L *lua.LState, sb *Sandbox, name string) error {
+		if err := sb.CheckPath(name, L.CheckString(1), true); err != nil {
+			return err
+		}
+		return sb.CheckPath(name, L.CheckString(2), true)
+	},
+	"tmpname": needTempDir,
+}
+
+var ioCapabilities = map[string]capabilityCheck{
+	"open": func(L *lua.LState, sb *Sandbox, name string) error {
+		return sb.CheckPath(name, L.CheckString(1), fileModeCapability(L.OptString(2, "r")) == CapFSWrite)
+	},
+	"lines": func(L *lua.LState, sb *Sandbox, name string) error {
+		if L.GetTop() == 0 {
+			return nil
+		}
+		return sb.CheckPath(name, L.CheckString(1), false)
+	},
+	"input": func(L *lua.LState, sb *Sandbox, name string) error {
+		if path, ok := L.Get(1).(lua.LString); ok {
+			return sb.CheckPath(name, string(path), false)
+		}
+		return nil
+	},
+	"output": func(L *lua.LState, sb *Sandbox, name string) error {
+		if path, ok := L.Get(1).(lua.LString); ok {
+			return sb.CheckPath(name, string(path), true)
+		}
+		return nil
+	},
+	"popen":   need(CapExec),
+	"tmpfile": needTempDir,
+}
+
+// globBase 返回 glob 模式中第一个通配符之前的目录
+func globBase(pattern string) string {
+	if i := strings.IndexAny(pattern, "*?["); i >= 0 {
+		return filepath.Dir(pattern[:i] + "x")
+	}
+	return pattern
+}
+
+// fileModeCapability 返回 io.open 的 mode 需要的能力
+func fileModeCapability(mode string) Capability {
+	if strings.ContainsAny(mode, "wa+") {
+		return CapFSWrite
+	}
+	return CapFSRead
+}
+
+// log 输出到 stdout/stderr 以外的路径时需要写文件
+func logOutputCheck(n int) capabilityCheck {
+	return func(L *lua.LState, sb *Sandbox, name string) error {
+		output := L.OptString(n, "")
+		switch output {
+		case "", "-", "STDOUT", "STDERR":
+			return nil
+		}
+		return sb.CheckPath(name, output, true)
+	}
+}
+
+// Apply 按照 sb 限制已经执行过 LoadLib 的 VM:
+// os, io 与 dofile/loadfile 替换为检查能力的版本, 受限模块在调用时报错,
+// require 只能从允许读取的路径加载 lua 文件, http 的重定向同样受 Hosts 限制.
+// load/loadstring 只接受文本代码, 加载的代码运行在受限后的环境中;
+// debug 只保留 traceback, 避免通过 upvalue 与元表取得被替换前的函数
+func (sb *Sandbox) Apply(L *lua.LState) {
+	guardFunctions(L, L.G.Global, "", baseCapabilities, sb)
+	L.SetGlobal("load", L.NewFunction(sandboxLoad))
+	L.SetGlobal("loadstring", L.NewFunction(sandboxLoad))
+	restrictDebug(L)
+	if os, ok := L.GetGlobal("os").(*lua.LTable); ok {
+		guardFunctions(L, os, "os.", osCapabilities, sb)
+	}
+	if io, ok := L.GetGlobal("io").(*lua.LTable); ok {
+		guardFunctions(L, io, "io.", ioCapabilities, sb)
+	}
+
+	if loaders, ok := L.GetField(L.Get(lua.RegistryIndex), "_LOADERS").(*lua.LTable); ok {
+		for i := 2; i <= loaders.Len(); i++ {
+			loaders.RawSetInt(i, L.NewFunction(sb.fileLoader))
+		}
+	}
+
+	preload, ok := L.GetField(L.GetField(L.Get(lua.EnvironIndex), "package"), "preload").(*lua.LTable)
+	if !ok {
+		return
+	}
+	if len(sb.Hosts) > 0 && sb.Allow(CapNetwork) {
+		preload.RawSetString("http", L.NewFunction(gluahttp.NewHttpModule(sb.httpClient()).Loader))
+	}
+	preload.ForEach(func(key, value lua.LValue) {
+		module := key.String()
+		loader, ok := value.(*lua.LFunction)
+		if !ok {
+			return
+		}
+		if caps, ok := moduleCapabilities[module]; ok && !sb.Allow(caps) {
+			preload.RawSet(key, L.NewFunction(deniedModuleLoader(module, sb.Check(module, caps))))
+			return
+		}
+		functions, hasFunctions := functionCapabilities[module]
+		methods, hasMethods := methodCapabilities[module]
+		if !hasFunctions && !hasMethods {
+			return
+		}
+		preload.RawSet(key, L.NewFunction(func(L *lua.LState) int {
+			base := L.GetTop()
+			L.Push(loader)
+			L.Push(lua.LString(module))
+			L.Call(1, 1)
+			if mod, ok := L.Get(-1).(*lua.LTable); ok {
+				guardFunctions(L, mod, module+".", functions, sb)
+			}
+			for typeName, fns := range methods {
+				if mt, ok := L.GetTypeMetatable(typeName).(*lua.LTable); ok {
+					if index, ok := L.GetField(mt, "__index").(*lua.LTable); ok {
+						guardFunctions(L, index, module+".", fns, sb)
+					}
+				}
+			}
+			return L.GetTop() - base
+		}))
+	})
+}
+
+// sandboxLoad 替换 load 与 loadstring, chunk 可以是字符串或返回代码片段的函数.
+// 拒绝二进制 chunk, 第 4 个参数为 table 时作为加载的函数的环境, 否则使用受限后的全局环境
+func sandboxLoad(L *lua.LState) int {
+	var source string
+	switch chunk := L.CheckAny(1).(type) {
+	case lua.LString:
+		source = string(chunk)
+	case *lua.LFunction:
+		var buf strings.Builder
+		for {
+			L.Push(chunk)
+			L.Call(0, 1)
+			piece := L.Get(-1)
+			L.Pop(1)
+			if piece == lua.LNil {
+				break
+			}
+			str, ok := piece.(lua.LString)
+			if !ok {
+				L.Push(lua.LNil)
+				L.Push(lua.LString("reader function must return a string"))
+				return 2
+			}
+			if str == "" {
+				break
+			}
+			buf.WriteString(string(str))
+		}
+		source = buf.String()
+	default:
+		L.ArgError(1, "string or function expected")
+		return 0
+	}
+	chunkname := L.OptString(2, "=(load)")
+	if mode := L.OptString(3, "t"); !strings.Contains(mode, "t") || strings.HasPrefix(source, "\x1b") {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("attempt to load a binary chunk in sandbox"))
+		return 2
+	}
+	fn, err := L.Load(strings.NewReader(source), chunkname)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	if env, ok := L.Get(4).(*lua.LTable); ok {
+		fn.Env = env
+	}
+	L.Push(fn)
+	return 1
+}
+
+// restrictDebug 将 debug 库替换为只包含 traceback 的表
+func restrictDebug(L *lua.LState) {
+	debug := L.NewTable()
+	if original, ok := L.GetGlobal(lua.DebugLibName).(*lua.LTable); ok {
+		debug.RawSetString("traceback", original.RawGetString("traceback"))
+	}
+	L.SetGlobal(lua.DebugLibName, debug)
+	if loaded, ok := L.GetField(L.Get(lua.RegistryIndex), "_LOADED").(*lua.LTable); ok {
+		loaded.RawSetString(lua.DebugLibName, debug)
+	}
+}
+
+// fileLoader 替换 require 默认的文件加载器, 只加载 package.path 中允许读取的文件
+func (sb *Sandbox) fileLoader(L *lua.LState) int {
+	name := strings.Replace(L.CheckString(1), ".", string(os.PathSeparator), -1)
+	paths, _ := L.GetField(L.GetField(L.Get(lua.EnvironIndex), "package"), "path").(lua.LString)
+	var messages []string
+	for _, pattern := range strings.Split(string(paths), ";") {
+		path := strings.Replace(pattern, "?", name, -1)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := sb.CheckPath("require", path, false); err != nil {
+			messages = append(messages, err.Error())
+			continue
+		}
+		fn, err := L.LoadFile(path)
+		if err != nil {
+			L.RaiseError("%s", err.Error())
+		}
+		L.Push(fn)
+		return 1
+	}
+	if len(messages) == 0 {
+		messages = append(messages, fmt.Sprintf("no allowed file for module %s in package.path", L.CheckString(1)))
+	}
+	L.Push(lua.LString("\n\t" + strings.Join(messages, "\n\t")))
+	return 1
+}
+
+// httpClient 在建立连接时检查地址, 重定向到其他主机同样会被拒绝
+func (sb *Sandbox) httpClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if err := sb.CheckHost("http", addr); err != nil {
+					return nil, err
+				}
+				return dialer.DialContext(ctx, network, addr)
+			},
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// guardFunctions 将 tbl 中的 Go 函数替换为先执行 check 的版本
+func guardFunctions(L *lua.LState, tbl *lua.LTable, prefix string, checks map[string]capabilityCheck, sb *Sandbox) {
+	for name, check := range checks {
+		fn, ok := L.GetField(tbl, name).(*lua.LFunction)
+		if !ok || !fn.IsG {
+			continue
+		}
+		original, check, fullName := fn.GFunction, check, prefix+name
+		L.SetField(tbl, name, L.NewFunction(func(L *lua.LState) int {
+			if err := check(L, sb, fullName); err != nil {
+				L.RaiseError("%s", err.Error())
+			}
+			return original(L)
+		}))
+	}
+}
+
+// deniedModuleLoader 返回的模块可以被 require, 访问其中任何字段时报告缺少的能力
+func deniedModuleLoader(module string, err error) lua.LGFunction {
+	return func(L *lua.LState) int {
+		mod := L.NewTable()
+		mt := L.NewTable()
+		L.SetField(mt, "__index", L.NewFunction(func(L *lua.LState) int {
+			L.RaiseError("%s.%s: %s", module, L.CheckString(2), err.Error())
+			return 0
+		}))
+		L.SetMetatable(mod, mt)
+		L.Push(mod)
+		return 1
+	}
+}
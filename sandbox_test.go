@@ -0,0 +1,120 @@
+package mals
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestSandboxCapabilities(t *testing.T) {
+	for name, tc := range map[string]struct {
+		caps   Capability
+		script string
+		denied bool
+	}{
+		"io.open read denied":        {caps: CapNone, script: `io.open(dir .. "/file.txt")`, denied: true},
+		"io.open read":               {caps: CapFSRead, script: `assert(io.open(dir .. "/file.txt")):close()`},
+		"io.open write denied":       {caps: CapFSRead, script: `io.open(dir .. "/file.txt", "a")`, denied: true},
+		"io.open write":              {caps: CapFSWrite, script: `assert(io.open(dir .. "/new.txt", "w")):close()`},
+		"dofile denied":              {caps: CapNone, script: `dofile(dir .. "/file.txt")`, denied: true},
+		"os.execute denied":          {caps: CapFSRead | CapFSWrite, script: `os.execute("true")`, denied: true},
+		"io.popen denied":            {caps: CapNone, script: `io.popen("true")`, denied: true},
+		"os.getenv denied":           {caps: CapNone, script: `os.getenv("HOME")`, denied: true},
+		"os.getenv":                  {caps: CapOSInfo, script: `os.getenv("HOME")`},
+		"os.remove denied":           {caps: CapFSRead, script: `os.remove(dir .. "/file.txt")`, denied: true},
+		"cmd module denied":          {caps: CapNone, script: `local cmd = require("cmd"); cmd.exec("true")`, denied: true},
+		"http module denied":         {caps: CapNone, script: `require("http").get("http://127.0.0.1")`, denied: true},
+		"ioutil read denied":         {caps: CapNone, script: `require("ioutil").read_file(dir .. "/file.txt")`, denied: true},
+		"ioutil read":                {caps: CapFSRead, script: `assert(require("ioutil").read_file(dir .. "/file.txt") == "data")`},
+		"descriptor set denied":      {caps: CapAll &^ CapProtoRegistry, script: `require("protobuf").parse_descriptor_set("")`, denied: true},
+		"descriptor set":             {caps: CapProtoRegistry, script: `require("protobuf").parse_descriptor_set("")`},
+		"load rejects binary chunks": {caps: CapNone, script: `local fn, err = load("\27Lua"); assert(fn == nil and err:find("binary"))`},
+		"debug is restricted":        {caps: CapNone, script: `assert(debug.getupvalue == nil and debug.traceback ~= nil)`},
+		"safe modules":               {caps: CapNone, script: `assert(require("json").encode({1}) == "[1]")`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("data"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			L := newTestVM(t, nil, WithCapabilities(tc.caps))
+			L.SetGlobal("dir", lua.LString(dir))
+			err := L.DoString(tc.script)
+			if tc.denied {
+				if err == nil || !strings.Contains(err.Error(), "permission denied") {
+					t.Fatalf("expected permission denied, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCheckPathSymlinkEscape(t *testing.T) {
+	base := t.TempDir()
+	allowed, outside := filepath.Join(base, "allowed"), filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(allowed, "sub"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for path, content := range map[string]string{
+		filepath.Join(allowed, "file.txt"):   "ok",
+		filepath.Join(outside, "secret.txt"): "secret",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		filepath.Join(allowed, "link.txt"):  filepath.Join(outside, "secret.txt"),
+		filepath.Join(allowed, "dirlink"):   outside,
+		filepath.Join(allowed, "inner.txt"): filepath.Join(allowed, "file.txt"),
+		filepath.Join(base, "rootlink"):     allowed,
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+	}
+
+	for name, tc := range map[string]struct {
+		roots   []string
+		path    string
+		allowed bool
+	}{
+		"file":                  {roots: []string{allowed}, path: filepath.Join(allowed, "file.txt"), allowed: true},
+		"new file":              {roots: []string{allowed}, path: filepath.Join(allowed, "sub", "new", "file.txt"), allowed: true},
+		"symlink inside":        {roots: []string{allowed}, path: filepath.Join(allowed, "inner.txt"), allowed: true},
+		"symlinked root":        {roots: []string{filepath.Join(base, "rootlink")}, path: filepath.Join(allowed, "file.txt"), allowed: true},
+		"dot dot":               {roots: []string{allowed}, path: filepath.Join(allowed, "..", "outside", "secret.txt")},
+		"symlink escape":        {roots: []string{allowed}, path: filepath.Join(allowed, "link.txt")},
+		"symlinked dir escape":  {roots: []string{allowed}, path: filepath.Join(allowed, "dirlink", "secret.txt")},
+		"new file through link": {roots: []string{allowed}, path: filepath.Join(allowed, "dirlink", "new", "file.txt")},
+		"prefix sibling":        {roots: []string{allowed}, path: allowed + "2"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			sb := &Sandbox{Capabilities: CapFSRead | CapFSWrite, WritePaths: tc.roots}
+			for _, write := range []bool{false, true} {
+				err := sb.CheckPath("test", tc.path, write)
+				if tc.allowed && err != nil {
+					t.Fatal(err)
+				} else if !tc.allowed && err == nil {
+					t.Fatalf("expected %s to be denied (write=%v)", tc.path, write)
+				}
+			}
+		})
+	}
+
+	// ReadPaths 只允许读取
+	sb := &Sandbox{Capabilities: CapFSRead | CapFSWrite, ReadPaths: []string{allowed}}
+	if err := sb.CheckPath("test", filepath.Join(allowed, "file.txt"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.CheckPath("test", filepath.Join(allowed, "file.txt"), true); err == nil {
+		t.Fatal("expected write outside of WritePaths to be denied")
+	}
+}